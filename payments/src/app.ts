@@ -4,6 +4,7 @@ import { UnlockStore } from '@/db/unlockStore';
 import { createPaymentsRouter } from '@/routes/payments';
 import { AnalyticsStore } from '@/analytics/analyticsStore';
 import { createAnalyticsRouter } from '@/routes/analytics';
+import { getJwks } from '@/services/jwks';
 
 export type AppDeps = {
   unlockStore?: UnlockStore;
@@ -25,12 +26,20 @@ export function createApp(deps: AppDeps = {}) {
     res.status(200).json({ status: 'ok' });
   });
 
+  app.get('/.well-known/jwks.json', (_req, res) => {
+    res.set('Cache-Control', 'public, max-age=300');
+    res.status(200).json(getJwks());
+  });
+
   app.use('/analytics', createAnalyticsRouter({ store: analyticsStore }));
   const paymentsRouterDeps = {
     unlockStore,
     ...(env.PROXY_UNLOCK_WEBHOOK
       ? { unlockWebhookUrl: env.PROXY_UNLOCK_WEBHOOK }
       : {}),
+    ...(env.UNLOCK_WEBHOOK_SECRET
+      ? { unlockWebhookSecret: env.UNLOCK_WEBHOOK_SECRET }
+      : {}),
   };
 
   app.use('/', createPaymentsRouter(paymentsRouterDeps));
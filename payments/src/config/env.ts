@@ -6,6 +6,30 @@ config();
 const schema = z.object({
   HELIUS_RPC_URL: z.string().url({ message: 'HELIUS_RPC_URL must be a valid URL' }),
   JWT_SECRET: z.string().min(32, { message: 'JWT_SECRET must be at least 32 characters' }),
+  JWT_PRIVATE_KEY_PATH: z
+    .string()
+    .optional()
+    .or(z.literal(''))
+    .transform((value) => (value === '' ? undefined : value)),
+  JWT_KEY_ID: z
+    .string()
+    .optional()
+    .or(z.literal(''))
+    .transform((value) => (value === '' ? undefined : value)),
+  JWT_RETIRED_PUBLIC_KEY_PATHS: z
+    .string()
+    .optional()
+    .transform((value) =>
+      (value ?? '')
+        .split(',')
+        .map((path) => path.trim())
+        .filter(Boolean)
+    ),
+  JWT_AUDIENCE: z
+    .string()
+    .optional()
+    .or(z.literal(''))
+    .transform((value) => (value === '' ? undefined : value)),
   PORT: z.coerce.number().int().positive().default(4000),
   UNLOCK_DB_PATH: z.string().default('data/unlocks.json'),
   USDC_MINT_ADDRESS: z
@@ -22,6 +46,12 @@ const schema = z.object({
     .optional()
     .or(z.literal(''))
     .transform((value) => (value === '' ? undefined : value)),
+  UNLOCK_WEBHOOK_SECRET: z
+    .string()
+    .min(32, { message: 'UNLOCK_WEBHOOK_SECRET must be at least 32 characters' })
+    .optional()
+    .or(z.literal(''))
+    .transform((value) => (value === '' ? undefined : value)),
   ANALYTICS_BUFFER_LIMIT: z.coerce.number().int().positive().default(10000),
 });
 
@@ -2,17 +2,20 @@ import { Router } from 'express';
 import { UnlockStore } from '@/db/unlockStore';
 import { issueUnlockToken, verifyUnlockToken } from '@/services/auth';
 import { verifySolanaPayment } from '@/services/solana';
+import { signedWebhookHeaders } from '@/services/webhook';
 
 const DAY_IN_MS = 24 * 60 * 60 * 1000;
 
 export type PaymentsRouterDeps = {
   unlockStore: UnlockStore;
   unlockWebhookUrl?: string;
+  unlockWebhookSecret?: string;
 };
 
 export function createPaymentsRouter({
   unlockStore,
   unlockWebhookUrl,
+  unlockWebhookSecret,
 }: PaymentsRouterDeps): Router {
   const router = Router();
 
@@ -39,7 +42,7 @@ export function createPaymentsRouter({
         req.ip ??
         undefined;
 
-      notifyProxyUnlock(unlockWebhookUrl, record, clientIp).catch(() => {
+      notifyProxyUnlock(unlockWebhookUrl, unlockWebhookSecret, record, clientIp).catch(() => {
         // Ignore webhook failures; proxy will fall back to polling/token validation.
       });
 
@@ -114,23 +117,34 @@ export function createPaymentsRouter({
 
 async function notifyProxyUnlock(
   webhookUrl: string | undefined,
+  webhookSecret: string | undefined,
   record: Awaited<ReturnType<UnlockStore['upsert']>>,
   clientIp?: string
 ) {
   if (!webhookUrl) {
     return;
   }
+  if (!webhookSecret) {
+    // The proxy refuses unsigned unlock webhooks.
+    console.warn('[payments] UNLOCK_WEBHOOK_SECRET is not set; skipping proxy unlock webhook');
+    return;
+  }
+
+  const body = JSON.stringify({
+    wallet: record.wallet,
+    expiresAt: record.expiresAt,
+    updatedAt: record.updatedAt,
+    clientIp,
+  });
 
   try {
     await fetch(webhookUrl, {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify({
-        wallet: record.wallet,
-        expiresAt: record.expiresAt,
-        updatedAt: record.updatedAt,
-        clientIp,
-      }),
+      headers: {
+        'Content-Type': 'application/json',
+        ...signedWebhookHeaders(webhookSecret, body),
+      },
+      body,
     });
   } catch {
     // ignore webhook errors
@@ -1,4 +1,11 @@
+import { generateKeyPairSync } from 'crypto';
+import fs from 'fs';
+import jwt from 'jsonwebtoken';
+import os from 'os';
+import path from 'path';
+import { resetEnvCache } from '@/config/env';
 import { daysRemaining, issueUnlockToken, verifyUnlockToken } from '@/services/auth';
+import { getJwks, resetKeyCache } from '@/services/jwks';
 
 describe('auth service', () => {
   const wallet = 'wallet123';
@@ -30,5 +37,74 @@ describe('auth service', () => {
     const remaining = daysRemaining(expiresAt, now);
     expect(remaining).toBe(0);
   });
+
+  describe('with an asymmetric signing key', () => {
+    const keyDir = fs.mkdtempSync(path.join(os.tmpdir(), 'payhole-keys-'));
+
+    function writeKey(name: string, type: 'ec' | 'rsa') {
+      const { privateKey, publicKey } =
+        type === 'ec'
+          ? generateKeyPairSync('ec', { namedCurve: 'P-256' })
+          : generateKeyPairSync('rsa', { modulusLength: 2048 });
+      const privatePath = path.join(keyDir, `${name}.key`);
+      const publicPath = path.join(keyDir, `${name}.pub`);
+      fs.writeFileSync(privatePath, privateKey.export({ format: 'pem', type: 'pkcs8' }));
+      fs.writeFileSync(publicPath, publicKey.export({ format: 'pem', type: 'spki' }));
+      return { privatePath, publicPath };
+    }
+
+    function useKeys(env: Record<string, string>) {
+      Object.assign(process.env, env);
+      resetEnvCache();
+      resetKeyCache();
+    }
+
+    afterEach(() => {
+      delete process.env.JWT_PRIVATE_KEY_PATH;
+      delete process.env.JWT_RETIRED_PUBLIC_KEY_PATHS;
+      delete process.env.JWT_AUDIENCE;
+    });
+
+    afterAll(() => {
+      fs.rmSync(keyDir, { recursive: true, force: true });
+    });
+
+    it('signs ES256 tokens with a kid published in the JWKS', () => {
+      const { privatePath } = writeKey('current', 'ec');
+      useKeys({ JWT_PRIVATE_KEY_PATH: privatePath, JWT_AUDIENCE: 'payhole-proxy' });
+
+      const { token } = issueUnlockToken(wallet);
+      const decoded = jwt.decode(token, { complete: true });
+      const jwks = getJwks();
+
+      expect(decoded?.header.alg).toBe('ES256');
+      expect(jwks.keys).toHaveLength(1);
+      expect(jwks.keys[0]).toMatchObject({ kty: 'EC', crv: 'P-256', alg: 'ES256', use: 'sig', kid: decoded?.header.kid });
+      expect(jwks.keys[0]).not.toHaveProperty('d');
+      expect(decoded?.payload).toMatchObject({ aud: 'payhole-proxy', iss: 'payhole-payments' });
+      expect(verifyUnlockToken(token).wallet).toBe(wallet);
+    });
+
+    it('keeps verifying tokens from a retired key after rotation', () => {
+      const old = writeKey('old', 'rsa');
+      useKeys({ JWT_PRIVATE_KEY_PATH: old.privatePath });
+      const { token } = issueUnlockToken(wallet);
+
+      const next = writeKey('next', 'ec');
+      useKeys({ JWT_PRIVATE_KEY_PATH: next.privatePath, JWT_RETIRED_PUBLIC_KEY_PATHS: old.publicPath });
+
+      expect(getJwks().keys.map((key) => key.alg)).toEqual(['ES256', 'RS256']);
+      expect(verifyUnlockToken(token).wallet).toBe(wallet);
+    });
+
+    it('rejects HS256 tokens forged with a published kid', () => {
+      const { privatePath } = writeKey('current', 'ec');
+      useKeys({ JWT_PRIVATE_KEY_PATH: privatePath });
+      const [{ kid }] = getJwks().keys;
+      const forged = jwt.sign({ wallet }, 'not-the-real-secret-but-32-chars-long!', { keyid: kid });
+
+      expect(() => verifyUnlockToken(forged)).toThrow();
+    });
+  });
 });
 
@@ -0,0 +1,33 @@
+import { createHmac } from 'crypto';
+import {
+  WEBHOOK_ID_HEADER,
+  WEBHOOK_SIGNATURE_HEADER,
+  WEBHOOK_TIMESTAMP_HEADER,
+  signWebhookPayload,
+  signedWebhookHeaders,
+} from '@/services/webhook';
+
+describe('webhook signing', () => {
+  const secret = 'webhook-secret-32-characters-long!!';
+  const body = JSON.stringify({ wallet: 'wallet123', clientIp: '203.0.113.10' });
+
+  it('signs timestamp, id and body with HMAC-SHA256', () => {
+    const expected = createHmac('sha256', secret)
+      .update(`1700000000.id-1.${body}`)
+      .digest('hex');
+
+    expect(signWebhookPayload(secret, 1700000000, 'id-1', body)).toBe(`v1=${expected}`);
+  });
+
+  it('builds headers with a unix timestamp and a unique id', () => {
+    const now = new Date('2024-01-01T00:00:00.000Z');
+    const first = signedWebhookHeaders(secret, body, now);
+    const second = signedWebhookHeaders(secret, body, now);
+
+    expect(first[WEBHOOK_TIMESTAMP_HEADER]).toBe('1704067200');
+    expect(first[WEBHOOK_ID_HEADER]).not.toBe(second[WEBHOOK_ID_HEADER]);
+    expect(first[WEBHOOK_SIGNATURE_HEADER]).toBe(
+      signWebhookPayload(secret, 1704067200, first[WEBHOOK_ID_HEADER], body)
+    );
+  });
+});
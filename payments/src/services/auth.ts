@@ -1,5 +1,6 @@
-import jwt from 'jsonwebtoken';
+import jwt, { SignOptions } from 'jsonwebtoken';
 import { getEnv } from '@/config/env';
+import { findVerificationKey, getSigningKey } from '@/services/jwks';
 
 const THIRTY_DAYS_IN_MS = 30 * 24 * 60 * 60 * 1000;
 
@@ -13,25 +14,36 @@ export type UnlockTokenResult = {
 };
 
 export function issueUnlockToken(wallet: string, issuedAt: Date = new Date()): UnlockTokenResult {
-  const { JWT_SECRET } = getEnv();
+  const { JWT_SECRET, JWT_AUDIENCE } = getEnv();
+  const signingKey = getSigningKey();
 
   const expiresAt = new Date(issuedAt.getTime() + THIRTY_DAYS_IN_MS);
-  const token = jwt.sign(
-    { wallet },
-    JWT_SECRET,
-    {
-      expiresIn: Math.floor(THIRTY_DAYS_IN_MS / 1000),
-      issuer: 'payhole-payments',
-      subject: wallet,
-    }
-  );
+  const options: SignOptions = {
+    expiresIn: Math.floor(THIRTY_DAYS_IN_MS / 1000),
+    issuer: 'payhole-payments',
+    subject: wallet,
+    ...(JWT_AUDIENCE ? { audience: JWT_AUDIENCE } : {}),
+  };
+  // With a private key configured, proxies verify against the published JWKS and never
+  // need a secret that could mint tokens.
+  const token = signingKey
+    ? jwt.sign({ wallet }, signingKey.privateKey, {
+        ...options,
+        algorithm: signingKey.alg,
+        keyid: signingKey.kid,
+      })
+    : jwt.sign({ wallet }, JWT_SECRET, options);
 
   return { token, expiresAt };
 }
 
 export function verifyUnlockToken(token: string): UnlockTokenPayload {
   const { JWT_SECRET } = getEnv();
-  const decoded = jwt.verify(token, JWT_SECRET);
+  const header = jwt.decode(token, { complete: true })?.header;
+  const verificationKey = header?.alg === 'HS256' ? undefined : findVerificationKey(header?.kid);
+  const decoded = verificationKey
+    ? jwt.verify(token, verificationKey.publicKey, { algorithms: [verificationKey.alg] })
+    : jwt.verify(token, JWT_SECRET, { algorithms: ['HS256'] });
 
   if (typeof decoded === 'string' || !('wallet' in decoded)) {
     throw new Error('Invalid token payload');
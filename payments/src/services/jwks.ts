@@ -0,0 +1,114 @@
+import { createHash, createPrivateKey, createPublicKey, KeyObject } from 'crypto';
+import fs from 'fs';
+import { getEnv } from '@/config/env';
+
+export type AsymmetricAlgorithm = 'ES256' | 'RS256';
+
+export type SigningKey = {
+  kid: string;
+  alg: AsymmetricAlgorithm;
+  privateKey: KeyObject;
+  publicKey: KeyObject;
+};
+
+export type VerificationKey = {
+  kid: string;
+  alg: AsymmetricAlgorithm;
+  publicKey: KeyObject;
+};
+
+export type PublicJwk = Record<string, string> & { kid: string; alg: AsymmetricAlgorithm; use: 'sig' };
+
+type KeyRing = {
+  signing: SigningKey | null;
+  verification: VerificationKey[];
+};
+
+let cachedKeyRing: KeyRing | null = null;
+
+/**
+ * Maps a key to the one algorithm the proxy will accept for it. jsonwebtoken cannot sign
+ * EdDSA, so only P-256 and RSA keys are supported here.
+ */
+export function algorithmFor(key: KeyObject): AsymmetricAlgorithm {
+  if (key.asymmetricKeyType === 'ec' && key.asymmetricKeyDetails?.namedCurve === 'prime256v1') {
+    return 'ES256';
+  }
+  if (key.asymmetricKeyType === 'rsa' && (key.asymmetricKeyDetails?.modulusLength ?? 0) >= 2048) {
+    return 'RS256';
+  }
+  throw new Error('JWT keys must be P-256 EC or RSA (>= 2048 bits)');
+}
+
+/**
+ * RFC 7638 thumbprint, used as the kid so ids stay stable without extra configuration.
+ */
+export function jwkThumbprint(publicKey: KeyObject): string {
+  const jwk = publicKey.export({ format: 'jwk' }) as Record<string, string>;
+  const members =
+    jwk.kty === 'EC'
+      ? { crv: jwk.crv, kty: jwk.kty, x: jwk.x, y: jwk.y }
+      : { e: jwk.e, kty: jwk.kty, n: jwk.n };
+  return createHash('sha256').update(JSON.stringify(members)).digest('base64url');
+}
+
+function verificationKeyFrom(publicKey: KeyObject, kid?: string): VerificationKey {
+  return { kid: kid || jwkThumbprint(publicKey), alg: algorithmFor(publicKey), publicKey };
+}
+
+function loadKeyRing(): KeyRing {
+  const { JWT_PRIVATE_KEY_PATH, JWT_KEY_ID, JWT_RETIRED_PUBLIC_KEY_PATHS } = getEnv();
+
+  let signing: SigningKey | null = null;
+  if (JWT_PRIVATE_KEY_PATH) {
+    const privateKey = createPrivateKey(fs.readFileSync(JWT_PRIVATE_KEY_PATH));
+    const publicKey = createPublicKey(privateKey);
+    signing = { ...verificationKeyFrom(publicKey, JWT_KEY_ID), privateKey };
+  }
+
+  const retired = JWT_RETIRED_PUBLIC_KEY_PATHS.map((path) =>
+    verificationKeyFrom(createPublicKey(fs.readFileSync(path)))
+  );
+
+  return {
+    signing,
+    verification: signing ? [signing, ...retired] : retired,
+  };
+}
+
+function keyRing(): KeyRing {
+  if (!cachedKeyRing) {
+    cachedKeyRing = loadKeyRing();
+  }
+  return cachedKeyRing;
+}
+
+/**
+ * Returns the key unlock tokens are signed with, or null to fall back to HS256 with JWT_SECRET.
+ */
+export function getSigningKey(): SigningKey | null {
+  return keyRing().signing;
+}
+
+export function findVerificationKey(kid: string | undefined): VerificationKey | undefined {
+  return keyRing().verification.find((key) => key.kid === kid);
+}
+
+/**
+ * The JWKS document the proxy fetches: the current signing key plus retired keys that
+ * may still have unexpired tokens in circulation.
+ */
+export function getJwks(): { keys: PublicJwk[] } {
+  return {
+    keys: keyRing().verification.map(({ kid, alg, publicKey }) => ({
+      ...(publicKey.export({ format: 'jwk' }) as Record<string, string>),
+      kid,
+      alg,
+      use: 'sig' as const,
+    })),
+  };
+}
+
+export function resetKeyCache() {
+  cachedKeyRing = null;
+}
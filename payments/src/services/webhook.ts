@@ -0,0 +1,33 @@
+import { createHmac, randomUUID } from 'crypto';
+
+export const WEBHOOK_TIMESTAMP_HEADER = 'X-PayHole-Timestamp';
+export const WEBHOOK_ID_HEADER = 'X-PayHole-Webhook-Id';
+export const WEBHOOK_SIGNATURE_HEADER = 'X-PayHole-Signature';
+
+/**
+ * Computes the signature the proxy expects on webhook calls:
+ * `v1=` + hex HMAC-SHA256 over `${timestamp}.${id}.${body}`.
+ */
+export function signWebhookPayload(secret: string, timestamp: number, id: string, body: string): string {
+  const digest = createHmac('sha256', secret).update(`${timestamp}.${id}.${body}`).digest('hex');
+  return `v1=${digest}`;
+}
+
+/**
+ * Builds the headers for a signed webhook request. Each call uses a fresh id, which the
+ * proxy remembers to reject replays.
+ */
+export function signedWebhookHeaders(
+  secret: string,
+  body: string,
+  now: Date = new Date()
+): Record<string, string> {
+  const timestamp = Math.floor(now.getTime() / 1000);
+  const id = randomUUID();
+
+  return {
+    [WEBHOOK_TIMESTAMP_HEADER]: String(timestamp),
+    [WEBHOOK_ID_HEADER]: id,
+    [WEBHOOK_SIGNATURE_HEADER]: signWebhookPayload(secret, timestamp, id, body),
+  };
+}
@@ -2,6 +2,7 @@ import fs from 'fs';
 import os from 'os';
 import path from 'path';
 import { resetEnvCache } from '@/config/env';
+import { resetKeyCache } from '@/services/jwks';
 
 const tmpDir = path.join(os.tmpdir(), 'payhole-test-data');
 const defaultDbPath = path.join(tmpDir, 'unlocks.json');
@@ -20,6 +21,7 @@ beforeEach(() => {
     process.env.TREASURY_WALLET ?? '4p4iHhfg9wyPRcu1WnNxBrAaraiKUN1fYe5XnjTQd3M2';
   process.env.MIN_PAYMENT_USDC = process.env.MIN_PAYMENT_USDC ?? '5';
   resetEnvCache();
+  resetKeyCache();
   if (fs.existsSync(defaultDbPath)) {
     fs.rmSync(defaultDbPath);
   }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strings"
 	"time"
@@ -18,10 +20,17 @@ import (
 	"github.com/payhole/proxy/internal/analytics"
 	"github.com/payhole/proxy/internal/auth"
 	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/clientip"
 	"github.com/payhole/proxy/internal/config"
 	"github.com/payhole/proxy/internal/dnsproxy"
+	"github.com/payhole/proxy/internal/filter"
 	"github.com/payhole/proxy/internal/httpproxy"
+	"github.com/payhole/proxy/internal/intercept"
 	"github.com/payhole/proxy/internal/policy"
+	"github.com/payhole/proxy/internal/privacy"
+	"github.com/payhole/proxy/internal/rewrite"
+	"github.com/payhole/proxy/internal/webhook"
+	"github.com/payhole/proxy/internal/x402"
 )
 
 func main() {
@@ -34,26 +43,232 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to load blocklist: %v", err)
 	}
-	if err := blockedDomains.AppendFromURLs(cfg.BlocklistURLs); err != nil {
+	allowedDomains, err := blocklist.LoadFromFile(cfg.AllowlistPath)
+	if err != nil {
+		log.Fatalf("failed to load allowlist: %v", err)
+	}
+
+	networkFilters := filter.NewNetworkEngine(nil)
+	cosmeticFilters := filter.NewCosmeticEngine(nil)
+	if err := blockedDomains.AppendFromURLs(cfg.BlocklistURLs, allowedDomains, blocklist.MultiSink(networkFilters, cosmeticFilters)); err != nil {
 		log.Printf("warning: failed to load remote blocklists: %v", err)
 	}
+	log.Printf("loaded %d URL filter rules and %d element hiding rules", networkFilters.Len(), cosmeticFilters.Len())
 
 	premiumDomains := blocklist.New(cfg.PremiumDomains)
 
-	jwtAuthorizer, err := auth.NewJWTAuthorizer(cfg.JWTSecret)
+	jwtOptions := auth.JWTOptions{
+		Secret:   cfg.JWTSecret,
+		Issuer:   cfg.JWTIssuer,
+		Audience: cfg.JWTAudience,
+		Leeway:   cfg.JWTLeeway,
+	}
+	if cfg.JWKSURL != "" {
+		jwtOptions.Keys = auth.NewKeySet(cfg.JWKSURL, cfg.JWKSRefresh, cfg.JWKSGrace)
+		// The payments service may still be starting; unknown kids and the schedule retry.
+		if err := jwtOptions.Keys.Refresh(context.Background()); err != nil {
+			log.Printf("warning: initial JWKS fetch failed: %v", err)
+		}
+		go jwtOptions.Keys.Run(context.Background())
+	}
+	jwtAuthorizer, err := auth.NewJWTAuthorizerWithOptions(jwtOptions)
 	if err != nil {
 		log.Fatalf("auth init failed: %v", err)
 	}
 
-	ipCache := auth.NewIPCache()
+	ipCache := auth.NewIPCacheWithOptions(auth.CacheOptions{
+		Capacity:   cfg.UnlockCacheCapacity,
+		IPv6Prefix: cfg.UnlockIPv6Prefix,
+		Session:    cfg.UnlockSession,
+	})
+	go ipCache.RunJanitor(context.Background(), time.Minute)
+	unlockStore, err := auth.OpenFileStore(cfg.UnlockStorePath)
+	if err != nil {
+		log.Fatalf("failed to open unlock store: %v", err)
+	}
+	restored, err := ipCache.UseStore(unlockStore)
+	if err != nil {
+		log.Fatalf("failed to restore unlocks: %v", err)
+	}
+	log.Printf("restored %d premium unlocks from %s", restored, cfg.UnlockStorePath)
+
+	var unlockVerifier *webhook.Verifier
+	if cfg.UnlockWebhookSecret != "" {
+		unlockVerifier, err = webhook.NewVerifier(cfg.UnlockWebhookSecret, cfg.UnlockWebhookTolerance, cfg.UnlockWebhookSources)
+		if err != nil {
+			log.Fatalf("config error: %v", err)
+		}
+	} else {
+		log.Printf("warning: UNLOCK_WEBHOOK_SECRET is not set; /webhooks/unlock will refuse all requests")
+	}
 	analyticsClient := analytics.NewClient(cfg.AnalyticsURL)
 
 	policyEngine := policy.New(blockedDomains, premiumDomains, jwtAuthorizer, ipCache, analyticsClient)
+	policyEngine.SetAllowlist(allowedDomains)
+	if cfg.X402FacilitatorURL != "" {
+		policyEngine.SetPaymentFacilitator(x402.NewHTTPFacilitator(cfg.X402FacilitatorURL, 10*time.Second))
+		log.Printf("x402 X-PAYMENT verification via %s", cfg.X402FacilitatorURL)
+	}
 
 	httpProxy := httpproxy.NewServer(policyEngine, nil)
+	httpProxy.SetNetworkFilter(networkFilters)
+	httpProxy.SetSurrogates(cfg.Surrogates)
+	// Every TCP listener counts, so a request aimed at the DoH, DNS or DoT port is refused too.
+	httpProxy.SetListenAddrs(cfg.HTTPProxyAddr, cfg.DoHAddr, cfg.DNSProxyAddr, cfg.DoTAddr)
+	httpProxy.SetTimeouts(httpproxy.Timeouts{
+		ReadHeader:         cfg.HTTPReadHeaderTimeout,
+		Idle:               cfg.HTTPIdleTimeout,
+		Connect:            cfg.UpstreamConnectTimeout,
+		ResponseHeader:     cfg.UpstreamResponseTimeout,
+		UpgradeIdle:        cfg.WebSocketIdleTimeout,
+		UpgradeMaxLifetime: cfg.WebSocketMaxLifetime,
+	})
+	egressPolicy, err := policy.NewEgress(cfg.EgressAllowCIDRs, cfg.EgressDenyCIDRs)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	httpProxy.SetEgressPolicy(egressPolicy)
+	trustedProxies, err := clientip.ParseTrusted(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	if cfg.CosmeticFiltering {
+		httpProxy.SetCosmeticFilter(cosmeticFilters)
+	}
 
-	resolver := dnsproxy.NewUpstreamResolver(cfg.UpstreamDNS, cfg.UpstreamTimeout)
+	headerPolicy, err := privacy.Profile(cfg.PrivacyProfile)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	if cfg.PrivacyForwardedFor != "" {
+		headerPolicy.Forwarding = privacy.ForwardingOverride
+		headerPolicy.ForwardingValue = cfg.PrivacyForwardedFor
+	}
+	httpProxy.SetHeaderPolicy(headerPolicy)
+
+	cookieMode, err := privacy.ParseCookieMode(cfg.CookiePolicy)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	// Blocked domains never reach the cookie check unless allowlisted, so trackers are mostly
+	// the hosts carrying path-level tracking rules, e.g. "||facebook.com/tr^".
+	cookiePolicy := privacy.CookiePolicy{Mode: cookieMode, Trackers: blocklist.Union(networkFilters.TrackerHosts(), blockedDomains)}
+	httpProxy.SetCookiePolicy(cookiePolicy)
+
+	if cfg.URLRewrite {
+		httpProxy.SetRewriter(rewrite.New(networkFilters, analyticsClient))
+	}
+
+	paymentAmount, err := x402.AtomicAmount(cfg.PaymentAmountUSDC, x402.USDCDecimals)
+	if err != nil {
+		log.Fatalf("invalid payment amount: %v", err)
+	}
+	if cfg.PaymentPayTo == "" {
+		log.Printf("warning: TREASURY_WALLET is not set; x402 payment requirements will have no payTo address")
+	}
+	httpProxy.SetPaymentTerms(x402.Terms{
+		Network:    cfg.X402Network,
+		Asset:      cfg.PaymentAsset,
+		PayTo:      cfg.PaymentPayTo,
+		Amount:     paymentAmount,
+		MaxTimeout: cfg.PaymentMaxTimeout,
+	})
+
+	var interceptCA *intercept.Authority
+	if cfg.TLSIntercept {
+		interceptCA, err = intercept.LoadOrCreateAuthority(cfg.InterceptCACertPath, cfg.InterceptCAKeyPath)
+		if err != nil {
+			log.Fatalf("failed to load interception CA: %v", err)
+		}
+		bypass, err := blocklist.LoadFromFile(cfg.InterceptBypassPath)
+		if err != nil {
+			log.Fatalf("failed to load interception bypass list: %v", err)
+		}
+		bypass.Merge(cfg.InterceptBypassDomains)
+		httpProxy.EnableInterception(interceptCA, bypass)
+		log.Printf("TLS interception enabled; CA certificate at %s", cfg.InterceptCACertPath)
+	}
+
+	strategy, err := dnsproxy.ParseStrategy(cfg.UpstreamStrategy)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	var upstreams []dnsproxy.Upstream
+	for _, spec := range cfg.UpstreamDNS {
+		upstream, err := dnsproxy.NewResolverFromURL(spec, cfg.UpstreamTimeout)
+		if err != nil {
+			log.Fatalf("config error: %v", err)
+		}
+		upstreams = append(upstreams, dnsproxy.Upstream{Name: spec, Resolver: upstream})
+	}
+	poolOptions := dnsproxy.DefaultPoolOptions()
+	poolOptions.Strategy = strategy
+	poolOptions.HealthCheckInterval = cfg.UpstreamHealthCheck
+	upstreamPool, err := dnsproxy.NewPool(upstreams, poolOptions)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	go upstreamPool.RunHealthChecks(context.Background())
+	var resolver dnsproxy.Resolver = upstreamPool
+	var dnsCache *dnsproxy.Cache
+	if cfg.DNSCacheSize > 0 {
+		cacheOptions := dnsproxy.DefaultCacheOptions()
+		cacheOptions.Capacity = cfg.DNSCacheSize
+		cacheOptions.MinTTL = cfg.DNSCacheMinTTL
+		cacheOptions.MaxTTL = cfg.DNSCacheMaxTTL
+		cacheOptions.MaxNegativeTTL = cfg.DNSCacheNegativeTTL
+		if !cfg.DNSPrefetch {
+			cacheOptions.PrefetchHits = 0
+		}
+		if !cfg.DNSServeStale {
+			cacheOptions.StaleTTL = 0
+		}
+		dnsCache = dnsproxy.NewCache(resolver, cacheOptions)
+		resolver = dnsCache
+		for _, list := range []*blocklist.Set{blockedDomains, allowedDomains, premiumDomains} {
+			list.OnChange(dnsCache.Flush)
+		}
+	}
 	dnsServer := dnsproxy.NewServer(resolver, policyEngine)
+	blockOptions := dnsproxy.DefaultBlockOptions()
+	blockOptions.TTL = cfg.DNSBlockedTTL
+	if cfg.DNSBlockModeAds != "" {
+		if blockOptions.AdBlocked, err = dnsproxy.ParseBlockMode(cfg.DNSBlockModeAds); err != nil {
+			log.Fatalf("config error: DNS_BLOCK_MODE_ADS: %v", err)
+		}
+	}
+	for _, raw := range cfg.DNSSinkholeIPs {
+		ip, err := netip.ParseAddr(raw)
+		if err != nil {
+			log.Fatalf("config error: invalid DNS_SINKHOLE_IPS entry %q", raw)
+		}
+		blockOptions.SinkholeIPs = append(blockOptions.SinkholeIPs, ip)
+	}
+	// Unpaid premium names must still reach the 402 paywall, so by default they resolve
+	// to the sinkhole when one is configured and are refused otherwise.
+	switch {
+	case cfg.DNSBlockModePremium != "":
+		if blockOptions.PremiumPayment, err = dnsproxy.ParseBlockMode(cfg.DNSBlockModePremium); err != nil {
+			log.Fatalf("config error: DNS_BLOCK_MODE_PREMIUM: %v", err)
+		}
+	case len(blockOptions.SinkholeIPs) > 0:
+		blockOptions.PremiumPayment = dnsproxy.BlockSinkholeIP
+	}
+	if err := blockOptions.Validate(); err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	dnsServer.SetBlockOptions(blockOptions)
+
+	var dotCerts *dnsproxy.CertReloader
+	if cfg.DoTAddr != "" {
+		dotCerts, err = dnsproxy.NewCertReloader(cfg.DoTCertPath, cfg.DoTKeyPath)
+		if err != nil {
+			log.Fatalf("dot certificate error: %v", err)
+		}
+		if port := extractPort(cfg.DoTAddr, "853"); port != "853" {
+			log.Printf("warning: DOT_ADDR listens on port %s; Android Private DNS only connects to 853", port)
+		}
+	}
 
 	determineSchemeAndHost := func(r *http.Request) (string, string) {
 		scheme := "https"
@@ -137,8 +352,22 @@ func main() {
 		httpEndpoint := formatHTTPEndpoint(proxyURL.Scheme, hostName, proxyPort)
 		dnsPort := extractPort(cfg.DNSProxyAddr, "5533")
 		dnsEndpoint := fmt.Sprintf("%s:%s", hostName, dnsPort)
+		privateDNSHost := ""
+		if dotCerts != nil {
+			privateDNSHost = cfg.DoTHostname
+			if privateDNSHost == "" {
+				privateDNSHost = hostName
+				if names := dotCerts.DNSNames(); len(names) > 0 {
+					privateDNSHost = names[0]
+				}
+			}
+		}
 		pacURL := fmt.Sprintf("%s://%s/auto-config", proxyURL.Scheme, proxyURL.Host)
 		docsURL := resolveDocsURL(r)
+		caURL := ""
+		if interceptCA != nil {
+			caURL = fmt.Sprintf("%s://%s/setup/ca.pem", proxyURL.Scheme, proxyURL.Host)
+		}
 
 		setupTemplate := `<!doctype html>
 <html lang="en">
@@ -170,18 +399,45 @@ func main() {
         <h3>DNS sinkhole</h3>
         <p><code>{{ .DNSEndpoint }}</code></p>
       </div>
+      {{ if .PrivateDNSHost }}
+      <div class="card">
+        <h3>DNS over TLS</h3>
+        <p><code>{{ .PrivateDNSHost }}</code></p>
+      </div>
+      {{ end }}
       <div class="card">
         <h3>Auto-config script</h3>
         <p><a href="{{ .PacURL }}">{{ .PacURL }}</a></p>
       </div>
+      <div class="card">
+        <h3>Header privacy: {{ .PrivacyProfile }}</h3>
+        <ul>
+          {{ range .PrivacyControls }}<li>{{ . }}</li>
+          {{ end }}
+        </ul>
+      </div>
+      {{ if .CAURL }}
+      <div class="card">
+        <h3>HTTPS filtering certificate</h3>
+        <p><a href="{{ .CAURL }}">Download the PayHole CA</a> and mark it as trusted to enable HTTPS path rules and paywalls. Banking, health and pinned apps are never intercepted.</p>
+      </div>
+      {{ end }}
     </div>
     <h2>Platform quickstart</h2>
     <h3>Android</h3>
+    {{ if .PrivateDNSHost }}
     <ol>
       <li>Open Settings → Network &amp; internet → Private DNS.</li>
       <li>Select Private DNS provider hostname.</li>
-      <li>Enter the DNS sinkhole hostname above and save.</li>
+      <li>Enter <code>{{ .PrivateDNSHost }}</code> and save.</li>
     </ol>
+    {{ else }}
+    <ol>
+      <li>Open Settings → Network &amp; internet → Proxy for the active Wi-Fi network.</li>
+      <li>Enter the HTTP proxy endpoint above and save.</li>
+      <li>Private DNS needs DNS over TLS, which is not enabled on this proxy.</li>
+    </ol>
+    {{ end }}
     <h3>iOS</h3>
     <ol>
       <li>Install the configuration profile exposing PayHole DNS.</li>
@@ -206,15 +462,23 @@ func main() {
 </html>`
 
 		data := struct {
-			HTTPEndpoint string
-			DNSEndpoint  string
-			PacURL       string
-			DocsURL      string
+			HTTPEndpoint    string
+			DNSEndpoint     string
+			PrivateDNSHost  string
+			PacURL          string
+			DocsURL         string
+			CAURL           string
+			PrivacyProfile  string
+			PrivacyControls []string
 		}{
-			HTTPEndpoint: httpEndpoint,
-			DNSEndpoint:  dnsEndpoint,
-			PacURL:       pacURL,
-			DocsURL:      docsURL,
+			HTTPEndpoint:    httpEndpoint,
+			DNSEndpoint:     dnsEndpoint,
+			PrivateDNSHost:  privateDNSHost,
+			PacURL:          pacURL,
+			DocsURL:         docsURL,
+			CAURL:           caURL,
+			PrivacyProfile:  headerPolicy.Profile,
+			PrivacyControls: append(headerPolicy.Summary(), cookiePolicy.Summary()),
 		}
 
 		tmpl, err := template.New("setup").Parse(setupTemplate)
@@ -228,68 +492,103 @@ func main() {
 		}
 	})
 
+	mux.HandleFunc("/setup/ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		if interceptCA == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Header().Set("Content-Disposition", `attachment; filename="payhole-ca.pem"`)
+		_, _ = w.Write(interceptCA.CertificatePEM())
+	})
+
 	mux.Handle("/", httpProxy)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(`{"status":"ok"}`))
-	})
-	mux.HandleFunc("/webhooks/unlock", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		var payload struct {
-			Wallet    string `json:"wallet"`
-			ExpiresAt string `json:"expiresAt"`
-			ClientIP  string `json:"clientIp"`
+		health := struct {
+			Status          string                    `json:"status"`
+			UnlockCache     auth.CacheStats           `json:"unlockCache"`
+			WebhookFailures uint64                    `json:"unlockWebhookFailures"`
+			DNSCache        *dnsproxy.CacheStats      `json:"dnsCache,omitempty"`
+			Upstreams       []dnsproxy.UpstreamStatus `json:"dnsUpstreams"`
+		}{
+			Status:          "ok",
+			UnlockCache:     ipCache.Stats(),
+			WebhookFailures: unlockVerifier.Failures(),
+			Upstreams:       upstreamPool.Status(),
 		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "invalid payload", http.StatusBadRequest)
-			return
+		if dnsCache != nil {
+			stats := dnsCache.Stats()
+			health.DNSCache = &stats
 		}
+		_ = json.NewEncoder(w).Encode(health)
+	})
+	mux.Handle("/webhooks/unlock", webhook.UnlockHandler(unlockVerifier, cfg.UnlockMaxLifetime, func(payload webhook.Unlock, expiry time.Time) {
 		if payload.ClientIP != "" && ipCache != nil {
 			remote := payload.ClientIP
 			if !strings.Contains(remote, ":") {
 				remote = remote + ":0"
 			}
-			expiry := time.Now().Add(30 * time.Second)
-			if ts, err := time.Parse(time.RFC3339, payload.ExpiresAt); err == nil && ts.Before(expiry) {
-				expiry = ts
-			}
-			ipCache.Authorize(remote, expiry)
+			ipCache.Bind(remote, payload.Wallet, expiry)
 		}
-		w.WriteHeader(http.StatusAccepted)
-	})
+	}))
 	if cfg.DoHAddr == cfg.HTTPProxyAddr {
 		mux.Handle("/dns-query", dnsServer.DoHHandler())
 	}
 
+	// No ReadTimeout or WriteTimeout: they would cap uploads, downloads and event streams.
 	httpSrv := &http.Server{
-		Addr:         cfg.HTTPProxyAddr,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		Addr:              cfg.HTTPProxyAddr,
+		Handler:           trustedProxies.Middleware(routeProxyRequests(mux, httpProxy)),
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
 	}
 
+	httpListener, err := listen(cfg.HTTPProxyAddr, trustedProxies, cfg.ProxyProtocol)
+	if err != nil {
+		log.Fatalf("http proxy error: %v", err)
+	}
 	go func() {
 		log.Printf("HTTP proxy listening on %s", cfg.HTTPProxyAddr)
-		if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := httpSrv.Serve(httpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("http proxy error: %v", err)
 		}
 	}()
 
 	if cfg.DoHAddr != cfg.HTTPProxyAddr {
+		dohListener, err := listen(cfg.DoHAddr, trustedProxies, cfg.ProxyProtocol)
+		if err != nil {
+			log.Fatalf("doh server error: %v", err)
+		}
 		go func() {
 			log.Printf("DoH endpoint listening on %s", cfg.DoHAddr)
-			if err := http.ListenAndServe(cfg.DoHAddr, dnsServer.DoHHandler()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err := http.Serve(dohListener, trustedProxies.Middleware(dnsServer.DoHHandler())); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Fatalf("doh server error: %v", err)
 			}
 		}()
 	}
 
 	udpSrv := &dns.Server{Addr: cfg.DNSProxyAddr, Net: "udp", Handler: dns.HandlerFunc(dnsServer.ServeDNS)}
-	tcpSrv := &dns.Server{Addr: cfg.DNSProxyAddr, Net: "tcp", Handler: dns.HandlerFunc(dnsServer.ServeDNS)}
+	dnsListener, err := listen(cfg.DNSProxyAddr, trustedProxies, cfg.ProxyProtocol)
+	if err != nil {
+		log.Fatalf("dns tcp error: %v", err)
+	}
+	tcpSrv := &dns.Server{Listener: dnsListener, Handler: dns.HandlerFunc(dnsServer.ServeDNS)}
+
+	if dotCerts != nil {
+		dotListener, err := listen(cfg.DoTAddr, trustedProxies, cfg.ProxyProtocol)
+		if err != nil {
+			log.Fatalf("dot server error: %v", err)
+		}
+		dotSrv := dnsServer.NewDoTServer(dotListener, dotCerts, dnsproxy.DoTOptions{IdleTimeout: cfg.DoTIdleTimeout})
+		go func() {
+			log.Printf("DNS over TLS listening on %s", cfg.DoTAddr)
+			if err := dotSrv.ActivateAndServe(); err != nil {
+				log.Fatalf("dot server error: %v", err)
+			}
+		}()
+	}
 
 	go func() {
 		log.Printf("DNS proxy (udp) listening on %s", cfg.DNSProxyAddr)
@@ -299,11 +598,32 @@ func main() {
 	}()
 
 	log.Printf("DNS proxy (tcp) listening on %s", cfg.DNSProxyAddr)
-	if err := tcpSrv.ListenAndServe(); err != nil {
+	if err := tcpSrv.ActivateAndServe(); err != nil {
 		log.Fatalf("dns tcp error: %v", err)
 	}
 }
 
+// listen opens a TCP listener on addr that, when proxyProtocol is set, accepts PROXY
+// protocol headers from the trusted load balancers.
+func listen(addr string, trusted clientip.Trusted, proxyProtocol bool) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || !proxyProtocol {
+		return l, err
+	}
+	return clientip.NewListener(l, trusted), nil
+}
+
+// routeProxyRequests sends CONNECT tunnels straight to the proxy, since ServeMux cannot match authority-form targets.
+func routeProxyRequests(mux *http.ServeMux, proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
 func formatHTTPEndpoint(scheme, host, port string) string {
 	if port == "" {
 		if scheme == "https" {
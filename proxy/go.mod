@@ -3,14 +3,15 @@ module github.com/payhole/proxy
 go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/miekg/dns v1.1.60
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/net v0.26.0
 )
 
 require (
 	golang.org/x/mod v0.18.0 // indirect
-	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
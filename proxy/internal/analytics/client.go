@@ -7,7 +7,7 @@ import (
 	"time"
 )
 
-// Event represents a blocked request telemetry item.
+// Event represents a blocked or rewritten request telemetry item.
 type Event struct {
 	Domain    string    `json:"domain"`
 	Reason    string    `json:"reason"`
@@ -37,6 +37,15 @@ func (c *Client) Enabled() bool {
 
 // RecordBlocked publishes a blocked request event. Failures are silent to avoid impacting the hot path.
 func (c *Client) RecordBlocked(domain, reason string) {
+	c.publish(domain, reason)
+}
+
+// RecordRewrite publishes an event for a request the proxy rewrote instead of blocking.
+func (c *Client) RecordRewrite(domain, kind string) {
+	c.publish(domain, kind)
+}
+
+func (c *Client) publish(domain, reason string) {
 	if !c.Enabled() {
 		return
 	}
@@ -1,50 +1,240 @@
 package auth
 
 import (
+	"context"
+	"log"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// CacheOptions bounds the IPCache and shapes its sessions.
+type CacheOptions struct {
+	// Capacity caps the number of cached clients; the entry closest to expiry is evicted
+	// to make room. Zero means unbounded.
+	Capacity int
+	// IPv6Prefix binds IPv6 clients by network prefix rather than exact address, so privacy
+	// address rotation within e.g. a /64 keeps the unlock. 128 binds exact addresses.
+	IPv6Prefix int
+	// Session is the sliding idle window: each authorized request renews the entry for this
+	// long, never past the unlock's own expiry. Zero keeps entries until that expiry.
+	Session time.Duration
+}
+
+// DefaultCacheOptions returns the options used by NewIPCache.
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{Capacity: 100000, IPv6Prefix: 64, Session: 30 * time.Minute}
+}
+
+// CacheStats reports IPCache activity since startup.
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
 type IPCache struct {
-	mu    sync.RWMutex
-	items map[string]time.Time
+	mu      sync.RWMutex
+	items   map[string]cacheEntry
+	store   UnlockStore
+	options CacheOptions
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type cacheEntry struct {
+	wallet string
+	// expiry is the sliding session end; limit is the unlock's hard expiry.
+	expiry time.Time
+	limit  time.Time
 }
 
 func NewIPCache() *IPCache {
-	return &IPCache{items: make(map[string]time.Time)}
+	return NewIPCacheWithOptions(DefaultCacheOptions())
+}
+
+// NewIPCacheWithOptions constructs an IPCache with explicit bounds and session behaviour.
+func NewIPCacheWithOptions(options CacheOptions) *IPCache {
+	if options.IPv6Prefix <= 0 || options.IPv6Prefix > 128 {
+		options.IPv6Prefix = 128
+	}
+	return &IPCache{items: make(map[string]cacheEntry), options: options}
+}
+
+// UseStore restores unexpired unlocks from store and persists every later authorization
+// to it. It returns the number of unlocks restored.
+func (c *IPCache) UseStore(store UnlockStore) (int, error) {
+	unlocks, err := store.Load()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	restored := 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, unlock := range unlocks {
+		if unlock.Expiry.After(now) {
+			c.insert(unlock.Client, unlock.Wallet, unlock.Expiry, now)
+			restored++
+		}
+	}
+	c.store = store
+	return restored, nil
 }
 
 func (c *IPCache) Authorize(remoteAddr string, expiry time.Time) {
-	ip := extractIP(remoteAddr)
-	if ip == "" {
+	c.Bind(remoteAddr, "", expiry)
+}
+
+// Bind authorizes the client address on behalf of wallet until expiry, the hard limit for
+// the sliding session.
+func (c *IPCache) Bind(remoteAddr, wallet string, expiry time.Time) {
+	key := c.clientKey(remoteAddr)
+	if key == "" {
 		return
 	}
 	c.mu.Lock()
-	c.items[ip] = expiry
+	c.insert(key, wallet, expiry, time.Now())
+	store := c.store
 	c.mu.Unlock()
+
+	if store != nil {
+		if err := store.Put(Unlock{Client: key, Wallet: wallet, Expiry: expiry}); err != nil {
+			log.Printf("warning: failed to persist unlock for %s: %v", key, err)
+		}
+	}
+}
+
+// insert adds or replaces an entry, evicting to stay within capacity. c.mu must be held.
+func (c *IPCache) insert(key, wallet string, limit, now time.Time) {
+	if _, exists := c.items[key]; !exists && c.options.Capacity > 0 && len(c.items) >= c.options.Capacity {
+		c.purgeExpired(now)
+		if len(c.items) >= c.options.Capacity {
+			c.evictSoonest()
+		}
+	}
+	c.items[key] = cacheEntry{wallet: wallet, expiry: c.sessionEnd(limit, now), limit: limit}
+}
+
+func (c *IPCache) sessionEnd(limit, now time.Time) time.Time {
+	if c.options.Session <= 0 {
+		return limit
+	}
+	if end := now.Add(c.options.Session); end.Before(limit) {
+		return end
+	}
+	return limit
 }
 
 func (c *IPCache) IsAuthorized(remoteAddr string) bool {
-	ip := extractIP(remoteAddr)
-	if ip == "" {
+	key := c.clientKey(remoteAddr)
+	if key == "" {
+		c.misses.Add(1)
 		return false
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	expiry, ok := c.items[ip]
+	entry, ok := c.items[key]
 	if !ok {
+		c.misses.Add(1)
 		return false
 	}
-	if time.Now().After(expiry) {
-		delete(c.items, ip)
+	now := time.Now()
+	if now.After(entry.expiry) {
+		delete(c.items, key)
+		c.evictions.Add(1)
+		c.misses.Add(1)
 		return false
 	}
+	entry.expiry = c.sessionEnd(entry.limit, now)
+	c.items[key] = entry
+	c.hits.Add(1)
 	return true
 }
 
+// RunJanitor removes expired entries every interval until ctx is done.
+func (c *IPCache) RunJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			c.purgeExpired(now)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// purgeExpired drops every entry whose session has ended. c.mu must be held.
+func (c *IPCache) purgeExpired(now time.Time) {
+	for key, entry := range c.items {
+		if now.After(entry.expiry) {
+			delete(c.items, key)
+			c.evictions.Add(1)
+		}
+	}
+}
+
+// evictSoonest drops the entry closest to expiry. c.mu must be held.
+func (c *IPCache) evictSoonest() {
+	var victim string
+	var soonest time.Time
+	for key, entry := range c.items {
+		if victim == "" || entry.expiry.Before(soonest) {
+			victim, soonest = key, entry.expiry
+		}
+	}
+	if victim != "" {
+		delete(c.items, victim)
+		c.evictions.Add(1)
+	}
+}
+
+// Stats returns the current size and hit, miss and eviction counters.
+func (c *IPCache) Stats() CacheStats {
+	c.mu.RLock()
+	size := len(c.items)
+	c.mu.RUnlock()
+	return CacheStats{
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// clientKey returns the cache key for a client: the IPv4 address, or the IPv6 address
+// masked to the configured prefix.
+func (c *IPCache) clientKey(remoteAddr string) string {
+	ip := extractIP(remoteAddr)
+	if ip == "" {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is4() || c.options.IPv6Prefix >= 128 {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(c.options.IPv6Prefix)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
 func extractIP(remoteAddr string) string {
 	if remoteAddr == "" {
 		return ""
@@ -58,4 +248,3 @@ func extractIP(remoteAddr string) string {
 	}
 	return host
 }
-
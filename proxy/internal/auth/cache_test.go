@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -21,3 +22,78 @@ func TestIPCacheAuthorize(t *testing.T) {
 	}
 }
 
+
+func TestIPCacheSlidesSessionUpToLimit(t *testing.T) {
+	cache := NewIPCacheWithOptions(CacheOptions{Session: 100 * time.Millisecond, IPv6Prefix: 128})
+	cache.Bind("203.0.113.10:1234", "wallet123", time.Now().Add(300*time.Millisecond))
+
+	// Regular use keeps renewing the session past its initial window...
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if !cache.IsAuthorized("203.0.113.10:1234") {
+			t.Fatalf("expected session to slide on use (iteration %d)", i)
+		}
+	}
+	// ...but never beyond the unlock's own expiry.
+	time.Sleep(150 * time.Millisecond)
+	if cache.IsAuthorized("203.0.113.10:1234") {
+		t.Fatal("expected session to end at the hard expiry")
+	}
+
+	cache.Bind("198.51.100.7:80", "wallet456", time.Now().Add(time.Hour))
+	time.Sleep(150 * time.Millisecond)
+	if cache.IsAuthorized("198.51.100.7:80") {
+		t.Fatal("expected idle session to lapse")
+	}
+}
+
+func TestIPCacheBindsIPv6Prefix(t *testing.T) {
+	cache := NewIPCacheWithOptions(CacheOptions{IPv6Prefix: 64})
+	cache.Authorize("[2001:db8:1:2::10]:443", time.Now().Add(time.Minute))
+
+	if !cache.IsAuthorized("[2001:db8:1:2:aaaa:bbbb:cccc:dddd]:443") {
+		t.Fatal("expected a rotated address in the same /64 to stay authorized")
+	}
+	if cache.IsAuthorized("[2001:db8:1:3::10]:443") {
+		t.Fatal("expected a different /64 to be unauthorized")
+	}
+}
+
+func TestIPCacheIsBoundedAndCountsActivity(t *testing.T) {
+	cache := NewIPCacheWithOptions(CacheOptions{Capacity: 2, IPv6Prefix: 128})
+	cache.Authorize("10.0.0.1", time.Now().Add(time.Minute))
+	cache.Authorize("10.0.0.2", time.Now().Add(time.Hour))
+	cache.Authorize("10.0.0.3", time.Now().Add(time.Hour))
+
+	if cache.IsAuthorized("10.0.0.1") {
+		t.Fatal("expected the entry closest to expiry to be evicted")
+	}
+	if !cache.IsAuthorized("10.0.0.2") || !cache.IsAuthorized("10.0.0.3") {
+		t.Fatal("expected newer entries to remain")
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 2 || stats.Hits != 2 || stats.Misses != 1 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestIPCacheJanitorPurgesExpiredEntries(t *testing.T) {
+	cache := NewIPCacheWithOptions(CacheOptions{IPv6Prefix: 128})
+	cache.Authorize("10.0.0.1", time.Now().Add(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.RunJanitor(ctx, 5*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for cache.Stats().Size != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected janitor to purge the expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cache.Stats().Evictions != 1 {
+		t.Fatalf("expected purge to count as an eviction, got %+v", cache.Stats())
+	}
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minRefetchInterval rate-limits JWKS fetches triggered by unknown key ids, so forged
+	// tokens cannot turn the proxy into a request amplifier against the payments service.
+	minRefetchInterval = 30 * time.Second
+	maxJWKSSize        = 1 << 20
+	minRSABits         = 2048
+)
+
+// ErrUnknownKey is returned when no current or recently retired key matches a token's kid.
+var ErrUnknownKey = errors.New("no verification key for token")
+
+// KeySet holds the public keys from a JWKS document, fetched over HTTP(S) or read from a
+// local file. Keys that disappear from the document stay usable for a grace period so
+// tokens signed just before a rotation keep verifying.
+type KeySet struct {
+	source  string
+	client  *http.Client
+	refresh time.Duration
+	grace   time.Duration
+
+	fetchMu   sync.Mutex
+	mu        sync.RWMutex
+	keys      map[string]verificationKey
+	lastFetch time.Time
+}
+
+type verificationKey struct {
+	alg       string
+	key       any
+	retiredAt time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// NewKeySet returns a key set for source, an http(s) URL or a file path, refreshed every
+// refresh interval and keeping retired keys for grace. Call Refresh before first use.
+func NewKeySet(source string, refresh, grace time.Duration) *KeySet {
+	return &KeySet{
+		source:  source,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		refresh: refresh,
+		grace:   grace,
+		keys:    make(map[string]verificationKey),
+	}
+}
+
+// Refresh fetches the JWKS document and swaps in its keys. On failure the previous keys
+// remain in place.
+func (k *KeySet) Refresh(ctx context.Context) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+	return k.refreshLocked(ctx)
+}
+
+func (k *KeySet) refreshLocked(ctx context.Context) error {
+	k.mu.Lock()
+	k.lastFetch = time.Now()
+	k.mu.Unlock()
+
+	raw, err := k.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("parse JWKS: %w", err)
+	}
+
+	fresh := make(map[string]verificationKey, len(doc.Keys))
+	for _, jwk := range doc.Keys {
+		key, err := jwk.parse()
+		if err != nil {
+			log.Printf("skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		fresh[jwk.Kid] = key
+	}
+	if len(fresh) == 0 {
+		return errors.New("JWKS contains no usable keys")
+	}
+
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for kid, old := range k.keys {
+		if _, ok := fresh[kid]; ok {
+			continue
+		}
+		if old.retiredAt.IsZero() {
+			old.retiredAt = now
+		}
+		if now.Sub(old.retiredAt) < k.grace {
+			fresh[kid] = old
+		}
+	}
+	k.keys = fresh
+	return nil
+}
+
+func (k *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(k.source, "http://") && !strings.HasPrefix(k.source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(k.source, "file://"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// Run refreshes the key set on its schedule until ctx is cancelled. It returns at once
+// when the refresh interval is not positive; unknown kids still trigger a refetch.
+func (k *KeySet) Run(ctx context.Context) {
+	if k.refresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(k.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Refresh(ctx); err != nil {
+				log.Printf("JWKS refresh failed, keeping %d cached keys: %v", k.Len(), err)
+			}
+		}
+	}
+}
+
+// Len returns the number of keys currently usable, retired ones included.
+func (k *KeySet) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+// Key returns the public key and algorithm for kid. An unknown kid triggers an immediate
+// refresh, at most once per minRefetchInterval. A token without a kid is accepted only
+// while the set holds a single key.
+func (k *KeySet) Key(kid string) (any, string, error) {
+	if key, ok := k.lookup(kid); ok {
+		return key.key, key.alg, nil
+	}
+
+	k.fetchMu.Lock()
+	k.mu.RLock()
+	stale := time.Since(k.lastFetch) >= minRefetchInterval
+	k.mu.RUnlock()
+	if stale {
+		ctx, cancel := context.WithTimeout(context.Background(), k.client.Timeout)
+		if err := k.refreshLocked(ctx); err != nil {
+			log.Printf("JWKS refresh for unknown kid %q failed: %v", kid, err)
+		}
+		cancel()
+	}
+	k.fetchMu.Unlock()
+
+	if key, ok := k.lookup(kid); ok {
+		return key.key, key.alg, nil
+	}
+	return nil, "", fmt.Errorf("%w: kid %q", ErrUnknownKey, kid)
+}
+
+func (k *KeySet) lookup(kid string) (verificationKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if kid == "" && len(k.keys) == 1 {
+		for _, only := range k.keys {
+			key, ok = only, true
+		}
+	}
+	if ok && !key.retiredAt.IsZero() && time.Since(key.retiredAt) >= k.grace {
+		return verificationKey{}, false
+	}
+	return key, ok
+}
+
+// parse converts a JWK into a public key bound to the single algorithm its type permits.
+func (j jsonWebKey) parse() (verificationKey, error) {
+	if j.Use != "" && j.Use != "sig" {
+		return verificationKey{}, fmt.Errorf("unsupported use %q", j.Use)
+	}
+
+	var key verificationKey
+	switch {
+	case j.Kty == "OKP" && j.Crv == "Ed25519":
+		x, err := decodeSegment(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return verificationKey{}, errors.New("invalid Ed25519 key")
+		}
+		key = verificationKey{alg: "EdDSA", key: ed25519.PublicKey(x)}
+	case j.Kty == "EC" && j.Crv == "P-256":
+		x, errX := decodeSegment(j.X)
+		y, errY := decodeSegment(j.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return verificationKey{}, errors.New("invalid P-256 key")
+		}
+		// ecdh rejects points that are not on the curve.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return verificationKey{}, fmt.Errorf("invalid P-256 key: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		key = verificationKey{alg: "ES256", key: pub}
+	case j.Kty == "RSA":
+		n, errN := decodeSegment(j.N)
+		e, errE := decodeSegment(j.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return verificationKey{}, errors.New("invalid RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSABits {
+			return verificationKey{}, fmt.Errorf("RSA key shorter than %d bits", minRSABits)
+		}
+		key = verificationKey{alg: "RS256", key: pub}
+	default:
+		return verificationKey{}, fmt.Errorf("unsupported key type %q %q", j.Kty, j.Crv)
+	}
+
+	if j.Alg != "" && j.Alg != key.alg {
+		return verificationKey{}, fmt.Errorf("algorithm %q does not match key type", j.Alg)
+	}
+	return key, nil
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func publicJWK(t *testing.T, kid string, pub crypto.PublicKey) map[string]string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "crv": "Ed25519", "kid": kid, "x": b64(key)}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "crv": "P-256", "kid": kid, "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "alg": "RS256", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+	}
+	t.Fatalf("unsupported key %T", pub)
+	return nil
+}
+
+// jwksServer serves whatever keys are currently set and counts fetches.
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches atomic.Int32
+}
+
+func (s *jwksServer) set(keys ...map[string]string) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s.fetches.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+}
+
+func signUnlock(t *testing.T, method jwt.SigningMethod, kid string, key any, mutate func(*UnlockClaims)) string {
+	t.Helper()
+	claims := &UnlockClaims{
+		Wallet: "wallet123",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "payhole-payments",
+			Audience:  jwt.ClaimStrings{"payhole-proxy"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	if mutate != nil {
+		mutate(claims)
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed
+}
+
+func TestJWKSAuthorizerVerifiesAsymmetricTokens(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := &jwksServer{}
+	jwks.set(publicJWK(t, "ed", edKey.Public()), publicJWK(t, "ec", &ecKey.PublicKey), publicJWK(t, "rsa", &rsaKey.PublicKey))
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := NewKeySet(srv.URL, time.Hour, time.Hour)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	authorizer, err := NewJWTAuthorizerWithOptions(JWTOptions{Keys: keys, Issuer: "payhole-payments", Audience: "payhole-proxy", Leeway: time.Minute})
+	if err != nil {
+		t.Fatalf("NewJWTAuthorizerWithOptions: %v", err)
+	}
+
+	for name, token := range map[string]string{
+		"EdDSA": signUnlock(t, jwt.SigningMethodEdDSA, "ed", edKey, nil),
+		"ES256": signUnlock(t, jwt.SigningMethodES256, "ec", ecKey, nil),
+		"RS256": signUnlock(t, jwt.SigningMethodRS256, "rsa", rsaKey, nil),
+		"leeway": signUnlock(t, jwt.SigningMethodEdDSA, "ed", edKey, func(c *UnlockClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-30 * time.Second))
+		}),
+	} {
+		if claims, err := authorizer.Verify(token); err != nil || claims.Wallet != "wallet123" {
+			t.Errorf("%s: expected valid token, got %v", name, err)
+		}
+	}
+
+	for name, token := range map[string]string{
+		"wrong issuer":   signUnlock(t, jwt.SigningMethodEdDSA, "ed", edKey, func(c *UnlockClaims) { c.Issuer = "mallory" }),
+		"wrong audience": signUnlock(t, jwt.SigningMethodEdDSA, "ed", edKey, func(c *UnlockClaims) { c.Audience = jwt.ClaimStrings{"other"} }),
+		"expired":        signUnlock(t, jwt.SigningMethodEdDSA, "ed", edKey, func(c *UnlockClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute)) }),
+		"no expiry":      signUnlock(t, jwt.SigningMethodEdDSA, "ed", edKey, func(c *UnlockClaims) { c.ExpiresAt = nil }),
+		"key mismatch":   signUnlock(t, jwt.SigningMethodES256, "rsa", ecKey, nil),
+		"hmac disabled":  signUnlock(t, jwt.SigningMethodHS256, "ed", []byte("abcdefghijklmnopqrstuvwxyz123456"), nil),
+	} {
+		if _, err := authorizer.Verify(token); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwks := &jwksServer{}
+	jwks.set(publicJWK(t, "old", oldKey.Public()))
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := NewKeySet(srv.URL, time.Hour, 200*time.Millisecond)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	authorizer, _ := NewJWTAuthorizerWithOptions(JWTOptions{Keys: keys})
+	oldToken := signUnlock(t, jwt.SigningMethodEdDSA, "old", oldKey, nil)
+
+	// The payments service rotates: the new kid is fetched on first sight, the old one is retired.
+	jwks.set(publicJWK(t, "new", newKey.Public()))
+	keys.mu.Lock()
+	keys.lastFetch = time.Time{}
+	keys.mu.Unlock()
+	if _, err := authorizer.Verify(signUnlock(t, jwt.SigningMethodEdDSA, "new", newKey, nil)); err != nil {
+		t.Fatalf("expected unknown kid to trigger a refresh, got %v", err)
+	}
+	if _, err := authorizer.Verify(oldToken); err != nil {
+		t.Fatalf("expected retired key to verify during grace, got %v", err)
+	}
+
+	fetches := jwks.fetches.Load()
+	if _, err := authorizer.Verify(signUnlock(t, jwt.SigningMethodEdDSA, "forged", oldKey, nil)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected unknown kid error, got %v", err)
+	}
+	if jwks.fetches.Load() != fetches {
+		t.Fatal("expected unknown kid refreshes to be rate limited")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if _, err := authorizer.Verify(oldToken); err == nil {
+		t.Fatal("expected retired key to expire after the grace period")
+	}
+}
+
+func TestKeySetReadsLocalFileAndKeepsKeysOnFailure(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	doc, _ := json.Marshal(map[string]any{"keys": []map[string]string{publicJWK(t, "", key.Public())}})
+	os.WriteFile(path, doc, 0o600)
+
+	keys := NewKeySet(path, time.Hour, time.Hour)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	authorizer, _ := NewJWTAuthorizerWithOptions(JWTOptions{Keys: keys})
+	if _, err := authorizer.Verify(signUnlock(t, jwt.SigningMethodEdDSA, "", key, nil)); err != nil {
+		t.Fatalf("expected single kid-less key to verify, got %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`), 0o600)
+	if err := keys.Refresh(context.Background()); err == nil || keys.Len() != 1 {
+		t.Fatalf("expected unusable JWKS to be rejected without dropping keys, got %v with %d keys", err, keys.Len())
+	}
+
+	if _, err := NewJWTAuthorizerWithOptions(JWTOptions{}); err == nil {
+		t.Fatal("expected a secret or key set to be required")
+	}
+}
+
+func TestKeySetRunWithoutScheduleReturns(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		NewKeySet("jwks.json", 0, time.Hour).Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return when the refresh interval is zero")
+	}
+}
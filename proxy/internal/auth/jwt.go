@@ -14,15 +14,61 @@ type UnlockClaims struct {
 	jwt.RegisteredClaims
 }
 
+// JWTOptions configures how unlock tokens are verified. At least one of Secret (HS256)
+// or Keys (EdDSA, ES256 and RS256 from a JWKS) must be set; with both, either is accepted,
+// which lets deployments migrate off the shared secret.
+type JWTOptions struct {
+	Secret   string
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking exp, nbf and iat.
+	Leeway time.Duration
+}
+
+// JWTAuthorizer verifies the unlock tokens issued by the payments service.
 type JWTAuthorizer struct {
-	secret []byte
+	secret  []byte
+	keys    *KeySet
+	methods []string
+	options []jwt.ParserOption
 }
 
+// NewJWTAuthorizer verifies HS256 tokens signed with secret.
 func NewJWTAuthorizer(secret string) (*JWTAuthorizer, error) {
-	if len(secret) < 32 {
-		return nil, errors.New("JWT secret must be at least 32 characters")
+	return NewJWTAuthorizerWithOptions(JWTOptions{Secret: secret})
+}
+
+// NewJWTAuthorizerWithOptions builds a verifier for the configured secret and key set,
+// enforcing the issuer and audience when they are set.
+func NewJWTAuthorizerWithOptions(opts JWTOptions) (*JWTAuthorizer, error) {
+	a := &JWTAuthorizer{keys: opts.Keys}
+	if opts.Secret != "" {
+		if len(opts.Secret) < 32 {
+			return nil, errors.New("JWT secret must be at least 32 characters")
+		}
+		a.secret = []byte(opts.Secret)
+		a.methods = append(a.methods, jwt.SigningMethodHS256.Alg())
+	}
+	if opts.Keys != nil {
+		a.methods = append(a.methods, jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodES256.Alg(), jwt.SigningMethodRS256.Alg())
+	}
+	if len(a.methods) == 0 {
+		return nil, errors.New("JWT verification needs a secret or a JWKS")
 	}
-	return &JWTAuthorizer{secret: []byte(secret)}, nil
+
+	a.options = []jwt.ParserOption{
+		jwt.WithValidMethods(a.methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		a.options = append(a.options, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		a.options = append(a.options, jwt.WithAudience(opts.Audience))
+	}
+	return a, nil
 }
 
 func (a *JWTAuthorizer) Verify(token string) (*UnlockClaims, error) {
@@ -30,12 +76,7 @@ func (a *JWTAuthorizer) Verify(token string) (*UnlockClaims, error) {
 		return nil, errors.New("token is empty")
 	}
 
-	parsed, err := jwt.ParseWithClaims(token, &UnlockClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %s", t.Header["alg"])
-		}
-		return a.secret, nil
-	})
+	parsed, err := jwt.ParseWithClaims(token, &UnlockClaims{}, a.key, a.options...)
 	if err != nil {
 		return nil, err
 	}
@@ -45,10 +86,6 @@ func (a *JWTAuthorizer) Verify(token string) (*UnlockClaims, error) {
 		return nil, errors.New("invalid token claims")
 	}
 
-	if claims.ExpiresAt == nil {
-		return nil, errors.New("token missing expiry")
-	}
-
 	if claims.Wallet == "" {
 		return nil, errors.New("token missing wallet claim")
 	}
@@ -56,6 +93,30 @@ func (a *JWTAuthorizer) Verify(token string) (*UnlockClaims, error) {
 	return claims, nil
 }
 
+// key selects the verification key for t. Asymmetric keys are bound to one algorithm,
+// so a token cannot pick a weaker method for a key than the JWKS declared.
+func (a *JWTAuthorizer) key(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if a.secret == nil {
+			return nil, fmt.Errorf("unexpected signing method: %s", t.Method.Alg())
+		}
+		return a.secret, nil
+	}
+	if a.keys == nil {
+		return nil, fmt.Errorf("unexpected signing method: %s", t.Method.Alg())
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key, alg, err := a.keys.Key(kid)
+	if err != nil {
+		return nil, err
+	}
+	if alg != t.Method.Alg() {
+		return nil, fmt.Errorf("key %q is for %s, token uses %s", kid, alg, t.Method.Alg())
+	}
+	return key, nil
+}
+
 func ExtractBearer(header string) string {
 	if header == "" {
 		return ""
@@ -76,4 +137,3 @@ func ExpiryFromClaims(claims *UnlockClaims) time.Time {
 	}
 	return claims.ExpiresAt.Time
 }
-
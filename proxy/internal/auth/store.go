@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compactMinRecords is the log length below which a FileStore never compacts on write.
+const compactMinRecords = 1024
+
+// Unlock binds a client address to the wallet that paid for premium access until Expiry.
+type Unlock struct {
+	Client string    `json:"client"`
+	Wallet string    `json:"wallet,omitempty"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// UnlockStore persists premium unlocks so they survive restarts. Put replaces any earlier
+// unlock for the same client; an already expired unlock revokes it.
+type UnlockStore interface {
+	Load() ([]Unlock, error)
+	Put(unlock Unlock) error
+	Close() error
+}
+
+// FileStore is an append-only UnlockStore: every Put adds one JSON line, and the log is
+// rewritten with only the live unlocks when it opens and once stale lines outnumber them.
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	live    map[string]Unlock
+	records int
+}
+
+// OpenFileStore replays the log at path, dropping expired unlocks, and compacts it. A
+// missing file starts an empty store; a torn final line from a crash is ignored.
+func OpenFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileStore{path: path, live: make(map[string]Unlock)}
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var unlock Unlock
+			if json.Unmarshal(scanner.Bytes(), &unlock) != nil || unlock.Client == "" {
+				continue
+			}
+			s.live[unlock.Client] = unlock
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read unlock store: %w", err)
+		}
+	}
+
+	if err := s.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load returns the unlocks that have not expired.
+func (s *FileStore) Load() ([]Unlock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	unlocks := make([]Unlock, 0, len(s.live))
+	for _, unlock := range s.live {
+		if unlock.Expiry.After(now) {
+			unlocks = append(unlocks, unlock)
+		}
+	}
+	return unlocks, nil
+}
+
+// Put appends unlock to the log.
+func (s *FileStore) Put(unlock Unlock) error {
+	line, err := json.Marshal(unlock)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("unlock store is closed")
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.live[unlock.Client] = unlock
+	s.records++
+
+	if s.records > compactMinRecords && s.records > 2*len(s.live) {
+		return s.compact(time.Now())
+	}
+	return nil
+}
+
+// compact drops expired unlocks and atomically replaces the log with the live ones.
+// s.mu must be held or s not yet shared.
+func (s *FileStore) compact(now time.Time) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	records := 0
+	for client, unlock := range s.live {
+		if !unlock.Expiry.After(now) {
+			delete(s.live, client)
+			continue
+		}
+		line, err := json.Marshal(unlock)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+		records++
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.records = records
+	return nil
+}
+
+// Close compacts the log one last time and releases the file.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.compact(time.Now())
+	if s.file != nil {
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+		s.file = nil
+	}
+	return err
+}
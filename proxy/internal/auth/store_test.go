@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unlocks.log")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	cache := NewIPCache()
+	if _, err := cache.UseStore(store); err != nil {
+		t.Fatalf("UseStore: %v", err)
+	}
+	cache.Bind("203.0.113.10:1234", "wallet123", time.Now().Add(time.Hour))
+	cache.Bind("198.51.100.7:80", "wallet456", time.Now().Add(-time.Minute))
+
+	// Simulate a crash: the handle is never closed and a torn line is left behind.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	f.WriteString(`{"client":"192.0.2.1","wal`)
+	f.Close()
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	restarted := NewIPCache()
+	restored, err := restarted.UseStore(reopened)
+	if err != nil || restored != 1 {
+		t.Fatalf("expected 1 restored unlock, got %d (%v)", restored, err)
+	}
+	if !restarted.IsAuthorized("203.0.113.10:5555") {
+		t.Fatal("expected unlock to survive restart")
+	}
+	if restarted.IsAuthorized("198.51.100.7:80") || restarted.IsAuthorized("192.0.2.1:80") {
+		t.Fatal("expected expired and torn entries to be dropped")
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 1 || !strings.Contains(string(data), "wallet123") {
+		t.Fatalf("expected compacted log with the live unlock only, got %q", data)
+	}
+}
+
+func TestFileStoreCompactsOnWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unlocks.log")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	defer store.Close()
+
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < 3*compactMinRecords; i++ {
+		if err := store.Put(Unlock{Client: "203.0.113.10", Wallet: "wallet123", Expiry: expiry}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines > compactMinRecords+1 {
+		t.Fatalf("expected log to be compacted, found %d lines", lines)
+	}
+	unlocks, _ := store.Load()
+	if len(unlocks) != 1 || unlocks[0].Wallet != "wallet123" {
+		t.Fatalf("unexpected unlocks after compaction: %+v", unlocks)
+	}
+}
@@ -14,11 +14,62 @@ import (
 
 type List interface {
 	Contains(host string) bool
+	// Match returns the most specific entry covering host.
+	Match(host string) (string, bool)
+}
+
+// RuleSink receives filter list lines that cannot be reduced to a plain blocked domain,
+// such as path rules or rules carrying ABP options.
+type RuleSink interface {
+	AddFilter(line string) bool
+}
+
+// MultiSink offers every line to each sink, so network and element hiding engines can share
+// one download. A line is accepted when any sink accepts it.
+func MultiSink(sinks ...RuleSink) RuleSink {
+	return multiSink(sinks)
+}
+
+type multiSink []RuleSink
+
+func (m multiSink) AddFilter(line string) bool {
+	accepted := false
+	for _, sink := range m {
+		if sink != nil && sink.AddFilter(line) {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// Union matches a host against each list in turn, returning the first list's match.
+func Union(lists ...List) List {
+	return union(lists)
+}
+
+type union []List
+
+func (u union) Contains(host string) bool {
+	_, ok := u.Match(host)
+	return ok
+}
+
+func (u union) Match(host string) (string, bool) {
+	for _, list := range u {
+		if list == nil {
+			continue
+		}
+		if entry, ok := list.Match(host); ok {
+			return entry, true
+		}
+	}
+	return "", false
 }
 
 type Set struct {
-	mu      sync.RWMutex
-	domains map[string]struct{}
+	mu       sync.RWMutex
+	domains  map[string]struct{}
+	onChange []func()
 }
 
 func New(entries []string) *Set {
@@ -61,9 +112,15 @@ func LoadFromFile(path string) (*Set, error) {
 }
 
 func (s *Set) Contains(host string) bool {
+	_, ok := s.Match(host)
+	return ok
+}
+
+// Match returns the most specific entry that equals host or one of its parent domains.
+func (s *Set) Match(host string) (string, bool) {
 	domain := canonicalDomain(host)
 	if domain == "" {
-		return false
+		return "", false
 	}
 
 	s.mu.RLock()
@@ -71,11 +128,11 @@ func (s *Set) Contains(host string) bool {
 
 	for {
 		if _, ok := s.domains[domain]; ok {
-			return true
+			return domain, true
 		}
 		idx := strings.IndexByte(domain, '.')
 		if idx == -1 {
-			return false
+			return "", false
 		}
 		domain = domain[idx+1:]
 	}
@@ -91,23 +148,37 @@ func canonicalDomain(host string) string {
 	return strings.TrimSuffix(strings.ToLower(host), ".")
 }
 
+// OnChange registers fn to run after entries are merged into the set, so caches derived
+// from earlier decisions can be dropped.
+func (s *Set) OnChange(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
 // Merge adds the provided domains into the blocklist.
 func (s *Set) Merge(domains []string) {
 	if s == nil || len(domains) == 0 {
 		return
 	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	for _, domain := range domains {
 		if d := canonicalDomain(domain); d != "" {
 			s.domains[d] = struct{}{}
 		}
 	}
+	hooks := s.onChange
+	s.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
 }
 
-// AppendFromURLs downloads filter lists (e.g., EasyList) and merges them into the set.
-func (s *Set) AppendFromURLs(urls []string) error {
+// AppendFromURLs downloads filter lists (e.g., EasyList) and merges their domain rules into
+// the set and whole-domain "@@" exceptions into allow. Remaining rules are handed to sink.
+// Both allow and sink may be nil.
+func (s *Set) AppendFromURLs(urls []string, allow *Set, sink RuleSink) error {
 	for _, u := range urls {
 		if strings.TrimSpace(u) == "" {
 			continue
@@ -124,10 +195,15 @@ func (s *Set) AppendFromURLs(urls []string) error {
 		}
 
 		scanner := bufio.NewScanner(resp.Body)
-		var domains []string
+		var domains, exceptions []string
 		for scanner.Scan() {
-			if domain := parseFilterLine(scanner.Text()); domain != "" {
+			line := scanner.Text()
+			if domain := parseFilterLine(line); domain != "" {
 				domains = append(domains, domain)
+			} else if domain := parseExceptionLine(line); domain != "" && allow != nil {
+				exceptions = append(exceptions, domain)
+			} else if sink != nil {
+				sink.AddFilter(line)
 			}
 		}
 		_ = resp.Body.Close()
@@ -137,6 +213,7 @@ func (s *Set) AppendFromURLs(urls []string) error {
 		}
 
 		s.Merge(domains)
+		allow.Merge(exceptions)
 	}
 	return nil
 }
@@ -152,30 +229,58 @@ func parseFilterLine(line string) string {
 	if strings.HasPrefix(trimmed, "##") || strings.HasPrefix(trimmed, "@@") {
 		return ""
 	}
+	// Only whole-domain rules ("||ads.example.com^") block a host outright; anything with a
+	// path, wildcard or options is left to the network filter so it is not widened to a domain.
 	if strings.HasPrefix(trimmed, "||") {
-		trimmed = trimmed[2:]
-		if idx := strings.IndexAny(trimmed, "^/"); idx != -1 {
-			trimmed = trimmed[:idx]
+		trimmed = strings.TrimSuffix(trimmed[2:], "^")
+		if !isPlainDomain(trimmed) {
+			return ""
 		}
-		return canonicalDomain(trimmed)
-	}
-	if strings.HasPrefix(trimmed, "|http") {
-		trimmed = strings.TrimPrefix(trimmed, "|")
-		if idx := strings.Index(trimmed, "://"); idx != -1 {
-			trimmed = trimmed[idx+3:]
-		}
-		if idx := strings.Index(trimmed, "/"); idx != -1 {
-			trimmed = trimmed[:idx]
-		}
-		return canonicalDomain(trimmed)
+		return registrableEntry(trimmed)
 	}
 	fields := strings.Fields(trimmed)
 	if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
-		return canonicalDomain(fields[len(fields)-1])
+		return registrableEntry(fields[len(fields)-1])
+	}
+	if net.ParseIP(trimmed) != nil || !isPlainDomain(trimmed) {
+		return ""
+	}
+	return registrableEntry(trimmed)
+}
+
+// registrableEntry drops entries naming a whole public suffix, which would otherwise block
+// every site under e.g. "co.uk" because Contains matches parent domains.
+func registrableEntry(host string) string {
+	if IsPublicSuffix(host) {
+		return ""
 	}
-	if net.ParseIP(trimmed) != nil {
+	return canonicalDomain(host)
+}
+
+// parseExceptionLine returns the domain of a whole-domain "@@||domain^" exception rule.
+func parseExceptionLine(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "@@||") {
+		return ""
+	}
+	trimmed = strings.TrimSuffix(trimmed[4:], "^")
+	if !isPlainDomain(trimmed) {
 		return ""
 	}
 	return canonicalDomain(trimmed)
 }
 
+func isPlainDomain(value string) bool {
+	if !strings.Contains(value, ".") || strings.HasPrefix(value, ".") || strings.HasPrefix(value, "-") {
+		return false
+	}
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
@@ -22,3 +22,105 @@ func TestContainsMatchesSubdomains(t *testing.T) {
 	}
 }
 
+func TestParseFilterLineKeepsOnlyWholeDomainRules(t *testing.T) {
+	tests := map[string]string{
+		"||ads.example.com^":              "ads.example.com",
+		"0.0.0.0 tracker.example.net":     "tracker.example.net",
+		"plain.example.org":               "plain.example.org",
+		"||ads.example.com^$third-party":  "",
+		"||cdn.example.com/ads/banner.js": "",
+		"|http://example.com/ads/":        "",
+		"/ads/banner.js":                  "",
+		"example.com##.ad":                "",
+		"@@||example.com^":                "",
+		"! EasyList comment":              "",
+		"||co.uk^":                        "",
+		"0.0.0.0 github.io":               "",
+	}
+	for line, want := range tests {
+		if got := parseFilterLine(line); got != want {
+			t.Errorf("parseFilterLine(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestParseExceptionLine(t *testing.T) {
+	if got := parseExceptionLine("@@||api.tracker.example.com^"); got != "api.tracker.example.com" {
+		t.Fatalf("expected whole-domain exception, got %q", got)
+	}
+	if got := parseExceptionLine("@@||example.com/ads/consent.js"); got != "" {
+		t.Fatalf("did not expect path exception to become a domain, got %q", got)
+	}
+}
+
+func TestMatchReturnsMostSpecificEntry(t *testing.T) {
+	bl := New([]string{"example.com", "api.example.com"})
+	if entry, ok := bl.Match("v1.api.example.com"); !ok || entry != "api.example.com" {
+		t.Fatalf("expected api.example.com, got %q (%v)", entry, ok)
+	}
+}
+
+func TestSiteUsesPublicSuffixList(t *testing.T) {
+	tests := map[string]string{
+		"www.example.com":    "example.com",
+		"a.b.example.co.uk":  "example.co.uk",
+		"user.github.io":     "user.github.io",
+		"cdn.user.github.io": "user.github.io",
+		"Example.COM.":       "example.com",
+		"co.uk":              "co.uk",
+		"203.0.113.10":       "203.0.113.10",
+	}
+	for host, want := range tests {
+		if got := Site(host); got != want {
+			t.Errorf("Site(%q) = %q, want %q", host, got, want)
+		}
+	}
+
+	if SameSite("shop.example.co.uk", "news.other.co.uk") {
+		t.Fatalf("different registrable domains under co.uk must not be same-site")
+	}
+	if !SameSite("static.example.co.uk", "www.example.co.uk") {
+		t.Fatalf("expected subdomains of example.co.uk to be same-site")
+	}
+	if SameSite("alice.github.io", "bob.github.io") {
+		t.Fatalf("private suffixes must separate sites")
+	}
+}
+
+type recordingSink struct {
+	prefix string
+	lines  []string
+}
+
+func (s *recordingSink) AddFilter(line string) bool {
+	s.lines = append(s.lines, line)
+	return len(line) >= len(s.prefix) && line[:len(s.prefix)] == s.prefix
+}
+
+func TestMultiSinkOffersEveryLineToEachSink(t *testing.T) {
+	network := &recordingSink{prefix: "||"}
+	cosmetic := &recordingSink{prefix: "##"}
+	sink := MultiSink(network, cosmetic)
+
+	if !sink.AddFilter("##.ad") || !sink.AddFilter("||ads.example.com/x.js") {
+		t.Fatalf("expected lines accepted by one sink to be reported as accepted")
+	}
+	if sink.AddFilter("! comment") {
+		t.Fatalf("did not expect a line rejected by every sink to be accepted")
+	}
+	if len(network.lines) != 3 || len(cosmetic.lines) != 3 {
+		t.Fatalf("expected each sink to see all lines, got %d and %d", len(network.lines), len(cosmetic.lines))
+	}
+}
+
+func TestMergeNotifiesChangeHooks(t *testing.T) {
+	set := New(nil)
+	changes := 0
+	set.OnChange(func() { changes++ })
+
+	set.Merge(nil)
+	set.Merge([]string{"ads.example.com"})
+	if changes != 1 || !set.Contains("x.ads.example.com") {
+		t.Fatalf("expected one change notification after merging entries, got %d", changes)
+	}
+}
@@ -0,0 +1,38 @@
+package blocklist
+
+import (
+	"net"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Site returns the registrable domain (eTLD+1) of host according to the embedded Public
+// Suffix List, so "a.b.example.co.uk" and "example.co.uk" share the site "example.co.uk".
+// IP addresses and bare public suffixes are returned unchanged.
+func Site(host string) string {
+	host = canonicalDomain(host)
+	if host == "" || net.ParseIP(host) != nil {
+		return host
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return site
+}
+
+// SameSite reports whether two hosts share a registrable domain.
+func SameSite(a, b string) bool {
+	return Site(a) == Site(b)
+}
+
+// IsPublicSuffix reports whether host is itself a public suffix such as "co.uk" or
+// "github.io", which no single party controls.
+func IsPublicSuffix(host string) bool {
+	host = canonicalDomain(host)
+	if host == "" || net.ParseIP(host) != nil {
+		return false
+	}
+	suffix, _ := publicsuffix.PublicSuffix(host)
+	return suffix == host
+}
@@ -0,0 +1,158 @@
+// Package clientip determines the real client address of requests that arrive through
+// load balancers and reverse proxies, so unlocks and policy decisions are tied to the user
+// rather than to the balancer in front of PayHole.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type peerKey struct{}
+
+// Trusted lists the networks of proxies and load balancers whose reports of the client
+// address (X-Forwarded-For, Forwarded or a PROXY protocol header) are believed.
+type Trusted struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrusted parses CIDRs or single IPs.
+func ParseTrusted(entries []string) (Trusted, error) {
+	var t Trusted
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return Trusted{}, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			addr = addr.Unmap()
+			t.prefixes = append(t.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return Trusted{}, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		t.prefixes = append(t.prefixes, prefix.Masked())
+	}
+	return t, nil
+}
+
+// Empty reports whether no proxies are trusted.
+func (t Trusted) Empty() bool {
+	return len(t.prefixes) == 0
+}
+
+// Contains reports whether address, an "ip:port" or bare IP, belongs to a trusted proxy.
+func (t Trusted) Contains(address string) bool {
+	addr, ok := parseAddr(address)
+	return ok && t.contains(addr)
+}
+
+func (t Trusted) contains(addr netip.Addr) bool {
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client behind r. When the connecting peer is a
+// trusted proxy, the Forwarded header (or X-Forwarded-For without it) is walked from the
+// nearest hop outwards and the first untrusted address wins; otherwise the peer itself is
+// the client. Malformed or obfuscated entries stop the walk at the last address known good.
+func (t Trusted) ClientAddr(r *http.Request) string {
+	client := r.RemoteAddr
+	if t.Empty() || !t.Contains(client) {
+		return client
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(hops[i])
+		if !ok {
+			break
+		}
+		client = net.JoinHostPort(addr.String(), "0")
+		if !t.contains(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// Middleware replaces RemoteAddr with the resolved client address for every handler
+// behind it; the connecting peer stays available through Peer.
+func (t Trusted) Middleware(next http.Handler) http.Handler {
+	if t.Empty() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := t.ClientAddr(r)
+		if client == r.RemoteAddr {
+			next.ServeHTTP(w, r)
+			return
+		}
+		resolved := r.WithContext(context.WithValue(r.Context(), peerKey{}, r.RemoteAddr))
+		resolved.RemoteAddr = client
+		next.ServeHTTP(w, resolved)
+	})
+}
+
+// Peer returns the address of the host that connected to the proxy, which differs from
+// r.RemoteAddr when Middleware resolved a client behind a trusted proxy.
+func Peer(r *http.Request) string {
+	if peer, ok := r.Context().Value(peerKey{}).(string); ok {
+		return peer
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor returns the client chain from the Forwarded header's for= parameters, or
+// from X-Forwarded-For when no Forwarded header is present, ordered from origin to nearest.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				node := ""
+				for _, pair := range strings.Split(element, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						node = strings.Trim(val, `"`)
+					}
+				}
+				hops = append(hops, node)
+			}
+		}
+		return hops
+	}
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseAddr accepts "ip", "ip:port", "[ipv6]" and "[ipv6]:port".
+func parseAddr(address string) (netip.Addr, bool) {
+	address = strings.TrimSpace(address)
+	if addrPort, err := netip.ParseAddrPort(address); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
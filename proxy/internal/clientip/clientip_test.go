@@ -0,0 +1,62 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddrWalksForwardedChain(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("ParseTrusted: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer ignores header", "203.0.113.9:4000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9:4000"},
+		{"trusted peer without header", "10.0.0.2:4000", nil, "10.0.0.2:4000"},
+		{"single hop", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1:0"},
+		{"spoofed origin is skipped", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 192.0.2.1"}, "198.51.100.1:0"},
+		{"forwarded wins over xff", "10.0.0.2:4000", map[string]string{
+			"Forwarded":       `for="[2001:db8::1]:4711";proto=https, for=10.1.2.3`,
+			"X-Forwarded-For": "198.51.100.1",
+		}, "[2001:db8::1]:0"},
+		{"garbage stops the walk", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "198.51.100.1, nonsense, 10.0.0.7"}, "10.0.0.7:0"},
+		{"obfuscated node keeps peer", "10.0.0.2:4000", map[string]string{"Forwarded": "for=_hidden"}, "10.0.0.2:4000"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if got := trusted.ClientAddr(r); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestMiddlewareKeepsPeer(t *testing.T) {
+	trusted, _ := ParseTrusted([]string{"10.0.0.0/8"})
+	var remote, peer string
+	handler := trusted.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		remote, peer = r.RemoteAddr, Peer(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if remote != "198.51.100.1:0" || peer != "10.0.0.2:4000" {
+		t.Fatalf("expected resolved client and original peer, got %s and %s", remote, peer)
+	}
+
+	if _, err := ParseTrusted([]string{"not-a-cidr"}); err == nil {
+		t.Fatal("expected invalid entry to be rejected")
+	}
+}
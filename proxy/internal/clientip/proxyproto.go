@@ -0,0 +1,205 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// headerTimeout bounds how long a trusted peer may take to send its PROXY header.
+	headerTimeout = 5 * time.Second
+	// maxV1Length is the longest v1 header the specification allows, CRLF included.
+	maxV1Length = 107
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader is returned when a trusted peer sends a malformed PROXY header.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener accepts PROXY protocol v1 and v2 headers from trusted peers and reports the
+// address they carry as the connection's RemoteAddr. The header is optional, so health
+// checks and L7 proxies on the trusted list still work; connections from any other peer
+// are passed through untouched and a header they send is treated as ordinary data.
+type Listener struct {
+	net.Listener
+	trusted Trusted
+}
+
+// NewListener wraps inner so trusted peers may prefix connections with a PROXY header.
+func NewListener(inner net.Listener, trusted Trusted) *Listener {
+	return &Listener{Listener: inner, trusted: trusted}
+}
+
+// Accept returns the next connection. The header is read lazily on first use, so a slow
+// peer cannot stall Accept for everyone else.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted.Contains(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+
+		c.mu.Lock()
+		restore := c.readDeadline
+		c.mu.Unlock()
+		deadline := time.Now().Add(headerTimeout)
+		if !restore.IsZero() && restore.Before(deadline) {
+			deadline = restore
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.remote, c.err = readHeader(c.reader)
+		c.Conn.SetReadDeadline(restore)
+
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader consumes a PROXY header if one is present and returns the source address it
+// names. A nil address with a nil error means the connection's own address applies: no
+// header was sent, or it was a LOCAL, UNKNOWN or non-IP header.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(v2Signature))
+	switch {
+	case bytes.Equal(peek, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		return readV1(r)
+	case err != nil && len(peek) == 0:
+		return nil, err
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is not CRLF terminated", ErrInvalidHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: bad source address %q", ErrInvalidHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port %q", ErrInvalidHeader, fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the balancer's own connection, e.g. a health check.
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+
+	// Any TLVs after the addresses are skipped.
+	switch family {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
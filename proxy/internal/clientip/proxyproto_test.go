@@ -0,0 +1,94 @@
+package clientip
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialThrough sends header and payload to a PROXY-aware listener and returns the
+// accepted connection's RemoteAddr along with the payload it read.
+func dialThrough(t *testing.T, trusted []string, header []byte, payload string) (string, string, error) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer inner.Close()
+	list, _ := ParseTrusted(trusted)
+	l := NewListener(inner, list)
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	go client.Write(append(header, payload...))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	remote := conn.RemoteAddr().String()
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, buf)
+	return remote, string(buf), err
+}
+
+func v2Header(command byte, src net.IP, port uint16) []byte {
+	block := make([]byte, 12)
+	copy(block[0:4], src.To4())
+	copy(block[4:8], net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(block[8:10], port)
+	binary.BigEndian.PutUint16(block[10:12], 8080)
+	block = append(block, 0x04, 0x00, 0x01, 'x') // a NOOP TLV to skip
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, 0x11, 0, byte(len(block)))
+	return append(header, block...)
+}
+
+func TestListenerParsesProxyHeaders(t *testing.T) {
+	loopback := []string{"127.0.0.0/8"}
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 198.51.100.1 127.0.0.1 51234 8080\r\n"), "198.51.100.1:51234"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::1 51234 8080\r\n"), "[2001:db8::1]:51234"},
+		{"v2 proxy", v2Header(0x1, net.IPv4(198, 51, 100, 2), 40000), "198.51.100.2:40000"},
+	}
+	for _, tc := range tests {
+		remote, payload, err := dialThrough(t, loopback, tc.header, "GET / HTTP/1.1\r\n")
+		if err != nil || remote != tc.want || payload != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: expected %s with intact payload, got %s %q (%v)", tc.name, tc.want, remote, payload, err)
+		}
+	}
+
+	for name, header := range map[string][]byte{
+		"no header":  nil,
+		"v1 unknown": []byte("PROXY UNKNOWN\r\n"),
+		"v2 local":   v2Header(0x0, net.IPv4(198, 51, 100, 2), 40000),
+	} {
+		remote, payload, err := dialThrough(t, loopback, header, "GET / HTTP/1.1\r\n")
+		if host, _, _ := net.SplitHostPort(remote); err != nil || host != "127.0.0.1" || payload != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: expected the peer address, got %s %q (%v)", name, remote, payload, err)
+		}
+	}
+}
+
+func TestListenerIgnoresUntrustedAndRejectsMalformed(t *testing.T) {
+	header := "PROXY TCP4 198.51.100.1 127.0.0.1 51234 8080\r\n"
+	remote, payload, err := dialThrough(t, []string{"10.0.0.0/8"}, []byte(header), "ping")
+	if err != nil || remote == "198.51.100.1:51234" || payload != header[:4] {
+		t.Fatalf("expected untrusted peer to pass through untouched, got %s %q (%v)", remote, payload, err)
+	}
+
+	if _, _, err := dialThrough(t, []string{"127.0.0.1"}, []byte("PROXY TCP4 bogus 127.0.0.1 1 2\r\n"), "ping"); err == nil {
+		t.Fatal("expected malformed header to fail the connection")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,15 +15,87 @@ type Config struct {
 	HTTPProxyAddr string
 	DoHAddr       string
 	DNSProxyAddr  string
-	UpstreamDNS   string
+	UpstreamDNS   []string
+	// How queries are spread across UpstreamDNS and how often each upstream is probed.
+	UpstreamStrategy    string
+	UpstreamHealthCheck time.Duration
 	BlocklistPath string
 	BlocklistURLs []string
+	AllowlistPath string
 	PremiumDomains []string
 	JWTSecret     string
+	// JWKS source (URL or file) for asymmetric unlock tokens, and the claims they must carry.
+	JWKSURL     string
+	JWKSRefresh time.Duration
+	JWKSGrace   time.Duration
+	JWTIssuer   string
+	JWTAudience string
+	JWTLeeway   time.Duration
 	AnalyticsURL  string
 	UpstreamTimeout time.Duration
+	// DNS answer cache limits; a zero size disables the cache.
+	DNSCacheSize        int
+	DNSCacheMinTTL      time.Duration
+	DNSCacheMaxTTL      time.Duration
+	DNSCacheNegativeTTL time.Duration
+	DNSPrefetch         bool
+	DNSServeStale       bool
+	// How blocked names are answered, per block reason, and the TTL of those answers. An
+	// empty mode keeps the default from dnsproxy.DefaultBlockOptions.
+	DNSBlockModeAds     string
+	DNSBlockModePremium string
+	DNSSinkholeIPs      []string
+	DNSBlockedTTL       time.Duration
+	// DNS-over-TLS listener (RFC 7858); an empty address disables it. DoTHostname is the
+	// Private DNS name advertised on /setup.
+	DoTAddr        string
+	DoTCertPath    string
+	DoTKeyPath     string
+	DoTHostname    string
+	DoTIdleTimeout time.Duration
 	AutoConfigProxyURL string
 	SetupDocsURL       string
+	TLSIntercept           bool
+	InterceptCACertPath    string
+	InterceptCAKeyPath     string
+	InterceptBypassPath    string
+	InterceptBypassDomains []string
+	X402Network            string
+	PaymentAsset           string
+	PaymentPayTo           string
+	PaymentAmountUSDC      float64
+	PaymentMaxTimeout      time.Duration
+	X402FacilitatorURL     string
+	PrivacyProfile         string
+	PrivacyForwardedFor    string
+	URLRewrite             bool
+	CookiePolicy           string
+	Surrogates             bool
+	CosmeticFiltering      bool
+	// Per-phase HTTP proxy timeouts; body transfer itself is never capped.
+	HTTPReadHeaderTimeout   time.Duration
+	HTTPIdleTimeout         time.Duration
+	UpstreamConnectTimeout  time.Duration
+	UpstreamResponseTimeout time.Duration
+	WebSocketIdleTimeout    time.Duration
+	WebSocketMaxLifetime    time.Duration
+	// Upstream CIDRs allowed or denied on top of the built-in private-range egress policy.
+	EgressAllowCIDRs []string
+	EgressDenyCIDRs  []string
+	// Shared secret, clock tolerance and optional caller CIDRs for the signed unlock webhook.
+	UnlockWebhookSecret    string
+	UnlockWebhookTolerance time.Duration
+	UnlockWebhookSources   []string
+	UnlockStorePath        string
+	// Unlock cache bounds: maximum clients, IPv6 binding prefix, sliding session length and
+	// the longest unlock a webhook may grant.
+	UnlockCacheCapacity int
+	UnlockIPv6Prefix    int
+	UnlockSession       time.Duration
+	UnlockMaxLifetime   time.Duration
+	// Load balancer CIDRs whose X-Forwarded-For, Forwarded and PROXY headers are believed.
+	TrustedProxies []string
+	ProxyProtocol  bool
 }
 
 // FromEnv loads configuration from environment variables.
@@ -37,15 +111,86 @@ func FromEnv() (Config, error) {
 		HTTPProxyAddr:  valueOrDefault("HTTP_PROXY_ADDR", ":8080"),
 		DoHAddr:        valueOrDefault("DOH_ADDR", ":8443"),
 		DNSProxyAddr:   valueOrDefault("DNS_PROXY_ADDR", ":5353"),
-		UpstreamDNS:    valueOrDefault("UPSTREAM_DNS_ADDR", "1.1.1.1:53"),
+		UpstreamDNS:    splitList(valueOrDefault("UPSTREAM_DNS_ADDR", "1.1.1.1:53")),
+		UpstreamStrategy:    valueOrDefault("UPSTREAM_DNS_STRATEGY", "failover"),
+		UpstreamHealthCheck: secondsValue("UPSTREAM_HEALTH_CHECK_SECONDS", 10*time.Second),
 		BlocklistPath:  valueOrDefault("BLOCKLIST_PATH", "data/blocklist.txt"),
 		BlocklistURLs:  splitList(os.Getenv("BLOCKLIST_URLS")),
+		AllowlistPath:  os.Getenv("ALLOWLIST_PATH"),
 		PremiumDomains: splitList(os.Getenv("PREMIUM_DOMAINS")),
 		JWTSecret:      os.Getenv("PAYMENTS_JWT_SECRET"),
+		JWKSURL:        os.Getenv("PAYMENTS_JWKS_URL"),
+		JWKSRefresh:    nonNegativeSecondsValue("JWKS_REFRESH_SECONDS", 5*time.Minute),
+		JWKSGrace:      secondsValue("JWKS_GRACE_SECONDS", 24*time.Hour),
+		JWTIssuer:      valueOrDefault("JWT_ISSUER", "payhole-payments"),
+		JWTAudience:    os.Getenv("JWT_AUDIENCE"),
+		JWTLeeway:      secondsValue("JWT_LEEWAY_SECONDS", 60*time.Second),
 		AnalyticsURL:   os.Getenv("ANALYTICS_URL"),
 		UpstreamTimeout: timeout,
+		DNSCacheSize:        intValue("DNS_CACHE_SIZE", 10000),
+		DNSCacheMinTTL:      secondsValue("DNS_CACHE_MIN_TTL_SECONDS", 0),
+		DNSCacheMaxTTL:      secondsValue("DNS_CACHE_MAX_TTL_SECONDS", 24*time.Hour),
+		DNSCacheNegativeTTL: secondsValue("DNS_CACHE_NEGATIVE_TTL_SECONDS", time.Hour),
+		DNSPrefetch:         boolValue("DNS_PREFETCH", true),
+		DNSServeStale:       boolValue("DNS_SERVE_STALE", true),
+		DNSBlockModeAds:     os.Getenv("DNS_BLOCK_MODE_ADS"),
+		DNSBlockModePremium: os.Getenv("DNS_BLOCK_MODE_PREMIUM"),
+		DNSSinkholeIPs:      splitList(os.Getenv("DNS_SINKHOLE_IPS")),
+		DNSBlockedTTL:       secondsValue("DNS_BLOCKED_TTL_SECONDS", 10*time.Second),
+		DoTAddr:        os.Getenv("DOT_ADDR"),
+		DoTCertPath:    os.Getenv("DOT_CERT_PATH"),
+		DoTKeyPath:     os.Getenv("DOT_KEY_PATH"),
+		DoTHostname:    os.Getenv("DOT_HOSTNAME"),
+		DoTIdleTimeout: secondsValue("DOT_IDLE_TIMEOUT_SECONDS", 120*time.Second),
 		AutoConfigProxyURL: os.Getenv("AUTOCONFIG_PROXY_URL"),
 		SetupDocsURL:       os.Getenv("SETUP_DOCS_URL"),
+		TLSIntercept:           boolValue("TLS_INTERCEPT", false),
+		InterceptCACertPath:    valueOrDefault("TLS_INTERCEPT_CA_CERT", "data/payhole-ca.pem"),
+		InterceptCAKeyPath:     valueOrDefault("TLS_INTERCEPT_CA_KEY", "data/payhole-ca-key.pem"),
+		InterceptBypassPath:    valueOrDefault("TLS_INTERCEPT_BYPASS_PATH", "data/intercept-bypass.txt"),
+		InterceptBypassDomains: splitList(os.Getenv("TLS_INTERCEPT_BYPASS")),
+		X402Network:            valueOrDefault("X402_NETWORK", "solana"),
+		PaymentAsset:           valueOrDefault("USDC_MINT_ADDRESS", "EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v"),
+		PaymentPayTo:           os.Getenv("TREASURY_WALLET"),
+		PaymentAmountUSDC:      5,
+		PaymentMaxTimeout:      secondsValue("X402_MAX_TIMEOUT_SECONDS", 300*time.Second),
+		X402FacilitatorURL:     os.Getenv("X402_FACILITATOR_URL"),
+		PrivacyProfile:         valueOrDefault("PRIVACY_PROFILE", "balanced"),
+		PrivacyForwardedFor:    os.Getenv("PRIVACY_FORWARDED_FOR"),
+		URLRewrite:             boolValue("URL_REWRITE", true),
+		CookiePolicy:           valueOrDefault("COOKIE_POLICY", "trackers"),
+		Surrogates:             boolValue("SURROGATES", true),
+		CosmeticFiltering:      boolValue("COSMETIC_FILTERING", true),
+		HTTPReadHeaderTimeout:   secondsValue("HTTP_READ_HEADER_TIMEOUT_SECONDS", 15*time.Second),
+		HTTPIdleTimeout:         secondsValue("HTTP_IDLE_TIMEOUT_SECONDS", 120*time.Second),
+		UpstreamConnectTimeout:  secondsValue("UPSTREAM_CONNECT_TIMEOUT_SECONDS", 10*time.Second),
+		UpstreamResponseTimeout: nonNegativeSecondsValue("UPSTREAM_RESPONSE_TIMEOUT_SECONDS", 60*time.Second),
+		WebSocketIdleTimeout:    nonNegativeSecondsValue("WEBSOCKET_IDLE_TIMEOUT_SECONDS", 5*time.Minute),
+		WebSocketMaxLifetime:    nonNegativeSecondsValue("WEBSOCKET_MAX_LIFETIME_SECONDS", 24*time.Hour),
+		EgressAllowCIDRs:        splitList(os.Getenv("EGRESS_ALLOW_CIDRS")),
+		EgressDenyCIDRs:         splitList(os.Getenv("EGRESS_DENY_CIDRS")),
+		UnlockWebhookSecret:     os.Getenv("UNLOCK_WEBHOOK_SECRET"),
+		UnlockWebhookTolerance:  secondsValue("UNLOCK_WEBHOOK_TOLERANCE_SECONDS", 300*time.Second),
+		UnlockWebhookSources:    splitList(os.Getenv("UNLOCK_WEBHOOK_SOURCES")),
+		UnlockStorePath:         valueOrDefault("UNLOCK_STORE_PATH", "data/unlocks.log"),
+		UnlockCacheCapacity:     intValue("UNLOCK_CACHE_CAPACITY", 100000),
+		UnlockIPv6Prefix:        intValue("UNLOCK_IPV6_PREFIX", 64),
+		UnlockSession:           nonNegativeSecondsValue("UNLOCK_SESSION_SECONDS", 30*time.Minute),
+		UnlockMaxLifetime:       secondsValue("UNLOCK_MAX_LIFETIME_SECONDS", 30*24*time.Hour),
+		TrustedProxies:          splitList(os.Getenv("TRUSTED_PROXIES")),
+		ProxyProtocol:           boolValue("PROXY_PROTOCOL", false),
+	}
+
+	if raw := os.Getenv("MIN_PAYMENT_USDC"); raw != "" {
+		amount, err := strconv.ParseFloat(raw, 64)
+		if err != nil || amount <= 0 {
+			return Config{}, fmt.Errorf("MIN_PAYMENT_USDC must be a positive number, got %q", raw)
+		}
+		cfg.PaymentAmountUSDC = amount
+	}
+
+	if cfg.AllowlistPath == "" {
+		cfg.AllowlistPath = filepath.Join(filepath.Dir(cfg.BlocklistPath), "allowlist.txt")
 	}
 
 	if len(cfg.BlocklistURLs) == 0 {
@@ -62,8 +207,16 @@ func FromEnv() (Config, error) {
 		}
 	}
 
-	if cfg.JWTSecret == "" {
-		return Config{}, errors.New("PAYMENTS_JWT_SECRET is required")
+	if cfg.JWTSecret == "" && cfg.JWKSURL == "" {
+		return Config{}, errors.New("PAYMENTS_JWT_SECRET or PAYMENTS_JWKS_URL is required")
+	}
+
+	if cfg.ProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		return Config{}, errors.New("PROXY_PROTOCOL requires TRUSTED_PROXIES")
+	}
+
+	if cfg.DoTAddr != "" && (cfg.DoTCertPath == "" || cfg.DoTKeyPath == "") {
+		return Config{}, errors.New("DOT_ADDR requires DOT_CERT_PATH and DOT_KEY_PATH")
 	}
 
 	if cfg.HTTPProxyAddr == cfg.DNSProxyAddr {
@@ -80,6 +233,55 @@ func valueOrDefault(key, fallback string) string {
 	return fallback
 }
 
+func secondsValue(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(raw + "s")
+	if err != nil || parsed <= 0 {
+		return fallback
+	}
+	return parsed
+}
+
+// nonNegativeSecondsValue is secondsValue for limits where 0 means disabled.
+func nonNegativeSecondsValue(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(raw + "s")
+	if err != nil || parsed < 0 {
+		return fallback
+	}
+	return parsed
+}
+
+func intValue(key string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(raw)
+	if err != nil || parsed < 0 {
+		return fallback
+	}
+	return parsed
+}
+
+func boolValue(key string, fallback bool) bool {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(raw)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
 func splitList(raw string) []string {
 	if strings.TrimSpace(raw) == "" {
 		return nil
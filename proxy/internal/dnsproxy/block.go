@@ -0,0 +1,182 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/payhole/proxy/internal/policy"
+)
+
+// BlockMode selects how a blocked name is answered.
+type BlockMode string
+
+const (
+	// BlockNXDomain claims the name does not exist, with an SOA so the denial is cached.
+	BlockNXDomain BlockMode = "nxdomain"
+	// BlockNoData claims the name exists without records of the queried type.
+	BlockNoData BlockMode = "nodata"
+	// BlockNullIP answers A with 0.0.0.0 and AAAA with ::, so connections fail locally.
+	BlockNullIP BlockMode = "null_ip"
+	// BlockSinkholeIP answers A and AAAA with the configured sinkhole addresses.
+	BlockSinkholeIP BlockMode = "sinkhole_ip"
+	// BlockRefused refuses the query; many stub resolvers then retry another server.
+	BlockRefused BlockMode = "refused"
+)
+
+// ParseBlockMode validates a block mode name from configuration.
+func ParseBlockMode(name string) (BlockMode, error) {
+	switch m := BlockMode(strings.ToLower(strings.TrimSpace(name))); m {
+	case BlockNXDomain, BlockNoData, BlockNullIP, BlockSinkholeIP, BlockRefused:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown DNS block mode %q", name)
+}
+
+// BlockOptions configures the answers given to blocked names, separately for ads and for
+// premium domains awaiting payment.
+type BlockOptions struct {
+	AdBlocked      BlockMode
+	PremiumPayment BlockMode
+	// SinkholeIPs are returned by BlockSinkholeIP, at most one IPv4 and one IPv6 address.
+	SinkholeIPs []netip.Addr
+	// TTL is set on synthesized records and bounds how long clients cache the block,
+	// which also delays premium unlocks on devices that cached it.
+	TTL time.Duration
+}
+
+// DefaultBlockOptions returns the block answers used when none are configured. Ads get
+// 0.0.0.0/:: rather than the REFUSED answered before block modes existed, because REFUSED
+// makes many stub resolvers retry another server. Premium names stay REFUSED, since a
+// null address would hide the paywall; point them at a sinkhole to serve it.
+func DefaultBlockOptions() BlockOptions {
+	return BlockOptions{
+		AdBlocked:      BlockNullIP,
+		PremiumPayment: BlockRefused,
+		TTL:            10 * time.Second,
+	}
+}
+
+// Validate reports options that cannot produce an answer.
+func (o BlockOptions) Validate() error {
+	for _, mode := range []BlockMode{o.AdBlocked, o.PremiumPayment} {
+		if _, err := ParseBlockMode(string(mode)); err != nil {
+			return err
+		}
+		if mode == BlockSinkholeIP && len(o.SinkholeIPs) == 0 {
+			return fmt.Errorf("DNS block mode %s needs a sinkhole IP", mode)
+		}
+	}
+	var v4, v6 int
+	for _, ip := range o.SinkholeIPs {
+		if ip.Unmap().Is4() {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	if v4 > 1 || v6 > 1 {
+		return fmt.Errorf("at most one IPv4 and one IPv6 sinkhole IP may be set")
+	}
+	return nil
+}
+
+func (o BlockOptions) mode(reason policy.DecisionReason) BlockMode {
+	if reason == policy.ReasonPremiumPayment {
+		return o.PremiumPayment
+	}
+	return o.AdBlocked
+}
+
+// blocked synthesizes the answer to query for a name denied by decision.
+func (o BlockOptions) blocked(query *dns.Msg, decision policy.Decision) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Authoritative = true
+	response.RecursionAvailable = true
+
+	mode := o.mode(decision.Reason)
+	if mode == BlockRefused {
+		response.RecursionAvailable = false
+		response.Rcode = dns.RcodeRefused
+		return response
+	}
+
+	q := query.Question[0]
+	if q.Qclass == dns.ClassINET {
+		var ip net.IP
+		switch mode {
+		case BlockNullIP:
+			ip = nullIP(q.Qtype)
+		case BlockSinkholeIP:
+			ip = o.sinkholeIP(q.Qtype)
+		}
+		if ip != nil {
+			response.Answer = []dns.RR{o.address(q, ip)}
+			return response
+		}
+	}
+
+	if mode == BlockNXDomain {
+		response.Rcode = dns.RcodeNameError
+	}
+	response.Ns = []dns.RR{o.soa(q.Name, decision.Match)}
+	return response
+}
+
+func nullIP(qtype uint16) net.IP {
+	switch qtype {
+	case dns.TypeA:
+		return net.IPv4zero.To4()
+	case dns.TypeAAAA:
+		return net.IPv6zero
+	}
+	return nil
+}
+
+func (o BlockOptions) sinkholeIP(qtype uint16) net.IP {
+	for _, ip := range o.SinkholeIPs {
+		ip = ip.Unmap()
+		if (qtype == dns.TypeA && ip.Is4()) || (qtype == dns.TypeAAAA && ip.Is6()) {
+			return net.IP(ip.AsSlice())
+		}
+	}
+	return nil
+}
+
+func (o BlockOptions) ttl() uint32 {
+	return uint32(o.TTL / time.Second)
+}
+
+func (o BlockOptions) address(q dns.Question, ip net.IP) dns.RR {
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: o.ttl()}
+	if q.Qtype == dns.TypeA {
+		return &dns.A{Hdr: hdr, A: ip}
+	}
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// soa synthesizes the authority record of a negative answer. Its owner is the blocklist
+// entry that matched, so resolvers apply the denial to the whole blocked zone (RFC 8020),
+// and its TTL and minimum bound negative caching (RFC 2308).
+func (o BlockOptions) soa(name, match string) dns.RR {
+	owner := dns.Fqdn(name)
+	if zone := dns.Fqdn(match); match != "" && dns.IsSubDomain(zone, owner) {
+		owner = zone
+	}
+	ttl := o.ttl()
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: owner, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "sinkhole.payhole.invalid.",
+		Mbox:    "hostmaster.payhole.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
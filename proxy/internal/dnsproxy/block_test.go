@@ -0,0 +1,120 @@
+package dnsproxy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/payhole/proxy/internal/policy"
+)
+
+func blockedAnswer(t *testing.T, opts BlockOptions, reason policy.DecisionReason, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	resp := opts.blocked(query, policy.Decision{Reason: reason, Match: "ads.example.com"})
+	if resp.Id != query.Id || !resp.Response {
+		t.Fatalf("response does not reply to the query: %v", resp)
+	}
+	return resp
+}
+
+func TestBlockModes(t *testing.T) {
+	opts := BlockOptions{
+		SinkholeIPs: []netip.Addr{netip.MustParseAddr("192.0.2.53"), netip.MustParseAddr("2001:db8::53")},
+		TTL:         42 * time.Second,
+	}
+
+	tests := []struct {
+		mode   BlockMode
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{BlockNullIP, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{BlockNullIP, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{BlockNullIP, dns.TypeTXT, dns.RcodeSuccess, ""},
+		{BlockSinkholeIP, dns.TypeA, dns.RcodeSuccess, "192.0.2.53"},
+		{BlockSinkholeIP, dns.TypeAAAA, dns.RcodeSuccess, "2001:db8::53"},
+		{BlockNXDomain, dns.TypeA, dns.RcodeNameError, ""},
+		{BlockNoData, dns.TypeA, dns.RcodeSuccess, ""},
+		{BlockRefused, dns.TypeA, dns.RcodeRefused, ""},
+	}
+	for _, tt := range tests {
+		opts.AdBlocked = tt.mode
+		resp := blockedAnswer(t, opts, policy.ReasonAdBlocked, "tracker.ads.example.com.", tt.qtype)
+		name := string(tt.mode) + "/" + dns.TypeToString[tt.qtype]
+
+		if resp.Rcode != tt.rcode {
+			t.Fatalf("%s: rcode %s, want %s", name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if tt.answer != "" {
+			if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 42 {
+				t.Fatalf("%s: unexpected answer %v", name, resp.Answer)
+			}
+			var got string
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.AAAA:
+				got = rr.AAAA.String()
+			}
+			if got != tt.answer {
+				t.Fatalf("%s: answered %s, want %s", name, got, tt.answer)
+			}
+			continue
+		}
+		if len(resp.Answer) != 0 {
+			t.Fatalf("%s: expected no answer, got %v", name, resp.Answer)
+		}
+		if tt.mode == BlockRefused {
+			if len(resp.Ns) != 0 {
+				t.Fatalf("%s: refusal must not carry an SOA", name)
+			}
+			continue
+		}
+		soa, ok := resp.Ns[0].(*dns.SOA)
+		if len(resp.Ns) != 1 || !ok {
+			t.Fatalf("%s: expected a synthesized SOA, got %v", name, resp.Ns)
+		}
+		if soa.Hdr.Name != "ads.example.com." || soa.Hdr.Ttl != 42 || soa.Minttl != 42 {
+			t.Fatalf("%s: unexpected SOA %v", name, soa)
+		}
+	}
+}
+
+func TestBlockModePerReason(t *testing.T) {
+	opts := DefaultBlockOptions()
+	opts.AdBlocked = BlockNXDomain
+	opts.PremiumPayment = BlockRefused
+
+	if resp := blockedAnswer(t, opts, policy.ReasonAdBlocked, "ads.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("ads: rcode %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := blockedAnswer(t, opts, policy.ReasonPremiumPayment, "premium.example.com.", dns.TypeA); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("premium: rcode %s, want REFUSED", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestBlockOptionsValidate(t *testing.T) {
+	opts := DefaultBlockOptions()
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("defaults should validate: %v", err)
+	}
+	opts.PremiumPayment = BlockSinkholeIP
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("expected sinkhole mode without an IP to be rejected")
+	}
+	opts.SinkholeIPs = []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}
+	if err := opts.Validate(); err == nil {
+		t.Fatalf("expected two IPv4 sinkholes to be rejected")
+	}
+	if _, err := ParseBlockMode("blackhole"); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+	if err := (BlockOptions{}).Validate(); err == nil {
+		t.Fatalf("expected options without modes to be rejected")
+	}
+}
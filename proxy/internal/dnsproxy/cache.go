@@ -0,0 +1,289 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// staleAnswerTTL is the TTL on answers served past expiry, as RFC 8767 recommends.
+	staleAnswerTTL = 30
+	// prefetchWindow is the fraction of an entry's TTL left when a popular entry is refreshed.
+	prefetchWindow = 10
+)
+
+// CacheOptions bounds the DNS cache. TTLs from upstream are clamped to [MinTTL, MaxTTL];
+// NXDOMAIN and NODATA answers are kept for the SOA minimum, capped at MaxNegativeTTL.
+type CacheOptions struct {
+	Capacity       int
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	MaxNegativeTTL time.Duration
+	// PrefetchHits is how often an entry must be hit before it is refreshed ahead of
+	// expiry; zero disables prefetching.
+	PrefetchHits int
+	// StaleTTL is how long expired answers may still be served while upstream fails;
+	// zero disables serve-stale.
+	StaleTTL time.Duration
+}
+
+// DefaultCacheOptions returns the limits used when none are configured.
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{
+		Capacity:       10000,
+		MaxTTL:         24 * time.Hour,
+		MaxNegativeTTL: time.Hour,
+		PrefetchHits:   3,
+		StaleTTL:       24 * time.Hour,
+	}
+}
+
+// CacheStats reports cache effectiveness for /health.
+type CacheStats struct {
+	Size       int     `json:"size"`
+	Hits       uint64  `json:"hits"`
+	Misses     uint64  `json:"misses"`
+	Stale      uint64  `json:"stale"`
+	Prefetches uint64  `json:"prefetches"`
+	Evictions  uint64  `json:"evictions"`
+	HitRatio   float64 `json:"hitRatio"`
+}
+
+// Cache is a Resolver that answers repeated queries from memory and forwards the rest to
+// the wrapped resolver. Entries are keyed on name, type, class and the DNSSEC OK bit.
+type Cache struct {
+	upstream Resolver
+	opts     CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	key        string
+	msg        *dns.Msg
+	stored     time.Time
+	expires    time.Time
+	staleUntil time.Time
+	hits       int
+	refreshing bool
+}
+
+// NewCache wraps upstream with a cache bounded by opts.
+func NewCache(upstream Resolver, opts CacheOptions) *Cache {
+	return &Cache{
+		upstream: upstream,
+		opts:     opts,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Resolve answers msg from the cache when possible.
+func (c *Cache) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	key, ok := cacheKey(msg)
+	if !ok {
+		return c.upstream.Resolve(msg)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	var stale *dns.Msg
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			entry.hits++
+			c.stats.Hits++
+			answer := entry.answer(msg, now)
+			if c.shouldPrefetch(entry, now) {
+				entry.refreshing = true
+				c.stats.Prefetches++
+				go c.refresh(key, msg.Copy())
+			}
+			c.mu.Unlock()
+			return answer, nil
+		}
+		if now.Before(entry.staleUntil) {
+			stale = entry.staleAnswer(msg)
+		}
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	resp, err := c.upstream.Resolve(msg)
+	if err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure {
+		if stale != nil {
+			c.mu.Lock()
+			c.stats.Stale++
+			c.mu.Unlock()
+			return stale, nil
+		}
+		return resp, err
+	}
+	c.store(key, resp, now)
+	return resp, nil
+}
+
+func (c *Cache) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if c.opts.PrefetchHits <= 0 || entry.refreshing || entry.hits < c.opts.PrefetchHits {
+		return false
+	}
+	ttl := entry.expires.Sub(entry.stored)
+	return entry.expires.Sub(now) < ttl/prefetchWindow
+}
+
+func (c *Cache) refresh(key string, query *dns.Msg) {
+	resp, err := c.upstream.Resolve(query)
+	if err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure {
+		c.store(key, resp, time.Now())
+		return
+	}
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+	c.mu.Unlock()
+}
+
+func (c *Cache) store(key string, resp *dns.Msg, now time.Time) {
+	ttl, ok := c.cacheTTL(resp)
+	if !ok {
+		return
+	}
+	entry := &cacheEntry{
+		key:        key,
+		msg:        resp.Copy(),
+		stored:     now,
+		expires:    now.Add(ttl),
+		staleUntil: now.Add(ttl + c.opts.StaleTTL),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.opts.Capacity > 0 && c.lru.Len() > c.opts.Capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// cacheTTL returns how long resp may be cached. Positive answers use their lowest record
+// TTL; NXDOMAIN and NODATA use the SOA minimum (RFC 2308) and are not cached without one.
+func (c *Cache) cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	var ttl time.Duration
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl = minTTL(resp.Answer)
+	case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+		soa := findSOA(resp.Ns)
+		if soa == nil {
+			return 0, false
+		}
+		ttl = time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		if c.opts.MaxNegativeTTL > 0 && ttl > c.opts.MaxNegativeTTL {
+			ttl = c.opts.MaxNegativeTTL
+		}
+	default:
+		return 0, false
+	}
+
+	if ttl < c.opts.MinTTL {
+		ttl = c.opts.MinTTL
+	}
+	if c.opts.MaxTTL > 0 && ttl > c.opts.MaxTTL {
+		ttl = c.opts.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// Flush drops every entry, e.g. after the blocklists change.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// answer copies the cached response for query with TTLs counted down to the time left.
+func (e *cacheEntry) answer(query *dns.Msg, now time.Time) *dns.Msg {
+	remaining := uint32(e.expires.Sub(now) / time.Second)
+	return e.reply(query, func(ttl uint32) uint32 { return min(ttl, remaining) })
+}
+
+func (e *cacheEntry) staleAnswer(query *dns.Msg) *dns.Msg {
+	return e.reply(query, func(uint32) uint32 { return staleAnswerTTL })
+}
+
+func (e *cacheEntry) reply(query *dns.Msg, ttl func(uint32) uint32) *dns.Msg {
+	resp := e.msg.Copy()
+	resp.Id = query.Id
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl(rr.Header().Ttl)
+		}
+	}
+	return resp
+}
+
+func cacheKey(msg *dns.Msg) (string, bool) {
+	if len(msg.Question) != 1 {
+		return "", false
+	}
+	q := msg.Question[0]
+	do := "0"
+	if opt := msg.IsEdns0(); opt != nil && opt.Do() {
+		do = "1"
+	}
+	return strings.ToLower(q.Name) + "|" + strconv.Itoa(int(q.Qtype)) + "|" + strconv.Itoa(int(q.Qclass)) + "|" + do, true
+}
+
+func minTTL(records []dns.RR) time.Duration {
+	lowest := ^uint32(0)
+	for _, rr := range records {
+		lowest = min(lowest, rr.Header().Ttl)
+	}
+	return time.Duration(lowest) * time.Second
+}
+
+func findSOA(records []dns.RR) *dns.SOA {
+	for _, rr := range records {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package dnsproxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// scriptedResolver answers with reply until fail is set, counting upstream queries.
+type scriptedResolver struct {
+	calls atomic.Int32
+	fail  atomic.Bool
+	reply func(*dns.Msg) *dns.Msg
+}
+
+func (s *scriptedResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	s.calls.Add(1)
+	if s.fail.Load() {
+		return nil, errors.New("upstream unreachable")
+	}
+	return s.reply(msg), nil
+}
+
+func answerA(ttl uint32) func(*dns.Msg) *dns.Msg {
+	return func(q *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		return resp
+	}
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	return msg
+}
+
+func TestCacheHonorsAndClampsTTLs(t *testing.T) {
+	upstream := &scriptedResolver{reply: answerA(5)}
+	cache := NewCache(upstream, CacheOptions{Capacity: 10, MinTTL: 60 * time.Second, MaxTTL: time.Hour})
+
+	first, _ := cache.Resolve(query("example.com.", dns.TypeA))
+	second, err := cache.Resolve(query("EXAMPLE.com.", dns.TypeA))
+	if err != nil || upstream.calls.Load() != 1 {
+		t.Fatalf("expected second query to be served from cache, %d upstream calls (%v)", upstream.calls.Load(), err)
+	}
+	if first.Answer[0].Header().Ttl != 5 || second.Answer[0].Header().Ttl > 5 {
+		t.Fatalf("unexpected TTLs %d and %d", first.Answer[0].Header().Ttl, second.Answer[0].Header().Ttl)
+	}
+
+	withDO := query("example.com.", dns.TypeA)
+	withDO.SetEdns0(1232, true)
+	cache.Resolve(withDO)
+	cache.Resolve(query("example.com.", dns.TypeAAAA))
+	if upstream.calls.Load() != 3 {
+		t.Fatalf("expected DO bit and type to be part of the key, got %d upstream calls", upstream.calls.Load())
+	}
+
+	upstream.reply = answerA(7 * 24 * 3600)
+	cache.Flush()
+	cache.Resolve(query("long.example.", dns.TypeA))
+	cache.mu.Lock()
+	entry := cache.entries["long.example.|1|1|0"].Value.(*cacheEntry)
+	lifetime := entry.expires.Sub(entry.stored)
+	cache.mu.Unlock()
+	if lifetime != time.Hour {
+		t.Fatalf("expected TTL clamped to MaxTTL, got %s", lifetime)
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 1 || stats.Hits != 1 || stats.Misses != 4 || stats.HitRatio != 0.2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	withSOA := func(q *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeNameError)
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. host.example.com. 1 7200 900 1209600 300")
+		resp.Ns = append(resp.Ns, soa)
+		return resp
+	}
+	upstream := &scriptedResolver{reply: withSOA}
+	cache := NewCache(upstream, DefaultCacheOptions())
+
+	cache.Resolve(query("missing.example.com.", dns.TypeA))
+	resp, _ := cache.Resolve(query("missing.example.com.", dns.TypeA))
+	if upstream.calls.Load() != 1 || resp.Rcode != dns.RcodeNameError || resp.Ns[0].Header().Ttl > 300 {
+		t.Fatalf("expected NXDOMAIN cached for the SOA minimum, got %d calls and %v", upstream.calls.Load(), resp)
+	}
+
+	upstream.reply = func(q *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		return resp
+	}
+	cache.Resolve(query("nosoa.example.com.", dns.TypeA))
+	cache.Resolve(query("nosoa.example.com.", dns.TypeA))
+	if upstream.calls.Load() != 3 {
+		t.Fatalf("expected NODATA without SOA to bypass the cache, got %d calls", upstream.calls.Load())
+	}
+}
+
+func TestCacheServesStaleWhenUpstreamFails(t *testing.T) {
+	upstream := &scriptedResolver{reply: answerA(1)}
+	cache := NewCache(upstream, CacheOptions{Capacity: 10, StaleTTL: time.Minute})
+
+	cache.Resolve(query("example.com.", dns.TypeA))
+	time.Sleep(1100 * time.Millisecond)
+	upstream.fail.Store(true)
+
+	resp, err := cache.Resolve(query("example.com.", dns.TypeA))
+	if err != nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("expected stale answer with a %ds TTL, got %v (%v)", staleAnswerTTL, resp, err)
+	}
+	if cache.Stats().Stale != 1 {
+		t.Fatalf("expected stale answer to be counted, got %+v", cache.Stats())
+	}
+
+	noStale := NewCache(upstream, CacheOptions{Capacity: 10})
+	if _, err := noStale.Resolve(query("example.com.", dns.TypeA)); err == nil {
+		t.Fatal("expected failure without a cached answer")
+	}
+}
+
+func TestCachePrefetchesPopularEntries(t *testing.T) {
+	upstream := &scriptedResolver{reply: answerA(10)}
+	cache := NewCache(upstream, CacheOptions{Capacity: 10, PrefetchHits: 2})
+
+	cache.Resolve(query("popular.example.", dns.TypeA))
+	cache.mu.Lock()
+	entry := cache.entries["popular.example.|1|1|0"].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-9500 * time.Millisecond)
+	entry.expires = entry.expires.Add(-9500 * time.Millisecond)
+	cache.mu.Unlock()
+
+	cache.Resolve(query("popular.example.", dns.TypeA))
+	cache.Resolve(query("popular.example.", dns.TypeA))
+	deadline := time.Now().Add(time.Second)
+	for upstream.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if upstream.calls.Load() != 2 || cache.Stats().Prefetches != 1 {
+		t.Fatalf("expected one prefetch before expiry, got %d calls and %+v", upstream.calls.Load(), cache.Stats())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	upstream := &scriptedResolver{reply: answerA(300)}
+	cache := NewCache(upstream, CacheOptions{Capacity: 2})
+
+	cache.Resolve(query("a.example.", dns.TypeA))
+	cache.Resolve(query("b.example.", dns.TypeA))
+	cache.Resolve(query("a.example.", dns.TypeA))
+	cache.Resolve(query("c.example.", dns.TypeA))
+	cache.Resolve(query("a.example.", dns.TypeA))
+	if upstream.calls.Load() != 3 || cache.Stats().Evictions != 1 {
+		t.Fatalf("expected b to be evicted and a kept, got %d calls and %+v", upstream.calls.Load(), cache.Stats())
+	}
+}
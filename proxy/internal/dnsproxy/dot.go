@@ -0,0 +1,168 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// certCheckInterval bounds how often the certificate files are stat'ed for changes.
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate from disk and re-reads the pair whenever either
+// file's modification time changes, so renewed certificates are picked up without a
+// restart. A pair that fails to load keeps the previous certificate in service.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads the PEM certificate chain and key at the given paths.
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{certPath: certPath, keyPath: keyPath, interval: certCheckInterval}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	c.checked = time.Now()
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= c.interval {
+		c.checked = now
+		if err := c.reload(); err != nil {
+			log.Printf("warning: keeping previous DoT certificate: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// DNSNames returns the names the current certificate is valid for, wildcards excluded.
+func (c *CertReloader) DNSNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for _, name := range c.cert.Leaf.DNSNames {
+		if !strings.HasPrefix(name, "*.") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (c *CertReloader) reload() error {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("load DoT certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("parse DoT certificate: %w", err)
+	}
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// DoTOptions configures the DNS-over-TLS listener.
+type DoTOptions struct {
+	// IdleTimeout closes connections that sent no query for this long. It is also the
+	// timeout advertised to clients through the EDNS tcp-keepalive option (RFC 7828).
+	IdleTimeout time.Duration
+}
+
+// NewDoTServer returns an RFC 7858 DNS-over-TLS server that terminates TLS on listener
+// with certs and answers through the same policy path as ServeDNS. Connections are kept
+// open for as many queries as the client sends, so stub resolvers such as Android
+// Private DNS can reuse them.
+func (s *Server) NewDoTServer(listener net.Listener, certs *CertReloader, opts DoTOptions) *dns.Server {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"dot"},
+	}
+	idle := opts.IdleTimeout
+	return &dns.Server{
+		Listener: tls.NewListener(listener, tlsConfig),
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			s.serveDoT(w, r, idle)
+		}),
+		IdleTimeout:   func() time.Duration { return idle },
+		MaxTCPQueries: -1,
+	}
+}
+
+func (s *Server) serveDoT(w dns.ResponseWriter, r *dns.Msg, idle time.Duration) {
+	resp, err := s.process(r, w.RemoteAddr().String(), "")
+	if err != nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeServerFailure)
+	}
+	resp.Id = r.Id
+	withKeepalive(r, resp, idle)
+	_ = w.WriteMsg(resp)
+}
+
+// withKeepalive answers a client that sent the edns-tcp-keepalive option with the idle
+// timeout the server applies, in units of 100 milliseconds.
+func withKeepalive(query, resp *dns.Msg, idle time.Duration) {
+	opt := query.IsEdns0()
+	if opt == nil || !hasOption(opt, dns.EDNS0TCPKEEPALIVE) {
+		return
+	}
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+		respOpt = resp.IsEdns0()
+	}
+
+	options := respOpt.Option[:0]
+	for _, option := range respOpt.Option {
+		if option.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, option)
+		}
+	}
+	timeout := min(max(idle/(100*time.Millisecond), 1), math.MaxUint16)
+	respOpt.Option = append(options, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(timeout)})
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package dnsproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/payhole/proxy/internal/analytics"
+	"github.com/payhole/proxy/internal/auth"
+	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/policy"
+)
+
+func writeCertPair(t *testing.T, dir, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "*." + name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func startDoTServer(t *testing.T, certs *CertReloader, upstream *dns.Msg) string {
+	t.Helper()
+	blocked := blocklist.New([]string{"ads.example.com"})
+	authorizer, _ := auth.NewJWTAuthorizer("abcdefghijklmnopqrstuvwxyz1234567890abcdef")
+	p := policy.New(blocked, blocklist.New(nil), authorizer, auth.NewIPCache(), analytics.NewClient(""))
+	server := NewServer(&stubResolver{msg: upstream}, p)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := server.NewDoTServer(listener, certs, DoTOptions{IdleTimeout: 30 * time.Second})
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return listener.Addr().String()
+}
+
+func dotClient(roots *x509.CertPool) *dns.Client {
+	return &dns.Client{Net: "tcp-tls", Timeout: 2 * time.Second, TLSConfig: &tls.Config{RootCAs: roots, ServerName: "dns.payhole.test"}}
+}
+
+func TestDoTServerAppliesPolicyAndKeepalive(t *testing.T) {
+	dir := t.TempDir()
+	leaf := writeCertPair(t, dir, "dns.payhole.test")
+	certs, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	if names := certs.DNSNames(); len(names) != 1 || names[0] != "dns.payhole.test" {
+		t.Fatalf("DNSNames = %v", names)
+	}
+
+	upstream := new(dns.Msg)
+	upstream.SetQuestion("example.com.", dns.TypeA)
+	upstream.Response = true
+	upstream.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	}}
+	addr := startDoTServer(t, certs, upstream)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := dotClient(roots)
+	conn, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.SetEdns0(1232, false)
+	query.IsEdns0().Option = append(query.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	resp, _, err := client.ExchangeWithConn(query, conn)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Id != query.Id {
+		t.Fatalf("unexpected answer: %v", resp)
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		t.Fatalf("expected an OPT record in the response")
+	}
+	var keepalive *dns.EDNS0_TCP_KEEPALIVE
+	for _, option := range opt.Option {
+		if k, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			keepalive = k
+		}
+	}
+	if keepalive == nil || keepalive.Timeout != 300 {
+		t.Fatalf("expected keepalive timeout 300, got %+v", keepalive)
+	}
+
+	blockedQuery := new(dns.Msg)
+	blockedQuery.SetQuestion("ads.example.com.", dns.TypeA)
+	resp, _, err = client.ExchangeWithConn(blockedQuery, conn)
+	if err != nil {
+		t.Fatalf("exchange on reused connection: %v", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("expected blocked name to get the null address, got %v", resp)
+	}
+	if resp.IsEdns0() != nil {
+		t.Fatalf("keepalive must only be sent to clients that asked for it")
+	}
+}
+
+func TestCertReloaderPicksUpRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCertPair(t, dir, "dns.payhole.test")
+	certs, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	certs.interval = 0
+
+	served, _ := certs.GetCertificate(nil)
+	if !served.Leaf.Equal(first) {
+		t.Fatalf("expected the initial certificate")
+	}
+
+	second := writeCertPair(t, dir, "dns.payhole.test")
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, name), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	served, _ = certs.GetCertificate(nil)
+	if !served.Leaf.Equal(second) {
+		t.Fatalf("expected the renewed certificate to be served")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "key.pem"), evenLater, evenLater)
+	served, _ = certs.GetCertificate(nil)
+	if !served.Leaf.Equal(second) {
+		t.Fatalf("a broken key must keep the previous certificate in service")
+	}
+}
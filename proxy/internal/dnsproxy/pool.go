@@ -0,0 +1,308 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy selects how a Pool spreads queries across its upstreams.
+type Strategy string
+
+const (
+	// StrategyFailover tries upstreams in configured order.
+	StrategyFailover Strategy = "failover"
+	// StrategyRoundRobin rotates the first upstream tried on every query.
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyFastest prefers the upstream with the lowest smoothed latency.
+	StrategyFastest Strategy = "fastest"
+	// StrategyRace sends each query to every healthy upstream and keeps the first answer.
+	StrategyRace Strategy = "race"
+)
+
+// latencyWeight is the EWMA weight given to the newest latency sample.
+const latencyWeight = 0.3
+
+// ParseStrategy validates a strategy name from configuration.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(strings.ToLower(strings.TrimSpace(name))); s {
+	case StrategyFailover, StrategyRoundRobin, StrategyFastest, StrategyRace:
+		return s, nil
+	case "":
+		return StrategyFailover, nil
+	}
+	return "", fmt.Errorf("unknown upstream strategy %q", name)
+}
+
+// Upstream names a resolver taking part in a Pool.
+type Upstream struct {
+	Name     string
+	Resolver Resolver
+}
+
+// PoolOptions tunes failure handling. After FailureThreshold consecutive failures an
+// upstream's circuit opens and it is skipped for Cooldown, then a single query or health
+// check is let through to probe it.
+type PoolOptions struct {
+	Strategy         Strategy
+	FailureThreshold int
+	Cooldown         time.Duration
+	// HealthCheckInterval is how often RunHealthChecks probes every upstream.
+	HealthCheckInterval time.Duration
+}
+
+// DefaultPoolOptions returns the failure handling used when none is configured.
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{
+		Strategy:            StrategyFailover,
+		FailureThreshold:    3,
+		Cooldown:            30 * time.Second,
+		HealthCheckInterval: 10 * time.Second,
+	}
+}
+
+// UpstreamStatus reports one upstream's health for /health.
+type UpstreamStatus struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	Failures  int     `json:"failures"`
+	LatencyMS float64 `json:"latencyMs"`
+}
+
+// Pool is a Resolver that composes several upstream resolvers, retrying a query on the
+// next upstream when one fails.
+type Pool struct {
+	members []*member
+	opts    PoolOptions
+	next    atomic.Uint64
+}
+
+type member struct {
+	Upstream
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	latency   time.Duration
+}
+
+// NewPool builds a Pool over upstreams.
+func NewPool(upstreams []Upstream, opts PoolOptions) (*Pool, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("at least one DNS upstream is required")
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 1
+	}
+	p := &Pool{opts: opts}
+	for _, upstream := range upstreams {
+		p.members = append(p.members, &member{Upstream: upstream})
+	}
+	return p, nil
+}
+
+// Resolve answers msg from the first upstream, in strategy order, that does not fail.
+func (p *Pool) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	now := time.Now()
+	candidates, lastResort := p.candidates(now)
+	if p.opts.Strategy == StrategyRace && len(candidates) > 1 {
+		return p.race(msg, candidates, now, lastResort)
+	}
+
+	resp, err := (*dns.Msg)(nil), errors.New("no DNS upstream available")
+	for _, m := range candidates {
+		if !m.begin(now, lastResort) {
+			continue
+		}
+		resp, err = p.exchange(m, msg)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return resp, err
+}
+
+// candidates orders the usable upstreams for one query. When every circuit is open all
+// upstreams are tried anyway as a last resort, since failing outright is never better.
+func (p *Pool) candidates(now time.Time) ([]*member, bool) {
+	var usable []*member
+	for _, m := range p.members {
+		if m.available(now) {
+			usable = append(usable, m)
+		}
+	}
+	lastResort := len(usable) == 0
+	if lastResort {
+		usable = append(usable, p.members...)
+	}
+
+	switch p.opts.Strategy {
+	case StrategyRoundRobin:
+		start := int(p.next.Add(1)-1) % len(usable)
+		usable = append(usable[start:len(usable):len(usable)], usable[:start]...)
+	case StrategyFastest:
+		sort.SliceStable(usable, func(i, j int) bool {
+			return usable[i].smoothedLatency() < usable[j].smoothedLatency()
+		})
+	}
+	return usable, lastResort
+}
+
+func (p *Pool) race(msg *dns.Msg, candidates []*member, now time.Time, lastResort bool) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(candidates))
+	started := 0
+	for _, m := range candidates {
+		if !m.begin(now, lastResort) {
+			continue
+		}
+		started++
+		go func(m *member) {
+			resp, err := p.exchange(m, msg.Copy())
+			results <- result{resp, err}
+		}(m)
+	}
+
+	last := result{err: errors.New("no DNS upstream available")}
+	for i := 0; i < started; i++ {
+		last = <-results
+		if last.err == nil {
+			return last.resp, nil
+		}
+	}
+	return last.resp, last.err
+}
+
+// exchange queries one upstream and feeds the outcome into its breaker and latency.
+// SERVFAIL and REFUSED count as failures so the query moves on to the next upstream.
+func (p *Pool) exchange(m *member, msg *dns.Msg) (*dns.Msg, error) {
+	started := time.Now()
+	resp, err := m.Resolver.Resolve(msg)
+	if err == nil && resp == nil {
+		err = errors.New("empty response")
+	}
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("upstream %s answered %s", m.Name, dns.RcodeToString[resp.Rcode])
+	}
+	m.record(err, time.Since(started), p.opts)
+	return resp, err
+}
+
+// RunHealthChecks probes every upstream with a root NS query on the configured interval
+// until ctx is cancelled, closing circuits of upstreams that recovered.
+func (p *Pool) RunHealthChecks(ctx context.Context) {
+	if p.opts.HealthCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.CheckHealth()
+		}
+	}
+}
+
+// CheckHealth probes each upstream once.
+func (p *Pool) CheckHealth() {
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			probe := new(dns.Msg)
+			probe.SetQuestion(".", dns.TypeNS)
+			wasHealthy := m.healthy()
+			if _, err := p.exchange(m, probe); err != nil && wasHealthy && !m.healthy() {
+				log.Printf("DNS upstream %s marked unhealthy: %v", m.Name, err)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// Status returns the health of each upstream in configured order.
+func (p *Pool) Status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(p.members))
+	for _, m := range p.members {
+		m.mu.Lock()
+		statuses = append(statuses, UpstreamStatus{
+			Name:      m.Name,
+			Healthy:   m.openUntil.IsZero(),
+			Failures:  m.failures,
+			LatencyMS: float64(m.latency) / float64(time.Millisecond),
+		})
+		m.mu.Unlock()
+	}
+	return statuses
+}
+
+// available reports whether m's circuit is closed or ready for a probe.
+func (m *member) available(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openUntil.IsZero() || (!now.Before(m.openUntil) && !m.probing)
+}
+
+// begin claims m for one query. Once the cooldown of an open circuit ends, exactly one
+// query is let through as a probe until its outcome is recorded; force skips the breaker.
+func (m *member) begin(now time.Time, force bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.openUntil.IsZero() || force {
+		return true
+	}
+	if now.Before(m.openUntil) || m.probing {
+		return false
+	}
+	m.probing = true
+	return true
+}
+
+// healthy reports whether m's circuit is closed.
+func (m *member) healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openUntil.IsZero()
+}
+
+func (m *member) record(err error, elapsed time.Duration, opts PoolOptions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.probing = false
+	if err != nil {
+		m.failures++
+		if m.failures >= opts.FailureThreshold {
+			m.openUntil = time.Now().Add(opts.Cooldown)
+		}
+		return
+	}
+	m.failures = 0
+	m.openUntil = time.Time{}
+	if m.latency == 0 {
+		m.latency = elapsed
+		return
+	}
+	m.latency = time.Duration(latencyWeight*float64(elapsed) + (1-latencyWeight)*float64(m.latency))
+}
+
+func (m *member) smoothedLatency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latency
+}
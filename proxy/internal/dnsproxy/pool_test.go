@@ -0,0 +1,137 @@
+package dnsproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// standIn is a local miekg/dns server answering A queries with ip after delay, or
+// SERVFAIL while failing is set.
+type standIn struct {
+	addr    string
+	queries atomic.Int32
+	failing atomic.Bool
+}
+
+func startStandIn(t *testing.T, ip string, delay time.Duration) *standIn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &standIn{addr: conn.LocalAddr().String()}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: conn, NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		s.queries.Add(1)
+		time.Sleep(delay)
+		resp := new(dns.Msg)
+		if s.failing.Load() {
+			resp.SetRcode(r, dns.RcodeServerFailure)
+		} else {
+			resp.SetReply(r)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return s
+}
+
+func newTestPool(t *testing.T, strategy Strategy, servers ...*standIn) *Pool {
+	t.Helper()
+	var upstreams []Upstream
+	for _, s := range servers {
+		upstreams = append(upstreams, Upstream{Name: s.addr, Resolver: NewUpstreamResolver(s.addr, time.Second)})
+	}
+	pool, err := NewPool(upstreams, PoolOptions{Strategy: strategy, FailureThreshold: 2, Cooldown: time.Hour})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	return pool
+}
+
+func resolveA(t *testing.T, pool *Pool) string {
+	t.Helper()
+	resp, err := pool.Resolve(query("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestPoolFailoverOpensCircuitAndRecovers(t *testing.T) {
+	primary := startStandIn(t, "192.0.2.1", 0)
+	secondary := startStandIn(t, "192.0.2.2", 0)
+	pool := newTestPool(t, StrategyFailover, primary, secondary)
+
+	if got := resolveA(t, pool); got != "192.0.2.1" {
+		t.Fatalf("expected primary answer, got %s", got)
+	}
+
+	primary.failing.Store(true)
+	for i := 0; i < 3; i++ {
+		if got := resolveA(t, pool); got != "192.0.2.2" {
+			t.Fatalf("expected failover to secondary, got %s", got)
+		}
+	}
+	if primary.queries.Load() != 3 || pool.Status()[0].Healthy {
+		t.Fatalf("expected the primary circuit to open after 2 failures, %d queries, status %+v", primary.queries.Load(), pool.Status())
+	}
+
+	primary.failing.Store(false)
+	pool.CheckHealth()
+	if !pool.Status()[0].Healthy || resolveA(t, pool) != "192.0.2.1" {
+		t.Fatalf("expected a health check to close the circuit, status %+v", pool.Status())
+	}
+}
+
+func TestPoolRoundRobinAndFastest(t *testing.T) {
+	slow := startStandIn(t, "192.0.2.1", 40*time.Millisecond)
+	fast := startStandIn(t, "192.0.2.2", 0)
+
+	rr := newTestPool(t, StrategyRoundRobin, slow, fast)
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[resolveA(t, rr)]++
+	}
+	if seen["192.0.2.1"] != 2 || seen["192.0.2.2"] != 2 {
+		t.Fatalf("expected queries to alternate, got %v", seen)
+	}
+
+	fastest := newTestPool(t, StrategyFastest, slow, fast)
+	fastest.CheckHealth()
+	for i := 0; i < 3; i++ {
+		if got := resolveA(t, fastest); got != "192.0.2.2" {
+			t.Fatalf("expected the lowest-latency upstream, got %s", got)
+		}
+	}
+}
+
+func TestPoolRaceReturnsFirstSuccess(t *testing.T) {
+	slow := startStandIn(t, "192.0.2.1", 200*time.Millisecond)
+	broken := startStandIn(t, "192.0.2.3", 0)
+	broken.failing.Store(true)
+	fast := startStandIn(t, "192.0.2.2", 10*time.Millisecond)
+	pool := newTestPool(t, StrategyRace, slow, broken, fast)
+
+	started := time.Now()
+	if got := resolveA(t, pool); got != "192.0.2.2" {
+		t.Fatalf("expected the fastest successful answer, got %s", got)
+	}
+	if elapsed := time.Since(started); elapsed > 150*time.Millisecond {
+		t.Fatalf("expected race not to wait for the slow upstream, took %s", elapsed)
+	}
+
+	if _, err := ParseStrategy("random"); err == nil {
+		t.Fatal("expected unknown strategy to be rejected")
+	}
+}
@@ -42,6 +42,7 @@ func (u *UpstreamResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
 type Server struct {
 	resolver Resolver
 	policy   *policy.Policy
+	block    BlockOptions
 }
 
 // NewServer builds a DNS server.
@@ -49,9 +50,15 @@ func NewServer(resolver Resolver, p *policy.Policy) *Server {
 	return &Server{
 		resolver: resolver,
 		policy:   p,
+		block:    DefaultBlockOptions(),
 	}
 }
 
+// SetBlockOptions replaces how blocked names are answered. Call it before serving.
+func (s *Server) SetBlockOptions(opts BlockOptions) {
+	s.block = opts
+}
+
 // ServeDNS handles UDP/TCP DNS messages.
 func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	resp, err := s.process(r, w.RemoteAddr().String(), "")
@@ -130,7 +137,7 @@ func (s *Server) process(msg *dns.Msg, remoteAddr, authHeader string) (*dns.Msg,
 	domain := strings.TrimSuffix(strings.ToLower(msg.Question[0].Name), ".")
 	decision := s.policy.Decide(domain, remoteAddr, authHeader)
 	if !decision.Allow {
-		return refused(msg), nil
+		return s.block.blocked(msg, decision), nil
 	}
 
 	upstream, err := s.resolver.Resolve(msg)
@@ -140,14 +147,6 @@ func (s *Server) process(msg *dns.Msg, remoteAddr, authHeader string) (*dns.Msg,
 	return upstream, nil
 }
 
-func refused(query *dns.Msg) *dns.Msg {
-	response := new(dns.Msg)
-	response.SetReply(query)
-	response.Authoritative = true
-	response.Rcode = dns.RcodeRefused
-	return response
-}
-
 func failure(w dns.ResponseWriter, r *dns.Msg, code int) {
 	resp := new(dns.Msg)
 	resp.SetReply(r)
@@ -58,8 +58,11 @@ func TestDNSBlockedUnauthorized(t *testing.T) {
 		t.Fatalf("expected response message")
 	}
 
-	if writer.msg.Rcode != dns.RcodeRefused {
-		t.Fatalf("expected refused rcode got %d", writer.msg.Rcode)
+	if writer.msg.Rcode != dns.RcodeSuccess || len(writer.msg.Answer) != 1 {
+		t.Fatalf("expected ads to be answered by default, got %v", writer.msg)
+	}
+	if a, ok := writer.msg.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IPv4zero) {
+		t.Fatalf("expected 0.0.0.0 for ads by default, got %v", writer.msg.Answer[0])
 	}
 }
 
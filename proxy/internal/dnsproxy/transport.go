@@ -0,0 +1,375 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMaxResponse = 1 << 16
+	dnsMessageType = "application/dns-message"
+)
+
+// TLSOptions configures the TLS session of an encrypted upstream. ServerName overrides
+// the name sent in SNI and checked against the certificate, which lets an upstream be
+// addressed by IP; SPKIPins, when set, additionally require one certificate in the chain
+// to carry a public key with a matching base64 SHA-256 digest.
+type TLSOptions struct {
+	ServerName string
+	SPKIPins   []string
+	Timeout    time.Duration
+	// RootCAs replaces the system roots; nil uses the system pool.
+	RootCAs *x509.CertPool
+}
+
+func (o TLSOptions) config(host string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName: o.ServerName,
+		RootCAs:    o.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if len(o.SPKIPins) > 0 {
+		pins := append([]string(nil), o.SPKIPins...)
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				encoded := base64.StdEncoding.EncodeToString(digest[:])
+				for _, pin := range pins {
+					if pin == encoded {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate from %s matches the pinned SPKI hashes", cfg.ServerName)
+		}
+	}
+	return cfg
+}
+
+// NewResolverFromURL builds a resolver from an upstream spec:
+//   - host:port or udp://host:port for plain DNS over UDP, tcp://host:port over TCP
+//   - tls://host[:853] for DNS over TLS (RFC 7858)
+//   - https://host/dns-query for DNS over HTTPS (RFC 8484), POST unless ?method=get
+//
+// Encrypted upstreams accept ?sni=name to pin the TLS server name and repeated
+// ?pin-sha256=base64 SPKI hashes; both are removed before a DoH URL is used.
+func NewResolverFromURL(spec string, timeout time.Duration) (Resolver, error) {
+	if !strings.Contains(spec, "://") {
+		return NewUpstreamResolver(spec, timeout), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS upstream %q: %w", spec, err)
+	}
+
+	query := u.Query()
+	opts := TLSOptions{
+		ServerName: query.Get("sni"),
+		SPKIPins:   query["pin-sha256"],
+		Timeout:    timeout,
+	}
+	for _, pin := range opts.SPKIPins {
+		if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin-sha256 %q in DNS upstream %q", pin, spec)
+		}
+	}
+	method := strings.ToUpper(query.Get("method"))
+	for _, key := range []string{"sni", "pin-sha256", "method"} {
+		query.Del(key)
+	}
+	u.RawQuery = query.Encode()
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &UpstreamResolver{client: &dns.Client{Net: u.Scheme, Timeout: timeout}, address: u.Host}, nil
+	case "tls":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+		return NewDoTResolver(addr, opts), nil
+	case "https":
+		if method == "" {
+			method = http.MethodPost
+		}
+		if method != http.MethodPost && method != http.MethodGet {
+			return nil, fmt.Errorf("invalid DoH method %q", method)
+		}
+		resolver := NewDoHResolver(u.String(), opts)
+		resolver.Method = method
+		return resolver, nil
+	}
+	return nil, fmt.Errorf("unsupported DNS upstream scheme %q", u.Scheme)
+}
+
+// DoHResolver sends queries to an RFC 8484 DNS-over-HTTPS endpoint over a pooled,
+// keep-alive HTTP/2 (or HTTP/1.1) client.
+type DoHResolver struct {
+	endpoint string
+	client   *http.Client
+	// Method is POST (the default) or GET.
+	Method string
+}
+
+// NewDoHResolver returns a POST resolver for endpoint.
+func NewDoHResolver(endpoint string, opts TLSOptions) *DoHResolver {
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil {
+		host = u.Hostname()
+	}
+	transport := &http.Transport{
+		TLSClientConfig:     opts.config(host),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: opts.Timeout,
+	}
+	return &DoHResolver{
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport, Timeout: opts.Timeout},
+		Method:   http.MethodPost,
+	}
+}
+
+// Resolve performs the DNS exchange. The query ID is sent as zero to keep responses
+// cacheable by HTTP intermediaries, as RFC 8484 recommends, and restored on the answer.
+func (d *DoHResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	query := msg.Copy()
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if d.Method == http.MethodGet {
+		u, _ := url.Parse(d.endpoint)
+		params := u.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+		u.RawQuery = params.Encode()
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, d.endpoint, bytes.NewReader(wire))
+		if req != nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, dohMaxResponse))
+		return nil, fmt.Errorf("DoH upstream returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, fmt.Errorf("invalid DoH response: %w", err)
+	}
+	answer.Id = msg.Id
+	return answer, nil
+}
+
+// DoTResolver sends queries to an RFC 7858 DNS-over-TLS server over one persistent
+// connection. Queries are pipelined: each goes out as soon as it arrives, under an ID
+// unique on the connection, and answers are matched back by ID in any order.
+type DoTResolver struct {
+	addr      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+type dotConn struct {
+	conn    *dns.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	nextID  uint16
+	err     error
+	done    chan struct{}
+	// lastRead is when the server last sent any message, so a timeout only drops the
+	// connection once it has gone silent for every query.
+	lastRead time.Time
+}
+
+// NewDoTResolver returns a resolver for the DoT server at addr (host:port).
+func NewDoTResolver(addr string, opts TLSOptions) *DoTResolver {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &DoTResolver{addr: addr, tlsConfig: opts.config(host), timeout: opts.Timeout}
+}
+
+// Resolve performs the DNS exchange, redialling once if the pooled connection was
+// closed by the server since the last query.
+func (d *DoTResolver) Resolve(msg *dns.Msg) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		conn, fresh, err := d.connection()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.exchange(msg, d.timeout)
+		if err == nil || fresh || attempt > 0 || !errors.Is(err, errConnClosed) {
+			return resp, err
+		}
+	}
+}
+
+var errConnClosed = errors.New("DoT connection closed")
+
+func (d *DoTResolver) connection() (*dotConn, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn.alive() {
+		return d.conn, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	dialer := &tls.Dialer{Config: d.tlsConfig}
+	raw, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	d.conn = &dotConn{
+		conn:    &dns.Conn{Conn: raw},
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go d.conn.readLoop()
+	return d.conn, true, nil
+}
+
+func (c *dotConn) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *dotConn) exchange(msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	reply := make(chan *dns.Msg, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, errConnClosed
+	}
+	if len(c.pending) >= 1<<16-1 {
+		c.mu.Unlock()
+		return nil, errors.New("too many queries in flight")
+	}
+	id := c.nextID
+	for _, taken := c.pending[id]; taken; _, taken = c.pending[id] {
+		id++
+	}
+	c.nextID = id + 1
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	query := msg.Copy()
+	query.Id = id
+	sent := time.Now()
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := c.conn.WriteMsg(query)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, errConnClosed
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-reply:
+		resp.Id = msg.Id
+		return resp, nil
+	case <-c.done:
+		return nil, errConnClosed
+	case <-timer.C:
+		// A peer that answered nothing since this query went out may have vanished
+		// without a reset; drop the connection so the next query redials. If other
+		// answers arrived, only this query was lost and the pipeline stays up.
+		err := fmt.Errorf("DoT query timed out after %s", timeout)
+		c.mu.Lock()
+		silent := !c.lastRead.After(sent)
+		c.mu.Unlock()
+		if silent {
+			c.close(err)
+		}
+		return nil, err
+	}
+}
+
+func (c *dotConn) readLoop() {
+	for {
+		resp, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.mu.Lock()
+		c.lastRead = time.Now()
+		reply, ok := c.pending[resp.Id]
+		c.mu.Unlock()
+		if ok {
+			select {
+			case reply <- resp:
+			default: // a duplicate answer for an ID already served
+			}
+		}
+	}
+}
+
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
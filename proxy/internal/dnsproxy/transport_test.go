@@ -0,0 +1,298 @@
+package dnsproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answerFor(r *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 53),
+	})
+	return resp
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestDoHResolverPostAndGet(t *testing.T) {
+	var methods []string
+	var mu sync.Mutex
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		if r.Method == http.MethodGet {
+			wire, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			wire, _ = io.ReadAll(r.Body)
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(wire); err != nil || q.Id != 0 || r.URL.Query().Get("sni") != "" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		out, _ := answerFor(q).Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(out)
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	opts := TLSOptions{ServerName: "example.com", Timeout: 2 * time.Second, RootCAs: roots}
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		resolver := NewDoHResolver(srv.URL+"/dns-query", opts)
+		resolver.Method = method
+		q := query("example.com.", dns.TypeA)
+		resp, err := resolver.Resolve(q)
+		if err != nil || resp.Id != q.Id || len(resp.Answer) != 1 {
+			t.Fatalf("%s: expected answer with the original ID, got %v (%v)", method, resp, err)
+		}
+	}
+	if len(methods) != 2 || methods[0] != http.MethodPost || methods[1] != http.MethodGet {
+		t.Fatalf("unexpected request methods %v", methods)
+	}
+
+	pinned := opts
+	pinned.SPKIPins = []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}
+	if _, err := NewDoHResolver(srv.URL, pinned).Resolve(query("example.com.", dns.TypeA)); err == nil {
+		t.Fatal("expected a mismatched SPKI pin to fail the handshake")
+	}
+	pinned.SPKIPins = []string{spkiPin(srv.Certificate())}
+	if _, err := NewDoHResolver(srv.URL, pinned).Resolve(query("example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("expected the matching SPKI pin to be accepted, got %v", err)
+	}
+}
+
+// countingListener counts accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestDoTResolverPipelinesOnOneConnection(t *testing.T) {
+	certSource := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSource.Close()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	counting := &countingListener{Listener: inner}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          tls.NewListener(counting, &tls.Config{Certificates: certSource.TLS.Certificates}),
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r))
+		}),
+	}
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certSource.Certificate())
+	resolver := NewDoTResolver(inner.Addr().String(), TLSOptions{
+		ServerName: "example.com",
+		SPKIPins:   []string{spkiPin(certSource.Certificate())},
+		Timeout:    2 * time.Second,
+		RootCAs:    roots,
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := query("example.com.", dns.TypeA)
+			resp, err := resolver.Resolve(q)
+			if err == nil && (resp.Id != q.Id || len(resp.Answer) != 1) {
+				err = io.ErrUnexpectedEOF
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("pipelined query failed: %v", err)
+		}
+	}
+	if n := counting.accepted.Load(); n != 1 {
+		t.Fatalf("expected all queries to share one connection, got %d", n)
+	}
+
+	// A dropped connection must not fail the next query.
+	resolver.conn.conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := resolver.Resolve(query("example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("expected a transparent redial, got %v", err)
+	}
+}
+
+func TestDoTResolverRedialsAfterTimeout(t *testing.T) {
+	certSource := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSource.Close()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	counting := &countingListener{Listener: inner}
+	var silent atomic.Bool
+	silent.Store(true)
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          tls.NewListener(counting, &tls.Config{Certificates: certSource.TLS.Certificates}),
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if !silent.Load() {
+				w.WriteMsg(answerFor(r))
+			}
+		}),
+	}
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certSource.Certificate())
+	resolver := NewDoTResolver(inner.Addr().String(), TLSOptions{
+		ServerName: "example.com",
+		Timeout:    200 * time.Millisecond,
+		RootCAs:    roots,
+	})
+
+	if _, err := resolver.Resolve(query("example.com.", dns.TypeA)); err == nil {
+		t.Fatal("expected the query to a silent server to time out")
+	}
+
+	silent.Store(false)
+	if _, err := resolver.Resolve(query("example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("expected the next query to redial, got %v", err)
+	}
+	if n := counting.accepted.Load(); n != 2 {
+		t.Fatalf("expected a fresh connection after the timeout, got %d connections", n)
+	}
+}
+
+func TestDoTResolverKeepsConnectionWhenOneQueryIsLost(t *testing.T) {
+	certSource := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSource.Close()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	counting := &countingListener{Listener: inner}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          tls.NewListener(counting, &tls.Config{Certificates: certSource.TLS.Certificates}),
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name != "lost.example.com." {
+				w.WriteMsg(answerFor(r))
+			}
+		}),
+	}
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certSource.Certificate())
+	resolver := NewDoTResolver(inner.Addr().String(), TLSOptions{
+		ServerName: "example.com",
+		Timeout:    300 * time.Millisecond,
+		RootCAs:    roots,
+	})
+
+	lost := make(chan error, 1)
+	go func() {
+		_, err := resolver.Resolve(query("lost.example.com.", dns.TypeA))
+		lost <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := resolver.Resolve(query("example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("expected the answered query to succeed, got %v", err)
+	}
+	if err := <-lost; err == nil {
+		t.Fatal("expected the unanswered query to time out")
+	}
+
+	if _, err := resolver.Resolve(query("example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("expected the connection to stay usable, got %v", err)
+	}
+	if n := counting.accepted.Load(); n != 1 {
+		t.Fatalf("one lost answer must not drop a live connection, got %d connections", n)
+	}
+}
+
+func TestNewResolverFromURL(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"9.9.9.9:53", "*dnsproxy.UpstreamResolver"},
+		{"tcp://9.9.9.9:53", "*dnsproxy.UpstreamResolver"},
+		{"tls://1.1.1.1?sni=cloudflare-dns.com&pin-sha256=" + pin, "*dnsproxy.DoTResolver"},
+		{"https://dns.example/dns-query?method=get", "*dnsproxy.DoHResolver"},
+	}
+	for _, tc := range tests {
+		resolver, err := NewResolverFromURL(tc.spec, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		if got := fmt.Sprintf("%T", resolver); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.spec, tc.want, got)
+		}
+	}
+
+	dot, _ := NewResolverFromURL("tls://1.1.1.1?sni=cloudflare-dns.com", time.Second)
+	if d := dot.(*DoTResolver); d.addr != "1.1.1.1:853" || d.tlsConfig.ServerName != "cloudflare-dns.com" {
+		t.Fatalf("expected default DoT port and pinned SNI, got %s %s", d.addr, d.tlsConfig.ServerName)
+	}
+	doh, _ := NewResolverFromURL("https://dns.example/dns-query?method=get&sni=x", time.Second)
+	if d := doh.(*DoHResolver); d.endpoint != "https://dns.example/dns-query" || d.Method != http.MethodGet {
+		t.Fatalf("expected resolver options stripped from the DoH URL, got %s %s", d.endpoint, d.Method)
+	}
+
+	for _, bad := range []string{"quic://dns.example", "tls://dns.example?pin-sha256=short", "https://dns.example/dns-query?method=put"} {
+		if _, err := NewResolverFromURL(bad, time.Second); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
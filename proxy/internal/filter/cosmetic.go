@@ -0,0 +1,386 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// selectorsPerRule bounds each CSS rule in the generated stylesheet; browsers drop a whole
+// rule when one selector in its list is invalid, so smaller groups limit the damage.
+const selectorsPerRule = 100
+
+// proceduralMarkers identify uBlock Origin/ABP extended selectors that plain CSS cannot express.
+var proceduralMarkers = []string{
+	":-abp-", ":has-text(", ":xpath(", ":matches-css", ":matches-attr(", ":matches-path(",
+	":matches-prop(", ":min-text-length(", ":upward(", ":remove(", ":remove-attr(",
+	":remove-class(", ":style(", ":watch-attr(", ":others(", ":contains(",
+}
+
+var documentTokenPattern = regexp.MustCompile(`(?i)\s(?:class|id)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// cosmeticRule is an element hiding selector with the domains it must not apply to.
+type cosmeticRule struct {
+	selector string
+	exclude  []string
+}
+
+// CosmeticEngine collects Adblock Plus element hiding rules ("##selector", "domain##selector",
+// "#@#selector") and builds the stylesheet that hides matching elements on a page.
+type CosmeticEngine struct {
+	mu sync.RWMutex
+
+	// genericByToken holds generic selectors keyed by a class or id they require, so only
+	// selectors that can match something in the document are emitted. The remaining
+	// generic selectors are few and always emitted, from a sheet built once per load.
+	genericByToken map[string][]cosmeticRule
+	genericOther   []cosmeticRule
+	genericSheet   *genericSheet
+	specific       map[string][]cosmeticRule
+
+	genericExceptions  map[string]bool
+	specificExceptions map[string]map[string]bool
+
+	// genericHide and elemHide come from "@@||domain^$generichide" and "$elemhide" rules.
+	genericHide map[string]bool
+	elemHide    map[string]bool
+
+	size int
+}
+
+// NewCosmeticEngine constructs an engine from ABP filter lines.
+func NewCosmeticEngine(lines []string) *CosmeticEngine {
+	e := &CosmeticEngine{
+		genericByToken:     make(map[string][]cosmeticRule),
+		specific:           make(map[string][]cosmeticRule),
+		genericExceptions:  make(map[string]bool),
+		specificExceptions: make(map[string]map[string]bool),
+		genericHide:        make(map[string]bool),
+		elemHide:           make(map[string]bool),
+	}
+	for _, line := range lines {
+		e.AddFilter(line)
+	}
+	return e
+}
+
+// AddFilter parses and indexes an element hiding rule, reporting whether it was accepted.
+// Procedural, scriptlet and HTML filtering rules are rejected.
+func (e *CosmeticEngine) AddFilter(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return false
+	}
+	if strings.HasPrefix(line, "@@") {
+		return e.addHideException(line)
+	}
+
+	domains, selector, exception, ok := splitCosmetic(line)
+	if !ok || !plainSelector(selector) {
+		return false
+	}
+	var include, exclude []string
+	for _, d := range strings.Split(domains, ",") {
+		d = normalize(d)
+		switch {
+		case d == "":
+		case strings.HasPrefix(d, "~"):
+			exclude = append(exclude, d[1:])
+		default:
+			include = append(include, d)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.size++
+	e.genericSheet = nil
+
+	switch {
+	case exception && len(include) == 0:
+		e.genericExceptions[selector] = true
+	case exception:
+		for _, d := range include {
+			if e.specificExceptions[d] == nil {
+				e.specificExceptions[d] = make(map[string]bool)
+			}
+			e.specificExceptions[d][selector] = true
+		}
+	case len(include) == 0:
+		rule := cosmeticRule{selector: selector, exclude: exclude}
+		if token := selectorToken(selector); token != "" {
+			e.genericByToken[token] = append(e.genericByToken[token], rule)
+		} else {
+			e.genericOther = append(e.genericOther, rule)
+		}
+	default:
+		for _, d := range include {
+			e.specific[d] = append(e.specific[d], cosmeticRule{selector: selector, exclude: exclude})
+		}
+	}
+	return true
+}
+
+// addHideException handles "@@||domain^$generichide" and "$elemhide" network rules, which
+// switch element hiding off for a site.
+func (e *CosmeticEngine) addHideException(line string) bool {
+	idx := strings.LastIndex(line, "$")
+	if idx == -1 || !strings.HasPrefix(line, "@@||") {
+		return false
+	}
+	domain := normalize(strings.TrimSuffix(line[4:idx], "^"))
+	if domain == "" || strings.ContainsAny(domain, "/*|^") {
+		return false
+	}
+
+	var generic, all bool
+	for _, option := range strings.Split(strings.ToLower(line[idx+1:]), ",") {
+		switch strings.TrimSpace(option) {
+		case "generichide", "ghide":
+			generic = true
+		case "elemhide", "ehide", "document", "doc":
+			all = true
+		}
+	}
+	if !generic && !all {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.size++
+	if all {
+		e.elemHide[domain] = true
+	} else {
+		e.genericHide[domain] = true
+	}
+	return true
+}
+
+// Len returns the number of indexed rules.
+func (e *CosmeticEngine) Len() int {
+	if e == nil {
+		return 0
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.size
+}
+
+// Stylesheet returns CSS hiding every element that the site-specific rules for host and the
+// generic rules select. Generic selectors keyed on a class or id are only included when that
+// token appears in document. It returns "" when nothing applies.
+func (e *CosmeticEngine) Stylesheet(host string, document []byte) string {
+	if e == nil {
+		return ""
+	}
+	host = normalize(host)
+	sheet := e.loadGenericSheet()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.domainFlag(e.elemHide, host) {
+		return ""
+	}
+	generic := !e.domainFlag(e.genericHide, host)
+	prebuilt := generic && !e.exceptsAny(host, sheet.selectors)
+
+	var selectors []string
+	seen := make(map[string]bool)
+	add := func(rules []cosmeticRule) {
+		for _, rule := range rules {
+			if seen[rule.selector] || prebuilt && sheet.selectors[rule.selector] || e.excepted(rule, host) {
+				continue
+			}
+			seen[rule.selector] = true
+			selectors = append(selectors, rule.selector)
+		}
+	}
+
+	for domain := host; domain != ""; domain = parentDomain(domain) {
+		add(e.specific[domain])
+	}
+	if !generic {
+		return buildStylesheet(selectors)
+	}
+	for _, token := range documentTokens(document) {
+		add(e.genericByToken[token])
+	}
+	if !prebuilt {
+		// A site-specific exception disables one of the prebuilt selectors here.
+		add(e.genericOther)
+		return buildStylesheet(selectors)
+	}
+	add(sheet.conditional)
+	return buildStylesheet(selectors) + sheet.css
+}
+
+// genericSheet is the part of every stylesheet that does not depend on the page: the
+// unkeyed generic selectors without domain exclusions, already rendered as CSS.
+type genericSheet struct {
+	css       string
+	selectors map[string]bool
+	// conditional holds the unkeyed generic rules that exclude some domains.
+	conditional []cosmeticRule
+}
+
+// loadGenericSheet returns the generic sheet, building it after the rules have changed.
+func (e *CosmeticEngine) loadGenericSheet() *genericSheet {
+	e.mu.RLock()
+	sheet := e.genericSheet
+	e.mu.RUnlock()
+	if sheet != nil {
+		return sheet
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.genericSheet == nil {
+		sheet := &genericSheet{selectors: make(map[string]bool)}
+		var selectors []string
+		for _, rule := range e.genericOther {
+			switch {
+			case e.genericExceptions[rule.selector] || sheet.selectors[rule.selector]:
+			case len(rule.exclude) > 0:
+				sheet.conditional = append(sheet.conditional, rule)
+			default:
+				sheet.selectors[rule.selector] = true
+				selectors = append(selectors, rule.selector)
+			}
+		}
+		sheet.css = buildStylesheet(selectors)
+		e.genericSheet = sheet
+	}
+	return e.genericSheet
+}
+
+// exceptsAny reports whether a site-specific exception for host names one of selectors.
+func (e *CosmeticEngine) exceptsAny(host string, selectors map[string]bool) bool {
+	for domain := host; domain != ""; domain = parentDomain(domain) {
+		for selector := range e.specificExceptions[domain] {
+			if selectors[selector] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *CosmeticEngine) excepted(rule cosmeticRule, host string) bool {
+	if e.genericExceptions[rule.selector] {
+		return true
+	}
+	for _, d := range rule.exclude {
+		if isSubdomain(host, d) {
+			return true
+		}
+	}
+	for domain := host; domain != ""; domain = parentDomain(domain) {
+		if e.specificExceptions[domain][rule.selector] {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *CosmeticEngine) domainFlag(flags map[string]bool, host string) bool {
+	for domain := host; domain != ""; domain = parentDomain(domain) {
+		if flags[domain] {
+			return true
+		}
+	}
+	return false
+}
+
+func buildStylesheet(selectors []string) string {
+	if len(selectors) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for start := 0; start < len(selectors); start += selectorsPerRule {
+		end := start + selectorsPerRule
+		if end > len(selectors) {
+			end = len(selectors)
+		}
+		b.WriteString(strings.Join(selectors[start:end], ",\n"))
+		b.WriteString(" { display: none !important; }\n")
+	}
+	return b.String()
+}
+
+// splitCosmetic splits "domains##selector" and "domains#@#selector".
+func splitCosmetic(line string) (domains, selector string, exception, ok bool) {
+	if idx := strings.Index(line, "#@#"); idx != -1 {
+		return line[:idx], strings.TrimSpace(line[idx+3:]), true, true
+	}
+	if idx := strings.Index(line, "##"); idx != -1 {
+		return line[:idx], strings.TrimSpace(line[idx+2:]), false, true
+	}
+	return "", "", false, false
+}
+
+// plainSelector rejects extended syntax and anything that could escape the injected <style>.
+func plainSelector(selector string) bool {
+	if selector == "" || strings.HasPrefix(selector, "+js(") || strings.HasPrefix(selector, "^") {
+		return false
+	}
+	if strings.ContainsAny(selector, "{}<") {
+		return false
+	}
+	lower := strings.ToLower(selector)
+	for _, marker := range proceduralMarkers {
+		if strings.Contains(lower, marker) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorToken returns a class or id the selector requires, taken from its leading part so
+// that tokens inside :not(), attribute selectors or later list items are never used.
+func selectorToken(selector string) string {
+	for i := 0; i < len(selector); i++ {
+		switch c := selector[i]; c {
+		case '(', '[', ',', '\\':
+			return ""
+		case '.', '#':
+			j := i + 1
+			for j < len(selector) && isNameChar(selector[j]) {
+				j++
+			}
+			if j < len(selector) && selector[j] == '\\' {
+				return ""
+			}
+			if j > i+1 {
+				return selector[i+1 : j]
+			}
+		}
+	}
+	return ""
+}
+
+func isNameChar(c byte) bool {
+	return isTokenChar(c) || c == '-' || c == '_' || c >= 0x80
+}
+
+// documentTokens returns the distinct class names and ids used in an HTML document.
+func documentTokens(document []byte) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, m := range documentTokenPattern.FindAllSubmatch(document, -1) {
+		value := m[1]
+		if value == nil {
+			value = m[2]
+		}
+		if value == nil {
+			value = m[3]
+		}
+		for _, token := range strings.Fields(string(value)) {
+			if !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,114 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCosmeticEngineStylesheet(t *testing.T) {
+	engine := NewCosmeticEngine([]string{
+		"##.ad-banner",
+		"###sidebar-ad",
+		"##div[data-ad-slot]",
+		"##.sponsored:not(.editorial)",
+		"news.example.com##.cookie-wall",
+		"example.org,~shop.example.org##.promo",
+		"##.newsletter-popup",
+		"blog.example.com#@#.newsletter-popup",
+		"#@#.allowed-ad",
+		"##.allowed-ad",
+		"example.com##.box:-abp-has(.ad)",
+		"example.com##+js(set-constant, ads, false)",
+		"example.com##.x { color: red }",
+		"||ads.example.com^",
+	})
+	document := []byte(`<html><body><div class="ad-banner wide"></div><p id='sidebar-ad'></p><div class="newsletter-popup"></div></body></html>`)
+
+	tests := []struct {
+		host    string
+		want    []string
+		notWant []string
+	}{
+		{"www.news.example.com", []string{".cookie-wall", ".ad-banner", "#sidebar-ad", "div[data-ad-slot]", ".newsletter-popup"}, []string{".sponsored", ".promo", ".allowed-ad"}},
+		{"example.org", []string{".promo"}, []string{".cookie-wall"}},
+		{"shop.example.org", nil, []string{".promo"}},
+		{"blog.example.com", []string{".ad-banner"}, []string{".newsletter-popup", ":-abp-has", "+js(", "color"}},
+	}
+	for _, tc := range tests {
+		css := engine.Stylesheet(tc.host, document)
+		for _, selector := range tc.want {
+			if !strings.Contains(css, selector) {
+				t.Errorf("%s: expected %q in stylesheet:\n%s", tc.host, selector, css)
+			}
+		}
+		for _, selector := range tc.notWant {
+			if strings.Contains(css, selector) {
+				t.Errorf("%s: did not expect %q in stylesheet:\n%s", tc.host, selector, css)
+			}
+		}
+	}
+	if got := engine.Len(); got != 10 {
+		t.Fatalf("expected 10 accepted rules, got %d", got)
+	}
+}
+
+func TestCosmeticEngineHideExceptions(t *testing.T) {
+	engine := NewCosmeticEngine([]string{
+		"##.ad-banner",
+		"example.com##.site-ad",
+		"@@||example.com^$generichide",
+		"@@||bank.example^$elemhide",
+	})
+	document := []byte(`<div class="ad-banner site-ad"></div>`)
+
+	css := engine.Stylesheet("www.example.com", document)
+	if strings.Contains(css, ".ad-banner") || !strings.Contains(css, ".site-ad") {
+		t.Fatalf("$generichide should keep only site-specific rules, got:\n%s", css)
+	}
+	if css := engine.Stylesheet("bank.example", document); css != "" {
+		t.Fatalf("$elemhide should disable element hiding, got:\n%s", css)
+	}
+}
+
+func TestCosmeticEngineGenericSheet(t *testing.T) {
+	engine := NewCosmeticEngine([]string{
+		"##div[data-ad-slot]",
+		"~example.net##a[href*=\"/ads/\"]",
+		"blog.example.com#@#div[data-ad-slot]",
+		"##.ad-banner",
+	})
+	document := []byte(`<p>script-inserted ads only</p>`)
+
+	css := engine.Stylesheet("www.example.com", document)
+	if !strings.Contains(css, "div[data-ad-slot]") || !strings.Contains(css, `a[href*="/ads/"]`) || strings.Contains(css, ".ad-banner") {
+		t.Fatalf("expected only the unkeyed generic selectors, got:\n%s", css)
+	}
+	if css := engine.Stylesheet("example.net", document); strings.Contains(css, `a[href*="/ads/"]`) {
+		t.Fatalf("domain exclusion ignored, got:\n%s", css)
+	}
+	if css := engine.Stylesheet("blog.example.com", document); strings.Contains(css, "div[data-ad-slot]") {
+		t.Fatalf("site-specific exception ignored, got:\n%s", css)
+	}
+
+	engine.AddFilter("##iframe[src*=\"adserver\"]")
+	if css := engine.Stylesheet("www.example.com", document); !strings.Contains(css, "iframe[src") {
+		t.Fatalf("rules added after a stylesheet was built must be included, got:\n%s", css)
+	}
+}
+
+func TestSelectorToken(t *testing.T) {
+	tests := map[string]string{
+		".ad-banner":        "ad-banner",
+		"#top_ad > img":     "top_ad",
+		"div.sponsored":     "sponsored",
+		"a[href*=\".ads\"]": "",
+		":not(.x) .y":       "",
+		".esc\\:aped":       "",
+		"div > span":        "",
+	}
+	for selector, want := range tests {
+		if got := selectorToken(selector); got != want {
+			t.Errorf("selectorToken(%q) = %q, want %q", selector, got, want)
+		}
+	}
+}
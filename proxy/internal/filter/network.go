@@ -0,0 +1,892 @@
+package filter
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/payhole/proxy/internal/blocklist"
+)
+
+// RequestType classifies a request the way Adblock Plus resource type options do.
+type RequestType uint16
+
+const (
+	TypeOther RequestType = 1 << iota
+	TypeScript
+	TypeImage
+	TypeStylesheet
+	TypeObject
+	TypeXMLHTTPRequest
+	TypeSubdocument
+	TypePing
+	TypeMedia
+	TypeFont
+	TypeWebSocket
+	TypeDocument
+)
+
+// defaultTypes is what a rule without type options applies to; ABP never matches documents implicitly.
+const defaultTypes = TypeOther | TypeScript | TypeImage | TypeStylesheet | TypeObject | TypeXMLHTTPRequest |
+	TypeSubdocument | TypePing | TypeMedia | TypeFont | TypeWebSocket
+
+var typeOptions = map[string]RequestType{
+	"other":          TypeOther,
+	"script":         TypeScript,
+	"image":          TypeImage,
+	"stylesheet":     TypeStylesheet,
+	"css":            TypeStylesheet,
+	"object":         TypeObject,
+	"xmlhttprequest": TypeXMLHTTPRequest,
+	"xhr":            TypeXMLHTTPRequest,
+	"subdocument":    TypeSubdocument,
+	"frame":          TypeSubdocument,
+	"ping":           TypePing,
+	"beacon":         TypePing,
+	"media":          TypeMedia,
+	"font":           TypeFont,
+	"websocket":      TypeWebSocket,
+	"document":       TypeDocument,
+	"doc":            TypeDocument,
+}
+
+// Request describes the parts of an outgoing request that network rules match against.
+type Request struct {
+	URL        string
+	Host       string
+	Type       RequestType
+	SourceHost string
+}
+
+// ThirdParty reports whether the request leaves the site of the page that issued it.
+func (r Request) ThirdParty() bool {
+	return r.SourceHost != "" && !SameSite(r.Host, r.SourceHost)
+}
+
+// RequestFromHTTP builds a Request from a proxied HTTP request, inferring its type from headers.
+func RequestFromHTTP(r *http.Request) Request {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return Request{
+		URL:        u.String(),
+		Host:       normalize(u.Hostname()),
+		Type:       InferRequestType(r.Header, u.Path),
+		SourceHost: sourceHost(r.Header),
+	}
+}
+
+// InferRequestType guesses the resource type from Fetch metadata, Accept and the path extension.
+func InferRequestType(header http.Header, requestPath string) RequestType {
+	if strings.EqualFold(header.Get("Upgrade"), "websocket") {
+		return TypeWebSocket
+	}
+	switch strings.ToLower(header.Get("Sec-Fetch-Dest")) {
+	case "document":
+		return TypeDocument
+	case "iframe", "frame", "embed":
+		return TypeSubdocument
+	case "script", "worker", "sharedworker", "serviceworker":
+		return TypeScript
+	case "style":
+		return TypeStylesheet
+	case "image":
+		return TypeImage
+	case "font":
+		return TypeFont
+	case "audio", "video", "track":
+		return TypeMedia
+	case "object":
+		return TypeObject
+	case "report":
+		return TypePing
+	}
+	if strings.EqualFold(header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return TypeXMLHTTPRequest
+	}
+	if header.Get("Ping-To") != "" || strings.Contains(header.Get("Content-Type"), "text/ping") {
+		return TypePing
+	}
+
+	switch strings.ToLower(path.Ext(requestPath)) {
+	case ".js", ".mjs":
+		return TypeScript
+	case ".css":
+		return TypeStylesheet
+	case ".png", ".gif", ".jpg", ".jpeg", ".webp", ".svg", ".ico", ".avif", ".bmp":
+		return TypeImage
+	case ".woff", ".woff2", ".ttf", ".otf", ".eot":
+		return TypeFont
+	case ".mp4", ".webm", ".mp3", ".m3u8", ".ogg", ".wav":
+		return TypeMedia
+	case ".swf":
+		return TypeObject
+	}
+
+	accept := strings.ToLower(header.Get("Accept"))
+	switch {
+	case strings.HasPrefix(accept, "text/html"):
+		return TypeDocument
+	case strings.HasPrefix(accept, "image/"):
+		return TypeImage
+	case strings.HasPrefix(accept, "text/css"):
+		return TypeStylesheet
+	case strings.Contains(accept, "javascript"):
+		return TypeScript
+	case strings.HasPrefix(accept, "application/json"):
+		return TypeXMLHTTPRequest
+	}
+	if strings.EqualFold(header.Get("Sec-Fetch-Mode"), "cors") {
+		return TypeXMLHTTPRequest
+	}
+	return TypeOther
+}
+
+func sourceHost(header http.Header) string {
+	for _, raw := range []string{header.Get("Origin"), header.Get("Referer")} {
+		if raw == "" || raw == "null" {
+			continue
+		}
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			return normalize(u.Hostname())
+		}
+	}
+	return ""
+}
+
+// NetworkRule is a parsed Adblock Plus URL blocking or "@@" exception rule.
+type NetworkRule struct {
+	Raw       string
+	Exception bool
+
+	pattern      string
+	regex        *regexp.Regexp
+	domainAnchor bool
+	startAnchor  bool
+	endAnchor    bool
+	matchCase    bool
+	important    bool
+	// subdomainsOnly marks "||*.example.com" rules, which skip the bare domain.
+	subdomainsOnly bool
+
+	types      RequestType
+	thirdParty int // 0 any, 1 third-party only, -1 first-party only
+
+	includeDomains []string
+	excludeDomains []string
+
+	// removeParam is set for $removeparam rules, which rewrite the query string instead of blocking.
+	removeParam *paramMatcher
+
+	// redirect names the surrogate resource served in place of a blocked request. With
+	// redirectOnly ($redirect-rule) the rule picks the surrogate but does not block by itself.
+	redirect     string
+	redirectOnly bool
+}
+
+// paramMatcher selects query parameters for a $removeparam rule. An empty matcher selects
+// every parameter; invert selects every parameter the name or regex does not.
+type paramMatcher struct {
+	name   string
+	regex  *regexp.Regexp
+	invert bool
+}
+
+func parseParamMatcher(value string) *paramMatcher {
+	m := &paramMatcher{}
+	if strings.HasPrefix(value, "~") {
+		m.invert = true
+		value = value[1:]
+	}
+	if len(value) > 2 && strings.HasPrefix(value, "/") {
+		end := strings.LastIndex(value, "/")
+		if end > 0 {
+			expr := value[1:end]
+			if strings.Contains(value[end+1:], "i") {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil
+			}
+			m.regex = re
+			return m
+		}
+	}
+	m.name = value
+	return m
+}
+
+func (m *paramMatcher) matches(name, value string) bool {
+	var hit bool
+	switch {
+	case m.regex != nil:
+		hit = m.regex.MatchString(name + "=" + value)
+	case m.name == "":
+		return !m.invert
+	default:
+		hit = name == m.name
+	}
+	return hit != m.invert
+}
+
+// Redirect returns the surrogate resource named by the rule's $redirect option, if any.
+func (r *NetworkRule) Redirect() string {
+	return r.redirect
+}
+
+// RemovesParam reports whether a $removeparam rule strips the query parameter name=value.
+func (r *NetworkRule) RemovesParam(name, value string) bool {
+	return r.removeParam != nil && r.removeParam.matches(name, value)
+}
+
+// ParseNetworkRule parses an ABP network filter line. It returns false for comments,
+// cosmetic rules and rules with options this engine cannot honour.
+func ParseNetworkRule(line string) (*NetworkRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, false
+	}
+	if isCosmetic(line) {
+		return nil, false
+	}
+
+	rule := &NetworkRule{Raw: line, types: defaultTypes}
+	body := line
+	if strings.HasPrefix(body, "@@") {
+		rule.Exception = true
+		body = body[2:]
+	}
+	pattern := body
+	if idx := optionsIndex(body); idx != -1 {
+		pattern = body[:idx]
+		if !rule.parseOptions(body[idx+1:]) {
+			return nil, false
+		}
+	}
+
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr := pattern[1 : len(pattern)-1]
+		if !rule.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, false
+		}
+		rule.regex = re
+		return rule, true
+	}
+
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		rule.domainAnchor = true
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		rule.startAnchor = true
+		pattern = pattern[1:]
+	}
+	if rule.domainAnchor && strings.HasPrefix(pattern, "*") {
+		if strings.HasPrefix(pattern, "*.") {
+			// "||*.example.com^" is anchored to the labels below example.com.
+			rule.subdomainsOnly = true
+			pattern = pattern[2:]
+		} else {
+			// Any host prefix may precede the rest, so the anchor adds nothing.
+			rule.domainAnchor = false
+		}
+	}
+	if strings.HasSuffix(pattern, "|") {
+		rule.endAnchor = true
+		pattern = pattern[:len(pattern)-1]
+	}
+	pattern = strings.Trim(pattern, "*")
+	if pattern == "" && !rule.domainAnchor && rule.removeParam == nil {
+		// A bare "*" would match every request.
+		if len(rule.includeDomains) == 0 {
+			return nil, false
+		}
+	}
+	if !rule.matchCase {
+		pattern = strings.ToLower(pattern)
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+func (r *NetworkRule) parseOptions(raw string) bool {
+	var included, excluded RequestType
+	for _, option := range strings.Split(raw, ",") {
+		original := strings.TrimSpace(option)
+		option = strings.ToLower(original)
+		negated := strings.HasPrefix(option, "~")
+		name := strings.TrimPrefix(option, "~")
+
+		if t, ok := typeOptions[name]; ok {
+			if negated {
+				excluded |= t
+			} else {
+				included |= t
+			}
+			continue
+		}
+
+		switch {
+		case name == "third-party" || name == "3p":
+			r.thirdParty = 1
+			if negated {
+				r.thirdParty = -1
+			}
+		case name == "first-party" || name == "1p":
+			r.thirdParty = -1
+			if negated {
+				r.thirdParty = 1
+			}
+		case name == "match-case":
+			r.matchCase = true
+		case name == "important":
+			r.important = true
+		case strings.HasPrefix(name, "domain="):
+			for _, d := range strings.Split(strings.TrimPrefix(name, "domain="), "|") {
+				if strings.HasPrefix(d, "~") {
+					r.excludeDomains = append(r.excludeDomains, normalize(d[1:]))
+				} else if d != "" {
+					r.includeDomains = append(r.includeDomains, normalize(d))
+				}
+			}
+		case strings.HasPrefix(name, "redirect=") || strings.HasPrefix(name, "redirect-rule="):
+			value := name[strings.IndexByte(name, '=')+1:]
+			// uBlock Origin allows a ":priority" suffix; this engine uses the first match.
+			if idx := strings.IndexByte(value, ':'); idx != -1 {
+				value = value[:idx]
+			}
+			if value == "" || r.Exception {
+				return false
+			}
+			r.redirect = value
+			r.redirectOnly = strings.HasPrefix(name, "redirect-rule=")
+		case name == "removeparam" || strings.HasPrefix(name, "removeparam="):
+			// Parameter names and regexes keep their case, unlike the rest of the options.
+			value := strings.TrimPrefix(strings.TrimPrefix(original, original[:len("removeparam")]), "=")
+			if r.removeParam = parseParamMatcher(value); r.removeParam == nil {
+				return false
+			}
+		default:
+			// popup, csp= and friends change what happens rather than whether a request
+			// is blocked; treating them as plain blocks would over-block.
+			return false
+		}
+	}
+
+	all := defaultTypes
+	if r.removeParam != nil {
+		// Tracking parameters matter most on navigations, so $removeparam covers documents too.
+		all |= TypeDocument
+		r.types = all
+	}
+	switch {
+	case included != 0:
+		r.types = included &^ excluded
+	case excluded != 0:
+		r.types = all &^ excluded
+	}
+	return r.types != 0
+}
+
+// Matches reports whether the rule applies to req.
+func (r *NetworkRule) Matches(req Request) bool {
+	if req.Type&r.types == 0 {
+		return false
+	}
+	switch r.thirdParty {
+	case 1:
+		if !req.ThirdParty() {
+			return false
+		}
+	case -1:
+		if req.ThirdParty() {
+			return false
+		}
+	}
+	if !r.matchesSource(req.SourceHost) {
+		return false
+	}
+
+	target := req.URL
+	if r.regex != nil {
+		return r.regex.MatchString(target)
+	}
+	if !r.matchCase {
+		target = strings.ToLower(target)
+	}
+	return r.matchesURL(target)
+}
+
+func (r *NetworkRule) matchesSource(source string) bool {
+	for _, d := range r.excludeDomains {
+		if source != "" && isSubdomain(source, d) {
+			return false
+		}
+	}
+	if len(r.includeDomains) == 0 {
+		return true
+	}
+	for _, d := range r.includeDomains {
+		if source != "" && isSubdomain(source, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *NetworkRule) matchesURL(target string) bool {
+	glob := r.pattern
+	if !r.endAnchor {
+		glob += "*"
+	}
+
+	switch {
+	case r.domainAnchor:
+		hostStart := strings.Index(target, "://")
+		if hostStart == -1 {
+			return false
+		}
+		hostStart += 3
+		hostEnd := len(target)
+		if idx := strings.IndexAny(target[hostStart:], "/?#"); idx != -1 {
+			hostEnd = hostStart + idx
+		}
+		for i := hostStart; i < hostEnd; i++ {
+			if i == hostStart && r.subdomainsOnly {
+				continue
+			}
+			if i == hostStart || target[i-1] == '.' {
+				if globMatch(glob, target[i:]) {
+					return true
+				}
+			}
+		}
+		return false
+	case r.startAnchor:
+		return globMatch(glob, target)
+	default:
+		return globMatch("*"+glob, target)
+	}
+}
+
+// hostKey returns the hostname a domain-anchored rule is pinned to, if any.
+func (r *NetworkRule) hostKey() string {
+	if !r.domainAnchor || r.regex != nil {
+		return ""
+	}
+	end := strings.IndexAny(r.pattern, "^/*|:?")
+	if end == -1 {
+		if r.endAnchor {
+			return r.pattern
+		}
+		return ""
+	}
+	if r.pattern[end] == '*' {
+		return ""
+	}
+	return r.pattern[:end]
+}
+
+// token returns the longest alphanumeric run in the pattern that is guaranteed to appear
+// as a whole token in any matching URL.
+func (r *NetworkRule) token() string {
+	if r.regex != nil || r.matchCase {
+		return ""
+	}
+	best := ""
+	p := r.pattern
+	for i := 0; i < len(p); {
+		if !isTokenChar(p[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(p) && isTokenChar(p[j]) {
+			j++
+		}
+		leftBounded := (i == 0 && (r.startAnchor || r.domainAnchor)) || (i > 0 && p[i-1] != '*')
+		rightBounded := (j == len(p) && r.endAnchor) || (j < len(p) && p[j] != '*')
+		if leftBounded && rightBounded && j-i > len(best) {
+			best = p[i:j]
+		}
+		i = j
+	}
+	if len(best) < 2 {
+		return ""
+	}
+	return best
+}
+
+// NetworkEngine indexes network rules by host and URL token for fast lookups.
+type NetworkEngine struct {
+	mu         sync.RWMutex
+	blocks     ruleIndex
+	important  ruleIndex
+	exceptions ruleIndex
+	size       int
+
+	removeParams    ruleIndex
+	keepParams      ruleIndex
+	hasRemoveParams bool
+
+	redirects ruleIndex
+}
+
+// NewNetworkEngine constructs an engine from ABP filter lines.
+func NewNetworkEngine(lines []string) *NetworkEngine {
+	e := &NetworkEngine{
+		blocks:       newRuleIndex(),
+		important:    newRuleIndex(),
+		exceptions:   newRuleIndex(),
+		removeParams: newRuleIndex(),
+		keepParams:   newRuleIndex(),
+		redirects:    newRuleIndex(),
+	}
+	for _, line := range lines {
+		e.AddFilter(line)
+	}
+	return e
+}
+
+// AddFilter parses and indexes a single filter line, reporting whether it was accepted.
+func (e *NetworkEngine) AddFilter(line string) bool {
+	rule, ok := ParseNetworkRule(line)
+	if !ok {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.size++
+	if rule.redirect != "" {
+		e.redirects.add(rule)
+	}
+	switch {
+	case rule.redirectOnly:
+		// Only consulted through Redirect once something else has blocked the request.
+	case rule.removeParam != nil && rule.Exception:
+		e.keepParams.add(rule)
+	case rule.removeParam != nil:
+		e.removeParams.add(rule)
+		e.hasRemoveParams = true
+	case rule.Exception:
+		e.exceptions.add(rule)
+	case rule.important:
+		e.important.add(rule)
+	default:
+		e.blocks.add(rule)
+	}
+	return true
+}
+
+// Len returns the number of indexed rules.
+func (e *NetworkEngine) Len() int {
+	if e == nil {
+		return 0
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.size
+}
+
+// TrackerHosts lists the hosts that blocking rules are pinned to, such as facebook.com for
+// "||facebook.com/tr^". Those hosts serve tracking endpoints without being blocked outright,
+// which makes them the hosts whose third-party cookies are worth stripping.
+func (e *NetworkEngine) TrackerHosts() blocklist.List {
+	return trackerHosts{e}
+}
+
+type trackerHosts struct {
+	engine *NetworkEngine
+}
+
+func (t trackerHosts) Contains(host string) bool {
+	_, ok := t.Match(host)
+	return ok
+}
+
+// Match returns the most specific pinned host that equals host or one of its parents.
+func (t trackerHosts) Match(host string) (string, bool) {
+	if t.engine == nil {
+		return "", false
+	}
+	t.engine.mu.RLock()
+	defer t.engine.mu.RUnlock()
+	for host = normalize(host); host != ""; host = parentDomain(host) {
+		if len(t.engine.blocks.byHost[host]) > 0 || len(t.engine.important.byHost[host]) > 0 {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// Match returns the rule that blocks req, or nil. "@@" exceptions override block rules
+// unless the block rule carries the $important option.
+func (e *NetworkEngine) Match(req Request) *NetworkRule {
+	if e == nil || req.URL == "" {
+		return nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	tokens := urlTokens(strings.ToLower(req.URL))
+	if rule := e.important.match(req, tokens); rule != nil {
+		return rule
+	}
+	rule := e.blocks.match(req, tokens)
+	if rule == nil || e.exceptions.match(req, tokens) != nil {
+		return nil
+	}
+	return rule
+}
+
+// Redirect returns the surrogate resource that $redirect and $redirect-rule rules select
+// for req, or "" when none applies. It does not decide whether req is blocked.
+func (e *NetworkEngine) Redirect(req Request) string {
+	if e == nil || req.URL == "" {
+		return ""
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if rule := e.redirects.match(req, urlTokens(strings.ToLower(req.URL))); rule != nil {
+		return rule.redirect
+	}
+	return ""
+}
+
+// RemovedParams returns the query parameters of req that $removeparam rules strip. An
+// "@@...$removeparam" exception keeps the parameters it selects.
+func (e *NetworkEngine) RemovedParams(req Request, query []QueryParam) []string {
+	if e == nil || req.URL == "" || len(query) == 0 {
+		return nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.hasRemoveParams {
+		return nil
+	}
+
+	tokens := urlTokens(strings.ToLower(req.URL))
+	removers := e.removeParams.matchAll(req, tokens)
+	if len(removers) == 0 {
+		return nil
+	}
+	keepers := e.keepParams.matchAll(req, tokens)
+
+	var removed []string
+	for _, param := range query {
+		if anyRemovesParam(removers, param) && !anyRemovesParam(keepers, param) {
+			removed = append(removed, param.Name)
+		}
+	}
+	return removed
+}
+
+// QueryParam is a decoded query string parameter.
+type QueryParam struct {
+	Name  string
+	Value string
+}
+
+func anyRemovesParam(rules []*NetworkRule, param QueryParam) bool {
+	for _, rule := range rules {
+		if rule.RemovesParam(param.Name, param.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleIndex struct {
+	byHost  map[string][]*NetworkRule
+	byToken map[string][]*NetworkRule
+	generic []*NetworkRule
+}
+
+func newRuleIndex() ruleIndex {
+	return ruleIndex{
+		byHost:  make(map[string][]*NetworkRule),
+		byToken: make(map[string][]*NetworkRule),
+	}
+}
+
+func (x *ruleIndex) add(rule *NetworkRule) {
+	if host := rule.hostKey(); host != "" {
+		x.byHost[host] = append(x.byHost[host], rule)
+		return
+	}
+	if token := rule.token(); token != "" {
+		x.byToken[token] = append(x.byToken[token], rule)
+		return
+	}
+	x.generic = append(x.generic, rule)
+}
+
+func (x *ruleIndex) match(req Request, tokens []string) *NetworkRule {
+	for host := req.Host; host != ""; host = parentDomain(host) {
+		if rule := firstMatch(x.byHost[host], req); rule != nil {
+			return rule
+		}
+	}
+	for i, token := range tokens {
+		if containsToken(tokens[:i], token) {
+			continue
+		}
+		if rule := firstMatch(x.byToken[token], req); rule != nil {
+			return rule
+		}
+	}
+	return firstMatch(x.generic, req)
+}
+
+func (x *ruleIndex) matchAll(req Request, tokens []string) []*NetworkRule {
+	var rules []*NetworkRule
+	collect := func(candidates []*NetworkRule) {
+		for _, rule := range candidates {
+			if rule.Matches(req) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	for host := req.Host; host != ""; host = parentDomain(host) {
+		collect(x.byHost[host])
+	}
+	for i, token := range tokens {
+		if !containsToken(tokens[:i], token) {
+			collect(x.byToken[token])
+		}
+	}
+	collect(x.generic)
+	return rules
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+func firstMatch(rules []*NetworkRule, req Request) *NetworkRule {
+	for _, rule := range rules {
+		if rule.Matches(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// globMatch matches s against an ABP pattern where '*' is any run and '^' is a separator or the end.
+func globMatch(p, s string) bool {
+	pi, si := 0, 0
+	starP, starS := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			starP, starS = pi, si
+			pi++
+		case pi < len(p) && (p[pi] == s[si] || (p[pi] == '^' && isSeparator(s[si]))):
+			pi++
+			si++
+		case starP >= 0:
+			pi = starP + 1
+			starS++
+			si = starS
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	if pi < len(p) && p[pi] == '^' {
+		pi++
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+func isSeparator(c byte) bool {
+	if isTokenChar(c) {
+		return false
+	}
+	switch c {
+	case '_', '-', '.', '%':
+		return false
+	}
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func urlTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		if !isTokenChar(s[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isTokenChar(s[j]) {
+			j++
+		}
+		if j-i >= 2 {
+			tokens = append(tokens, s[i:j])
+		}
+		i = j
+	}
+	return tokens
+}
+
+// optionsIndex finds the '$' that starts the options section, ignoring '$' inside regex rules.
+func optionsIndex(line string) int {
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return -1
+	}
+	return strings.LastIndex(line, "$")
+}
+
+func isCosmetic(line string) bool {
+	for _, marker := range []string{"##", "#@#", "#?#", "#$#", "#@$#", "#@?#"} {
+		if strings.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func parentDomain(host string) string {
+	idx := strings.IndexByte(host, '.')
+	if idx == -1 {
+		return ""
+	}
+	return host[idx+1:]
+}
+
+func isSubdomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// SameSite reports whether two hosts share a registrable domain according to the Public Suffix List.
+func SameSite(a, b string) bool {
+	return blocklist.SameSite(normalize(a), normalize(b))
+}
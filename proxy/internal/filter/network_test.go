@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNetworkEngineMatchesABPRules(t *testing.T) {
+	engine := NewNetworkEngine([]string{
+		"! comment",
+		"example.com##.ad-banner",
+		"/ads/banner.js",
+		"||tracker.example^$third-party",
+		"||cdn.example.net/pixel^$image",
+		"||widgets.example.org^$script,domain=news.example.com|~blog.news.example.com",
+		"|https://exact.example.com/path|",
+		"/\\/track\\d+\\.gif/",
+	})
+
+	tests := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{"path rule anywhere", Request{URL: "http://site.test/static/ads/banner.js", Host: "site.test", Type: TypeScript}, true},
+		{"path rule does not block host", Request{URL: "http://site.test/static/app.js", Host: "site.test", Type: TypeScript}, false},
+		{"third-party from other site", Request{URL: "https://tracker.example/collect", Host: "tracker.example", Type: TypeXMLHTTPRequest, SourceHost: "news.example.com"}, true},
+		{"third-party rule skips first-party", Request{URL: "https://tracker.example/collect", Host: "tracker.example", Type: TypeXMLHTTPRequest, SourceHost: "www.tracker.example"}, false},
+		{"image type matches", Request{URL: "https://img.cdn.example.net/pixel?id=1", Host: "img.cdn.example.net", Type: TypeImage}, true},
+		{"image rule skips scripts", Request{URL: "https://img.cdn.example.net/pixel?id=1", Host: "img.cdn.example.net", Type: TypeScript}, false},
+		{"domain option include", Request{URL: "https://widgets.example.org/w.js", Host: "widgets.example.org", Type: TypeScript, SourceHost: "news.example.com"}, true},
+		{"domain option exclude", Request{URL: "https://widgets.example.org/w.js", Host: "widgets.example.org", Type: TypeScript, SourceHost: "blog.news.example.com"}, false},
+		{"domain option other site", Request{URL: "https://widgets.example.org/w.js", Host: "widgets.example.org", Type: TypeScript, SourceHost: "shop.example.com"}, false},
+		{"anchored both ends", Request{URL: "https://exact.example.com/path", Host: "exact.example.com", Type: TypeOther}, true},
+		{"anchored end rejects suffix", Request{URL: "https://exact.example.com/path/more", Host: "exact.example.com", Type: TypeOther}, false},
+		{"regex rule", Request{URL: "http://stats.test/track42.gif", Host: "stats.test", Type: TypeImage}, true},
+		{"documents need explicit type", Request{URL: "http://site.test/ads/banner.js", Host: "site.test", Type: TypeDocument}, false},
+	}
+
+	for _, tc := range tests {
+		if got := engine.Match(tc.req) != nil; got != tc.want {
+			t.Errorf("%s: Match(%s) = %v, want %v", tc.name, tc.req.URL, got, tc.want)
+		}
+	}
+}
+
+func TestDomainAnchorRespectsLabelBoundaries(t *testing.T) {
+	engine := NewNetworkEngine([]string{"||ads.example.com^$script"})
+
+	if engine.Match(Request{URL: "https://cdn.ads.example.com/a.js", Host: "cdn.ads.example.com", Type: TypeScript}) == nil {
+		t.Fatalf("expected subdomain to match")
+	}
+	if engine.Match(Request{URL: "https://badads.example.com/a.js", Host: "badads.example.com", Type: TypeScript}) != nil {
+		t.Fatalf("did not expect partial label to match")
+	}
+}
+
+func TestWildcardSubdomainRules(t *testing.T) {
+	engine := NewNetworkEngine([]string{"||*.tracker.example^", "||*pixel.example/collect"})
+
+	if engine.Match(Request{URL: "https://cdn.tracker.example/t.js", Host: "cdn.tracker.example", Type: TypeScript}) == nil {
+		t.Fatalf("expected subdomain to match ||*.tracker.example^")
+	}
+	if engine.Match(Request{URL: "https://tracker.example/t.js", Host: "tracker.example", Type: TypeScript}) != nil {
+		t.Fatalf("did not expect the bare domain to match ||*.tracker.example^")
+	}
+	if engine.Match(Request{URL: "https://eu.mypixel.example/collect", Host: "eu.mypixel.example", Type: TypeImage}) == nil {
+		t.Fatalf("expected a wildcard host prefix to match anywhere in the host")
+	}
+}
+
+func TestInferRequestType(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		path   string
+		want   RequestType
+	}{
+		{http.Header{"Sec-Fetch-Dest": []string{"script"}}, "/a", TypeScript},
+		{http.Header{"Sec-Fetch-Dest": []string{"iframe"}}, "/a", TypeSubdocument},
+		{http.Header{}, "/pixel.gif", TypeImage},
+		{http.Header{"Accept": []string{"text/html,application/xhtml+xml"}}, "/", TypeDocument},
+		{http.Header{"X-Requested-With": []string{"XMLHttpRequest"}}, "/api", TypeXMLHTTPRequest},
+		{http.Header{}, "/unknown", TypeOther},
+	}
+	for _, tc := range tests {
+		if got := InferRequestType(tc.header, tc.path); got != tc.want {
+			t.Errorf("InferRequestType(%v, %s) = %d, want %d", tc.header, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestNetworkEngineExceptions(t *testing.T) {
+	engine := NewNetworkEngine([]string{
+		"/ads/*",
+		"@@||cdn.example.com/ads/consent.js",
+		"||tracker.example^$important",
+		"@@||tracker.example^",
+	})
+
+	blocked := Request{URL: "https://news.example.org/ads/banner.js", Host: "news.example.org", Type: TypeScript}
+	if engine.Match(blocked) == nil {
+		t.Fatalf("expected block rule to match")
+	}
+	excepted := Request{URL: "https://cdn.example.com/ads/consent.js", Host: "cdn.example.com", Type: TypeScript}
+	if engine.Match(excepted) != nil {
+		t.Fatalf("expected exception to override block rule")
+	}
+	important := Request{URL: "https://tracker.example/p.gif", Host: "tracker.example", Type: TypeImage}
+	if engine.Match(important) == nil {
+		t.Fatalf("expected $important rule to beat the exception")
+	}
+}
+
+func TestRemoveParamRules(t *testing.T) {
+	engine := NewNetworkEngine([]string{
+		"$removeparam=ref_src",
+		"||shop.example^$removeparam=/^sessionTag=/",
+		"||news.example^$removeparam",
+		"@@||news.example/search^$removeparam=q",
+	})
+	query := []QueryParam{{"ref_src", "tw"}, {"sessionTag", "abc"}, {"q", "go"}}
+
+	tests := []struct {
+		url  string
+		host string
+		want []string
+	}{
+		{"https://site.test/?x", "site.test", []string{"ref_src"}},
+		{"https://shop.example/item?x", "shop.example", []string{"ref_src", "sessionTag"}},
+		{"https://news.example/story?x", "news.example", []string{"ref_src", "sessionTag", "q"}},
+		{"https://news.example/search?x", "news.example", []string{"ref_src", "sessionTag"}},
+	}
+	for _, tc := range tests {
+		got := engine.RemovedParams(Request{URL: tc.url, Host: tc.host, Type: TypeDocument}, query)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("RemovedParams(%s) = %v, want %v", tc.url, got, tc.want)
+		}
+	}
+	if engine.Match(Request{URL: "https://news.example/story", Host: "news.example", Type: TypeScript}) != nil {
+		t.Fatalf("$removeparam rules must not block requests")
+	}
+}
+
+func TestRedirectRules(t *testing.T) {
+	engine := NewNetworkEngine([]string{
+		"||ads.example.com^$script,redirect=noopjs",
+		"||metrics.example.net^$image,redirect-rule=1x1.gif:5",
+		"@@||ads.example.com^$redirect=noopjs",
+	})
+
+	script := Request{URL: "https://ads.example.com/tag.js", Host: "ads.example.com", Type: TypeScript}
+	rule := engine.Match(script)
+	if rule == nil || rule.Redirect() != "noopjs" {
+		t.Fatalf("expected $redirect rule to block with noopjs, got %+v", rule)
+	}
+
+	pixel := Request{URL: "https://metrics.example.net/p.gif", Host: "metrics.example.net", Type: TypeImage}
+	if engine.Match(pixel) != nil {
+		t.Fatalf("$redirect-rule must not block on its own")
+	}
+	if got := engine.Redirect(pixel); got != "1x1.gif" {
+		t.Fatalf("expected redirect-rule surrogate 1x1.gif, got %q", got)
+	}
+	if got := engine.Redirect(Request{URL: "https://site.test/a.js", Host: "site.test", Type: TypeScript}); got != "" {
+		t.Fatalf("expected no surrogate for unrelated request, got %q", got)
+	}
+}
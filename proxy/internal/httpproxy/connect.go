@@ -0,0 +1,211 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/payhole/proxy/internal/policy"
+)
+
+// helloPeekTimeout bounds how long a tunnel waits for the client to start its TLS handshake.
+const helloPeekTimeout = 5 * time.Second
+
+var errHelloCaptured = errors.New("client hello captured")
+
+// serveConnect answers CONNECT requests by splicing the client connection to the requested authority.
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	authority := r.Host
+	if authority == "" {
+		authority = r.URL.Host
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil || host == "" || port == "" {
+		http.Error(w, "CONNECT requires host:port", http.StatusBadRequest)
+		return
+	}
+	if s.loopsBack(host, port) {
+		respondLoopDetected(w)
+		return
+	}
+
+	// Premium hosts are still tunnelled when they will be intercepted, so the paywall
+	// page can be served over the decrypted connection instead of a bare 402.
+	intercepting := s.shouldIntercept(host)
+	decision := s.policy.Decide(host, r.RemoteAddr, r.Header.Get("Authorization"))
+	if !decision.Allow && !(intercepting && decision.Reason == policy.ReasonPremiumPayment) {
+		s.respondTunnelDenied(w, decision, host)
+		return
+	}
+	requiresInterception := !decision.Allow
+
+	// Dial before answering so an unreachable upstream is reported instead of a silent
+	// close. Intercepted tunnels reach the upstream through the transport instead.
+	var upstream net.Conn
+	if !intercepting {
+		if upstream, err = s.dialer.DialContext(r.Context(), "tcp", net.JoinHostPort(host, port)); err != nil {
+			s.respondDialError(w, host, err)
+			return
+		}
+		defer upstream.Close()
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusNotImplemented)
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "CONNECT not supported", http.StatusNotImplemented)
+		return
+	}
+	defer clientConn.Close()
+
+	// The http.Server deadlines outlive the hijack and would cut long-lived tunnels short.
+	_ = clientConn.SetDeadline(time.Time{})
+
+	if _, err := clientBuf.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	serverName, prefix := peekServerName(clientConn, clientBuf.Reader)
+	if serverName != "" && !strings.EqualFold(serverName, host) {
+		intercepting = intercepting && s.shouldIntercept(serverName)
+		sniDecision := s.policy.Decide(serverName, r.RemoteAddr, r.Header.Get("Authorization"))
+		if !sniDecision.Allow {
+			if !intercepting || sniDecision.Reason != policy.ReasonPremiumPayment {
+				return
+			}
+			requiresInterception = true
+		}
+	}
+
+	clientReader := io.MultiReader(bytes.NewReader(prefix), clientBuf.Reader)
+	if intercepting && len(prefix) > 0 {
+		s.serveIntercepted(clientConn, clientReader, authority, r)
+		return
+	}
+	if requiresInterception {
+		return
+	}
+
+	if upstream == nil {
+		// Interception was expected but did not happen, so the 200 is already sent and a
+		// failed dial can only be recorded, not reported.
+		if upstream, err = s.dialer.DialContext(r.Context(), "tcp", net.JoinHostPort(host, port)); err != nil {
+			var denied *policy.EgressError
+			if errors.As(err, &denied) {
+				s.policy.Record(host, denied.Reason)
+			}
+			return
+		}
+		defer upstream.Close()
+	}
+
+	splice(clientConn, clientReader, upstream)
+}
+
+// respondDialError answers a CONNECT whose upstream could not be reached: 403 when the
+// egress policy denied it, as for forwarded requests, 508 when it is this proxy, 504 when
+// the dial timed out and 502 otherwise.
+func (s *Server) respondDialError(w http.ResponseWriter, host string, err error) {
+	var denied *policy.EgressError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &denied):
+		s.policy.Record(host, denied.Reason)
+		http.Error(w, denied.Error(), http.StatusForbidden)
+	case errors.Is(err, errLoopDetected):
+		respondLoopDetected(w)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func (s *Server) respondTunnelDenied(w http.ResponseWriter, decision policy.Decision, host string) {
+	switch decision.Reason {
+	case policy.ReasonPremiumPayment:
+		// Browsers never render CONNECT error bodies, so only the x402 document is useful here.
+		s.respondPaymentRequirements(w, s.paymentRequirements("https://"+host+"/", host), "X-PAYMENT header is required")
+	case policy.ReasonAdBlocked:
+		http.Error(w, "blocked by PayHole filter", http.StatusForbidden)
+	default:
+		http.Error(w, "request blocked", http.StatusForbidden)
+	}
+}
+
+// peekServerName reads the TLS ClientHello from the client, if any, and returns its SNI
+// together with the bytes consumed so they can be replayed to the upstream.
+func peekServerName(conn net.Conn, reader *bufio.Reader) (string, []byte) {
+	_ = conn.SetReadDeadline(time.Now().Add(helloPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := reader.Peek(1)
+	if err != nil || first[0] != 0x16 {
+		// Not a TLS handshake record; tunnel the raw bytes untouched.
+		return "", nil
+	}
+
+	var consumed bytes.Buffer
+	var serverName string
+	sniffer := tls.Server(sniffConn{reader: io.TeeReader(reader, &consumed)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloCaptured
+		},
+	})
+	_ = sniffer.Handshake()
+	return strings.ToLower(serverName), consumed.Bytes()
+}
+
+// sniffConn is a read-only net.Conn that lets crypto/tls parse a ClientHello without replying.
+type sniffConn struct {
+	reader io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c sniffConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                       { return nil }
+func (c sniffConn) LocalAddr() net.Addr                { return nil }
+func (c sniffConn) RemoteAddr() net.Addr               { return nil }
+func (c sniffConn) SetDeadline(_ time.Time) error      { return nil }
+func (c sniffConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c sniffConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// splice copies bytes in both directions until either side finishes.
+func splice(client net.Conn, clientReader io.Reader, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(upstream, clientReader)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,109 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newConnectProxy(t *testing.T, blocked, premium []string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newTestProxy(t, testProxyOptions{blocked: blocked, premium: premium}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func openTunnel(t *testing.T, proxyAddr, authority string) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", authority, authority)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	return conn, resp
+}
+
+func TestConnectRejectsBlockedAndPremiumHosts(t *testing.T) {
+	proxy := newConnectProxy(t, []string{"ads.example.com"}, []string{"premium.example.com"})
+
+	tests := []struct {
+		authority string
+		want      int
+	}{
+		{"ads.example.com:443", http.StatusForbidden},
+		{"premium.example.com:443", http.StatusPaymentRequired},
+	}
+	for _, tc := range tests {
+		_, resp := openTunnel(t, proxy.Listener.Addr().String(), tc.authority)
+		if resp.StatusCode != tc.want {
+			t.Errorf("CONNECT %s: expected %d, got %d", tc.authority, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestConnectReportsUnreachableUpstream(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	authority := closed.Addr().String()
+	closed.Close()
+
+	proxy := newConnectProxy(t, nil, nil)
+	_, resp := openTunnel(t, proxy.Listener.Addr().String(), authority)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 for a refused upstream, got %d", resp.StatusCode)
+	}
+}
+
+func TestConnectTunnelsTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("tunnelled"))
+	}))
+	defer upstream.Close()
+
+	proxy := newConnectProxy(t, []string{"ads.example.com"}, nil)
+	conn, resp := openTunnel(t, proxy.Listener.Addr().String(), upstream.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for tunnel, got %d", resp.StatusCode)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	tunnelled, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("read tunnelled response: %v", err)
+	}
+	body, _ := io.ReadAll(tunnelled.Body)
+	if string(body) != "tunnelled" {
+		t.Fatalf("unexpected tunnelled body %q", string(body))
+	}
+}
+
+func TestConnectClosesTunnelForBlockedSNI(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer upstream.Close()
+
+	proxy := newConnectProxy(t, []string{"ads.example.com"}, nil)
+	conn, resp := openTunnel(t, proxy.Listener.Addr().String(), upstream.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for tunnel, got %d", resp.StatusCode)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "ads.example.com", InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err == nil {
+		t.Fatalf("expected handshake to fail for blocked SNI")
+	}
+}
@@ -0,0 +1,256 @@
+package httpproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/payhole/proxy/internal/filter"
+)
+
+const (
+	// maxCosmeticBody caps how much of an HTML response is buffered for injection; larger
+	// documents are streamed untouched.
+	maxCosmeticBody = 4 << 20
+	// maxCosmeticDecoded guards against compression bombs when decoding the buffered body.
+	maxCosmeticDecoded = 16 << 20
+)
+
+var (
+	headOpenTag   = regexp.MustCompile(`(?i)<head(?:\s[^>]*)?>`)
+	bodyOpenTag   = regexp.MustCompile(`(?i)<body[\s>]`)
+	htmlOpenTag   = regexp.MustCompile(`(?i)<html(?:\s[^>]*)?>`)
+	metaCSPTag    = regexp.MustCompile(`(?i)<meta[^>]+http-equiv\s*=\s*["']?content-security-policy`)
+	errNotEncoded = errors.New("unsupported content encoding")
+)
+
+// SetCosmeticFilter enables element hiding: matching CSS is injected into proxied HTML pages.
+func (s *Server) SetCosmeticFilter(engine *filter.CosmeticEngine) {
+	s.cosmetic = engine
+}
+
+// injectCosmetics adds the element hiding stylesheet for host to an HTML response, decoding
+// compressed bodies and adjusting Content-Security-Policy so the injected style may apply.
+// Any response it cannot safely rewrite is left exactly as received.
+func (s *Server) injectCosmetics(resp *http.Response, host string) {
+	if s.cosmetic.Len() == 0 || resp.StatusCode != http.StatusOK || !isHTMLResponse(resp.Header) {
+		return
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxCosmeticBody+1))
+	if err != nil || len(raw) > maxCosmeticBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		return
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+
+	document, err := decodeBody(resp.Header.Get("Content-Encoding"), raw)
+	if err != nil || metaCSPTag.Match(document) {
+		return
+	}
+	css := s.cosmetic.Stylesheet(host, document)
+	if css == "" {
+		return
+	}
+	nonce, err := allowInjectedStyle(resp.Header)
+	if err != nil {
+		return
+	}
+
+	document = injectStyle(document, css, nonce)
+	resp.Body = io.NopCloser(bytes.NewReader(document))
+	resp.ContentLength = int64(len(document))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(document)))
+	// The representation changed, so a strong validator would now be a lie.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+func isHTMLResponse(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// decodeBody undoes a single gzip, deflate or br content coding.
+func decodeBody(encoding string, raw []byte) ([]byte, error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return raw, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	case "deflate":
+		// RFC 9110 deflate is zlib-wrapped, but some servers send a raw DEFLATE stream.
+		if zr, err := zlib.NewReader(bytes.NewReader(raw)); err == nil {
+			reader = zr
+		} else {
+			reader = flate.NewReader(bytes.NewReader(raw))
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(raw))
+	default:
+		return nil, errNotEncoded
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxCosmeticDecoded+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxCosmeticDecoded {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", maxCosmeticDecoded)
+	}
+	return decoded, nil
+}
+
+// allowInjectedStyle makes every Content-Security-Policy on the response admit one inline
+// <style> element. Policies that already allow inline styles are left alone; the others get
+// a fresh nonce, which is returned so the element can carry it.
+func allowInjectedStyle(header http.Header) (string, error) {
+	policies := header.Values("Content-Security-Policy")
+	if len(policies) == 0 {
+		return "", nil
+	}
+
+	nonce := ""
+	rewritten := make([]string, 0, len(policies))
+	for _, value := range policies {
+		var parts []string
+		for _, policy := range strings.Split(value, ",") {
+			updated, needsNonce := addStyleNonce(policy, &nonce)
+			if needsNonce && nonce == "" {
+				return "", errors.New("nonce generation failed")
+			}
+			parts = append(parts, updated)
+		}
+		rewritten = append(rewritten, strings.Join(parts, ","))
+	}
+	header.Del("Content-Security-Policy")
+	for _, value := range rewritten {
+		header.Add("Content-Security-Policy", value)
+	}
+	return nonce, nil
+}
+
+// addStyleNonce adds a nonce source to the directive governing <style> elements in a single
+// serialized policy, generating *nonce on first use.
+func addStyleNonce(policy string, nonce *string) (string, bool) {
+	directives := strings.Split(policy, ";")
+	effective := -1
+	for _, name := range []string{"style-src-elem", "style-src", "default-src"} {
+		for i, directive := range directives {
+			fields := strings.Fields(directive)
+			if len(fields) > 0 && strings.EqualFold(fields[0], name) {
+				effective = i
+				break
+			}
+		}
+		if effective != -1 {
+			break
+		}
+	}
+	if effective == -1 {
+		return policy, false
+	}
+
+	fields := strings.Fields(directives[effective])
+	sources := fields[1:]
+	if allowsInline(sources) {
+		return policy, false
+	}
+	if *nonce == "" {
+		*nonce = newNonce()
+		if *nonce == "" {
+			return policy, true
+		}
+	}
+
+	var kept []string
+	for _, source := range sources {
+		if !strings.EqualFold(source, "'none'") {
+			kept = append(kept, source)
+		}
+	}
+	kept = append(kept, "'nonce-"+*nonce+"'")
+
+	if strings.EqualFold(fields[0], "default-src") {
+		// Leave default-src alone so scripts and other fetches keep their policy.
+		directives = append(directives, " style-src "+strings.Join(kept, " "))
+	} else {
+		directives[effective] = " " + fields[0] + " " + strings.Join(kept, " ")
+	}
+	return strings.TrimSpace(strings.Join(directives, ";")), true
+}
+
+// allowsInline reports whether a source list permits any inline style. 'unsafe-inline' is
+// ignored by browsers once a nonce or hash is present.
+func allowsInline(sources []string) bool {
+	inline := false
+	for _, source := range sources {
+		lower := strings.ToLower(source)
+		switch {
+		case lower == "'unsafe-inline'":
+			inline = true
+		case strings.HasPrefix(lower, "'nonce-"), strings.HasPrefix(lower, "'sha"):
+			return false
+		}
+	}
+	return inline
+}
+
+func newNonce() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(buf[:])
+}
+
+// injectStyle places the stylesheet at the start of <head>, or as early as the markup allows.
+func injectStyle(document []byte, css, nonce string) []byte {
+	var tag strings.Builder
+	tag.WriteString(`<style id="payhole-cosmetic"`)
+	if nonce != "" {
+		tag.WriteString(` nonce="` + html.EscapeString(nonce) + `"`)
+	}
+	tag.WriteString(">\n" + css + "</style>")
+
+	insertAt := 0
+	if loc := headOpenTag.FindIndex(document); loc != nil {
+		insertAt = loc[1]
+	} else if loc := bodyOpenTag.FindIndex(document); loc != nil {
+		insertAt = loc[0]
+	} else if loc := htmlOpenTag.FindIndex(document); loc != nil {
+		insertAt = loc[1]
+	}
+
+	out := make([]byte, 0, len(document)+tag.Len())
+	out = append(out, document[:insertAt]...)
+	out = append(out, tag.String()...)
+	return append(out, document[insertAt:]...)
+}
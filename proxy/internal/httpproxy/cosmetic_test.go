@@ -0,0 +1,136 @@
+package httpproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/payhole/proxy/internal/filter"
+)
+
+const cosmeticPage = `<!DOCTYPE html><html><head><title>News</title></head><body><div class="ad-banner"></div></body></html>`
+
+func newCosmeticProxy(t *testing.T, respond func() *http.Response) *Server {
+	t.Helper()
+	proxy := newTestProxy(t, testProxyOptions{transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return respond(), nil
+	})})
+	proxy.SetCosmeticFilter(filter.NewCosmeticEngine([]string{"##.ad-banner", "news.example.com##.cookie-wall"}))
+	return proxy
+}
+
+func htmlResponse(body []byte, header http.Header) *http.Response {
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func TestProxyInjectsElementHidingIntoCompressedHTML(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(cosmeticPage))
+	_ = zw.Close()
+
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	_, _ = bw.Write([]byte(cosmeticPage))
+	_ = bw.Close()
+
+	for encoding, body := range map[string][]byte{"gzip": gz.Bytes(), "br": br.Bytes(), "": []byte(cosmeticPage)} {
+		proxy := newCosmeticProxy(t, func() *http.Response {
+			header := http.Header{"Etag": []string{`"v1"`}}
+			if encoding != "" {
+				header.Set("Content-Encoding", encoding)
+			}
+			return htmlResponse(body, header)
+		})
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://news.example.com/", nil))
+
+		got := resp.Body.String()
+		if !strings.Contains(got, `<head><style id="payhole-cosmetic">`) || !strings.Contains(got, ".cookie-wall") || !strings.Contains(got, ".ad-banner") {
+			t.Fatalf("%q: expected stylesheet injected into <head>, got %s", encoding, got)
+		}
+		if resp.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%q: expected decoded body, got Content-Encoding %q", encoding, resp.Header().Get("Content-Encoding"))
+		}
+		if resp.Header().Get("Content-Length") != strconv.Itoa(len(got)) {
+			t.Fatalf("%q: Content-Length %s does not match body length %d", encoding, resp.Header().Get("Content-Length"), len(got))
+		}
+		if resp.Header().Get("Etag") != `W/"v1"` {
+			t.Fatalf("%q: expected weakened ETag, got %q", encoding, resp.Header().Get("Etag"))
+		}
+	}
+}
+
+func TestProxyAddsCSPNonceForInjectedStyle(t *testing.T) {
+	tests := []struct {
+		csp      string
+		wantCSP  string
+		useNonce bool
+	}{
+		{"default-src 'self'; style-src 'self' 'unsafe-inline'", "default-src 'self'; style-src 'self' 'unsafe-inline'", false},
+		{"default-src 'self'; style-src 'self'", "default-src 'self'; style-src 'self' 'nonce-NONCE'", true},
+		{"default-src 'none'; img-src *", "default-src 'none'; img-src *; style-src 'nonce-NONCE'", true},
+		{"script-src 'self'", "script-src 'self'", false},
+	}
+	for _, tc := range tests {
+		proxy := newCosmeticProxy(t, func() *http.Response {
+			return htmlResponse([]byte(cosmeticPage), http.Header{"Content-Security-Policy": []string{tc.csp}})
+		})
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://news.example.com/", nil))
+
+		nonce := ""
+		if m := regexp.MustCompile(`<style id="payhole-cosmetic" nonce="([^"]+)">`).FindStringSubmatch(resp.Body.String()); m != nil {
+			nonce = m[1]
+		}
+		if (nonce != "") != tc.useNonce {
+			t.Fatalf("CSP %q: nonce %q, want nonce=%v", tc.csp, nonce, tc.useNonce)
+		}
+		if got, want := resp.Header().Get("Content-Security-Policy"), strings.ReplaceAll(tc.wantCSP, "NONCE", nonce); got != want {
+			t.Fatalf("CSP %q rewritten to %q, want %q", tc.csp, got, want)
+		}
+	}
+}
+
+func TestProxyLeavesUnsupportedResponsesUntouched(t *testing.T) {
+	tests := map[string]func() *http.Response{
+		"json": func() *http.Response {
+			resp := htmlResponse([]byte(cosmeticPage), http.Header{})
+			resp.Header.Set("Content-Type", "application/json")
+			return resp
+		},
+		"no-transform": func() *http.Response {
+			return htmlResponse([]byte(cosmeticPage), http.Header{"Cache-Control": []string{"no-transform"}})
+		},
+		"meta csp": func() *http.Response {
+			page := strings.Replace(cosmeticPage, "<head>", `<head><meta http-equiv="Content-Security-Policy" content="style-src 'self'">`, 1)
+			return htmlResponse([]byte(page), http.Header{})
+		},
+		"unknown encoding": func() *http.Response {
+			return htmlResponse([]byte(cosmeticPage), http.Header{"Content-Encoding": []string{"zstd"}})
+		},
+	}
+	for name, respond := range tests {
+		proxy := newCosmeticProxy(t, respond)
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://news.example.com/", nil))
+		if strings.Contains(resp.Body.String(), "payhole-cosmetic") {
+			t.Errorf("%s: did not expect injection", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package httpproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/payhole/proxy/internal/policy"
+)
+
+func newEgressProxy(t *testing.T, allow []string) *Server {
+	t.Helper()
+	proxy := newTestProxy(t, testProxyOptions{})
+	egress, err := policy.NewEgress(allow, nil)
+	if err != nil {
+		t.Fatalf("NewEgress: %v", err)
+	}
+	proxy.SetEgressPolicy(egress)
+	return proxy
+}
+
+func TestProxyRefusesInternalUpstreamsAfterResolution(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "internal")
+	}))
+	defer internal.Close()
+	_, port, _ := net.SplitHostPort(internal.Listener.Addr().String())
+
+	proxy := newEgressProxy(t, nil)
+	// "localhost" is only refused once it resolves, the way a rebinding hostname would be.
+	for _, target := range []string{"http://127.0.0.1:" + port + "/webhooks/unlock", "http://localhost:" + port + "/"} {
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		if resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), string(policy.ReasonEgressLoopback)) {
+			t.Fatalf("%s: expected loopback egress denial, got %d %q", target, resp.Code, resp.Body.String())
+		}
+	}
+
+	allowed := newEgressProxy(t, []string{"127.0.0.1/32"})
+	resp := httptest.NewRecorder()
+	allowed.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:"+port+"/", nil))
+	if resp.Code != http.StatusOK || resp.Body.String() != "internal" {
+		t.Fatalf("expected allow-listed CIDR to be reachable, got %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+func TestConnectRefusesInternalUpstreams(t *testing.T) {
+	internal, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer internal.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := internal.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	srv := httptest.NewServer(newEgressProxy(t, nil))
+	defer srv.Close()
+	_, resp := openTunnel(t, srv.Listener.Addr().String(), internal.Addr().String())
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), string(policy.ReasonEgressLoopback)) {
+		t.Fatalf("expected loopback egress denial, got %d %q", resp.StatusCode, body)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("internal listener should never receive a connection")
+	default:
+	}
+}
@@ -0,0 +1,237 @@
+package httpproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// viaPseudonym identifies this proxy in Via headers without revealing its host name.
+const viaPseudonym = "payhole"
+
+// errLoopDetected is returned by the dialer when an upstream address is one of the
+// proxy's own listeners.
+var errLoopDetected = errors.New("request would loop back to this proxy")
+
+// hopByHopHeaders apply to a single connection and must not be forwarded (RFC 9110 §7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// traceRedactedHeaders are left out of TRACE echoes so credentials are never reflected.
+var traceRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Payment"}
+
+// removeHopByHop deletes hop-by-hop headers and any header named in Connection.
+func removeHopByHop(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol requested by "Connection: Upgrade" plus "Upgrade", or "".
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// prepareHopHeaders strips hop-by-hop request headers while keeping what the next hop still
+// needs: the Upgrade handshake and a request for trailers.
+func prepareHopHeaders(h http.Header) {
+	upgrade := upgradeType(h)
+	trailers := false
+	for _, value := range h.Values("TE") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	removeHopByHop(h)
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("TE", "trailers")
+	}
+}
+
+// appendVia records this proxy as a recipient of a message received with the given protocol version.
+func appendVia(h http.Header, protoMajor, protoMinor int) {
+	received := fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, viaPseudonym)
+	if protoMajor == 0 && protoMinor == 0 {
+		received = "1.1 " + viaPseudonym
+	}
+	if prior := h.Get("Via"); prior != "" {
+		h.Set("Via", prior+", "+received)
+		return
+	}
+	h.Set("Via", received)
+}
+
+// answerMaxForwards handles Max-Forwards on TRACE and OPTIONS (RFC 9110 §7.6.2): a value of
+// zero is answered by the proxy itself and anything else is decremented. It reports whether a
+// response was written.
+func answerMaxForwards(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodTrace && r.Method != http.MethodOptions {
+		return false
+	}
+	raw := r.Header.Get("Max-Forwards")
+	if raw == "" {
+		return false
+	}
+	remaining, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || remaining < 0 {
+		return false
+	}
+	if remaining > 0 {
+		r.Header.Set("Max-Forwards", strconv.Itoa(remaining-1))
+		return false
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE, CONNECT")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+
+	echo := r.Clone(r.Context())
+	for _, name := range traceRedactedHeaders {
+		echo.Header.Del(name)
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "TRACE %s %s\r\n", r.RequestURI, r.Proto)
+	_ = echo.Header.Write(&body)
+	body.WriteString("\r\n")
+
+	w.Header().Set("Content-Type", "message/http")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body.Bytes())
+	return true
+}
+
+// SetListenAddrs records the addresses the proxy accepts connections on, so requests whose
+// target resolves back to one of them are refused with 508 instead of looping. Host names
+// are checked on the address actually dialed, which also catches DNS rebinding. Empty
+// addresses, such as an unset optional listener, are ignored.
+func (s *Server) SetListenAddrs(addrs ...string) {
+	listeners := make(map[string][]net.IP)
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		// A nil entry means the listener is bound to every local address.
+		var ip net.IP
+		if host != "" {
+			if ip = net.ParseIP(host); ip == nil {
+				resolved, err := net.LookupIP(host)
+				if err != nil || len(resolved) == 0 {
+					continue
+				}
+				ip = resolved[0]
+			}
+			if ip.IsUnspecified() {
+				ip = nil
+			}
+		}
+		listeners[port] = append(listeners[port], ip)
+	}
+
+	var local []net.IP
+	if ifaceAddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range ifaceAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				local = append(local, ipNet.IP)
+			}
+		}
+	}
+	s.listeners = listeners
+	s.localIPs = local
+}
+
+// loopsBack reports whether host:port is one of the proxy's own listeners. Host names
+// are not resolved here; checkDial catches them once they resolve.
+func (s *Server) loopsBack(host, port string) bool {
+	bound, ok := s.listeners[port]
+	target := net.ParseIP(host)
+	if !ok || target == nil {
+		return false
+	}
+	for _, listener := range bound {
+		if listener == nil && s.isLocalIP(target) || listener != nil && listener.Equal(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDial is the upstream dialer's Control hook. It runs on every resolved address, so
+// loops and egress denials are caught without a lookup of their own.
+func (s *Server) checkDial(network, address string, raw syscall.RawConn) error {
+	if host, port, err := net.SplitHostPort(address); err == nil && s.loopsBack(host, port) {
+		return errLoopDetected
+	}
+	if s.egress != nil {
+		return s.egress.Control(network, address, raw)
+	}
+	return nil
+}
+
+func (s *Server) isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, local := range s.localIPs {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetPort returns the port a proxied request will be sent to.
+func targetPort(r *http.Request) string {
+	u := absoluteURL(r)
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") || strings.EqualFold(u.Scheme, "wss") {
+		return "443"
+	}
+	return "80"
+}
+
+func respondLoopDetected(w http.ResponseWriter) {
+	http.Error(w, errLoopDetected.Error(), http.StatusLoopDetected)
+}
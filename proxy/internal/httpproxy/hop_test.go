@@ -0,0 +1,166 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/payhole/proxy/internal/privacy"
+)
+
+func newHopProxy(t *testing.T, transport http.RoundTripper) *Server {
+	t.Helper()
+	return newTestProxy(t, testProxyOptions{transport: transport})
+}
+
+func TestProxyStripsHopByHopHeadersBothWays(t *testing.T) {
+	var forwarded http.Header
+	proxy := newHopProxy(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwarded = r.Header.Clone()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Connection":     []string{"close, X-Upstream-Hop"},
+				"Keep-Alive":     []string{"timeout=5"},
+				"X-Upstream-Hop": []string{"secret"},
+				"Content-Type":   []string{"text/plain"},
+			},
+			Body: io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}))
+	headers, _ := privacy.Profile("off")
+	proxy.SetHeaderPolicy(headers)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("TE", "trailers, deflate")
+	req.Header.Set("Via", "1.0 corp-proxy")
+	req.Header.Set("X-End-To-End", "kept")
+	resp := httptest.NewRecorder()
+	proxy.ServeHTTP(resp, req)
+
+	for _, name := range []string{"Connection", "X-Client-Hop", "Proxy-Connection", "Keep-Alive"} {
+		if forwarded.Get(name) != "" {
+			t.Fatalf("expected %s to be stripped upstream, got %q", name, forwarded.Get(name))
+		}
+	}
+	if forwarded.Get("TE") != "trailers" || forwarded.Get("X-End-To-End") != "kept" {
+		t.Fatalf("unexpected forwarded headers: %v", forwarded)
+	}
+	if via := forwarded.Get("Via"); via != "1.0 corp-proxy, 1.1 payhole" {
+		t.Fatalf("expected Via to be appended, got %q", via)
+	}
+
+	result := resp.Result()
+	for _, name := range []string{"Connection", "Keep-Alive", "X-Upstream-Hop"} {
+		if result.Header.Get(name) != "" {
+			t.Fatalf("expected %s to be stripped downstream, got %q", name, result.Header.Get(name))
+		}
+	}
+	if via := result.Header.Get("Via"); via != "1.1 payhole" {
+		t.Fatalf("expected response Via, got %q", via)
+	}
+}
+
+func TestProxyOmitsViaWhenAnonymizing(t *testing.T) {
+	var forwarded http.Header
+	proxy := newHopProxy(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwarded = r.Header.Clone()
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Via", "1.0 corp-proxy")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if via := forwarded.Get("Via"); via != "" {
+		t.Fatalf("expected no Via under the default profile, got %q", via)
+	}
+}
+
+func TestProxyAnswersMaxForwardsZero(t *testing.T) {
+	var upstream int
+	var forwardedMax string
+	proxy := newHopProxy(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		upstream++
+		forwardedMax = r.Header.Get("Max-Forwards")
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}))
+
+	trace := httptest.NewRequest(http.MethodTrace, "http://example.com/path", nil)
+	trace.Header.Set("Max-Forwards", "0")
+	trace.Header.Set("Cookie", "session=secret")
+	trace.Header.Set("X-Debug", "yes")
+	resp := httptest.NewRecorder()
+	proxy.ServeHTTP(resp, trace)
+	body := resp.Body.String()
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "message/http" {
+		t.Fatalf("expected local TRACE echo, got %d %q", resp.Code, resp.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(body, "TRACE http://example.com/path") || !strings.Contains(body, "X-Debug: yes") || strings.Contains(body, "secret") {
+		t.Fatalf("unexpected TRACE echo: %q", body)
+	}
+
+	options := httptest.NewRequest(http.MethodOptions, "http://example.com/", nil)
+	options.Header.Set("Max-Forwards", "0")
+	resp = httptest.NewRecorder()
+	proxy.ServeHTTP(resp, options)
+	if resp.Code != http.StatusOK || resp.Header().Get("Allow") == "" {
+		t.Fatalf("expected local OPTIONS answer, got %d", resp.Code)
+	}
+	if upstream != 0 {
+		t.Fatalf("expected Max-Forwards 0 requests to stay local, forwarded %d", upstream)
+	}
+
+	options.Header.Set("Max-Forwards", "3")
+	proxy.ServeHTTP(httptest.NewRecorder(), options)
+	if upstream != 1 || forwardedMax != "2" {
+		t.Fatalf("expected decremented Max-Forwards upstream, got %d %q", upstream, forwardedMax)
+	}
+}
+
+func TestProxyRejectsRequestsLoopingBackToItself(t *testing.T) {
+	var upstream int
+	proxy := newHopProxy(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		upstream++
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}))
+	proxy.SetListenAddrs(":8080", "127.0.0.1:8443", "")
+
+	for _, target := range []string{"http://127.0.0.1:8080/", "http://127.0.0.1:8443/dns-query"} {
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		if resp.Code != http.StatusLoopDetected {
+			t.Fatalf("expected 508 for %s, got %d", target, resp.Code)
+		}
+	}
+
+	// Host names are only caught once the dialer has resolved them.
+	dialing := newHopProxy(t, nil)
+	dialing.SetListenAddrs(":8080")
+	resp := httptest.NewRecorder()
+	dialing.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil))
+	if resp.Code != http.StatusLoopDetected {
+		t.Fatalf("expected 508 for a name resolving to the proxy, got %d", resp.Code)
+	}
+
+	connect := httptest.NewRequest(http.MethodConnect, "http://127.0.0.1:8080", nil)
+	connect.Host = "127.0.0.1:8080"
+	resp = httptest.NewRecorder()
+	proxy.ServeHTTP(resp, connect)
+	if resp.Code != http.StatusLoopDetected {
+		t.Fatalf("expected 508 for CONNECT, got %d", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	proxy.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:9090/", nil))
+	if resp.Code != http.StatusOK || upstream != 1 {
+		t.Fatalf("expected other ports to be forwarded, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,117 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/intercept"
+)
+
+// EnableInterception terminates tunnelled TLS with leaf certificates minted by ca so that
+// HTTPS requests run through the same pipeline as plain HTTP. Hosts in bypass are never intercepted.
+func (s *Server) EnableInterception(ca *intercept.Authority, bypass blocklist.List) {
+	s.authority = ca
+	s.bypass = bypass
+}
+
+func (s *Server) shouldIntercept(hosts ...string) bool {
+	if s.authority == nil {
+		return false
+	}
+	for _, host := range hosts {
+		if host != "" && s.bypass != nil && s.bypass.Contains(host) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveIntercepted completes the client's TLS handshake locally and serves the decrypted
+// requests through ServeHTTP as if they had been sent to the proxy in absolute form.
+func (s *Server) serveIntercepted(client net.Conn, reader io.Reader, authority string, connect *http.Request) {
+	host, port, _ := net.SplitHostPort(authority)
+	target := authority
+	if port == "443" {
+		target = host
+	}
+
+	closed := make(chan struct{})
+	conn := &replayConn{Conn: client, reader: reader, closed: closed}
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: s.authority.GetCertificate(host),
+		NextProtos:     []string{"http/1.1"},
+	})
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = target
+			// Inner requests belong to the client resolved for the CONNECT, not the raw peer.
+			r.RemoteAddr = connect.RemoteAddr
+			s.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithoutCancel(connect.Context())
+		},
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		IdleTimeout:       s.timeouts.Idle,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	_ = srv.Serve(&singleConnListener{conn: tlsConn, closed: closed})
+}
+
+// replayConn replays bytes consumed while sniffing the ClientHello before reading from the client.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *replayConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// singleConnListener hands a single connection to http.Server and reports closure once it is done.
+type singleConnListener struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "tunnel" }
@@ -0,0 +1,103 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/intercept"
+)
+
+func newInterceptingProxy(t *testing.T, transport http.RoundTripper, bypass []string) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	certPEM, keyPEM, err := intercept.GenerateCA("test CA")
+	if err != nil {
+		t.Fatalf("generate CA: %v", err)
+	}
+	ca, err := intercept.NewAuthority(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load CA: %v", err)
+	}
+
+	proxy := newTestProxy(t, testProxyOptions{premium: []string{"premium.example.com"}, transport: transport})
+	proxy.EnableInterception(ca, blocklist.New(bypass))
+
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	return srv, roots
+}
+
+func interceptedGet(t *testing.T, proxyAddr, authority, serverName string, roots *x509.CertPool) *http.Response {
+	t.Helper()
+	conn, resp := openTunnel(t, proxyAddr, authority)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel to open, got %d", resp.StatusCode)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, RootCAs: roots})
+	fmt.Fprintf(tlsConn, "GET /article?id=1 HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", serverName)
+	result, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("read intercepted response: %v", err)
+	}
+	return result
+}
+
+func TestInterceptionServesPaywallOverTLS(t *testing.T) {
+	proxy, roots := newInterceptingProxy(t, nil, nil)
+
+	resp := interceptedGet(t, proxy.Listener.Addr().String(), "premium.example.com:443", "premium.example.com", roots)
+	if resp.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("expected 402, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "PayHole Unlock Required") {
+		t.Fatalf("expected paywall page, got %s", string(body))
+	}
+}
+
+func TestInterceptionForwardsDecryptedRequests(t *testing.T) {
+	var forwarded string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwarded = r.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		}, nil
+	})
+	proxy, roots := newInterceptingProxy(t, transport, nil)
+
+	resp := interceptedGet(t, proxy.Listener.Addr().String(), "news.example.com:443", "news.example.com", roots)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if forwarded != "https://news.example.com/article?id=1" {
+		t.Fatalf("unexpected forwarded URL %q", forwarded)
+	}
+}
+
+func TestInterceptionSkipsBypassedHosts(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("direct"))
+	}))
+	defer upstream.Close()
+
+	proxy, _ := newInterceptingProxy(t, nil, []string{"bank.example.com"})
+	upstreamRoots := upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	resp := interceptedGet(t, proxy.Listener.Addr().String(), upstream.Listener.Addr().String(), "bank.example.com", upstreamRoots)
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "direct" {
+		t.Fatalf("expected bypassed host to be tunnelled untouched, got %q", string(body))
+	}
+}
@@ -3,41 +3,157 @@ package httpproxy
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/skip2/go-qrcode"
 
+	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/clientip"
+	"github.com/payhole/proxy/internal/filter"
+	"github.com/payhole/proxy/internal/intercept"
 	"github.com/payhole/proxy/internal/policy"
+	"github.com/payhole/proxy/internal/privacy"
+	"github.com/payhole/proxy/internal/rewrite"
+	"github.com/payhole/proxy/internal/surrogate"
+	"github.com/payhole/proxy/internal/x402"
 )
 
 // Server implements an HTTP proxy with premium enforcement.
 type Server struct {
 	transport http.RoundTripper
+	dialer    *net.Dialer
 	policy    *policy.Policy
+	authority *intercept.Authority
+	bypass    blocklist.List
+	network   *filter.NetworkEngine
+	terms     x402.Terms
+	headers   privacy.HeaderPolicy
+	rewriter  *rewrite.Rewriter
+	cookies   privacy.CookiePolicy
+	// surrogates answers blocked subresources with neutral stand-ins instead of a 403.
+	surrogates bool
+	cosmetic   *filter.CosmeticEngine
+	timeouts   Timeouts
+	// listeners maps each listening port to its bound IPs (nil for all interfaces) and
+	// localIPs lists this host's addresses, for refusing requests that loop back.
+	listeners map[string][]net.IP
+	localIPs  []net.IP
+	egress    *policy.Egress
+}
+
+// Timeouts bounds each phase of a proxied exchange; zero disables a limit. Body transfer is
+// deliberately never capped, so event streams, long polls, large downloads and slow uploads
+// run for as long as both ends keep the connection open.
+type Timeouts struct {
+	// ReadHeader limits how long a client may take to send request headers.
+	ReadHeader time.Duration
+	// Idle closes keep-alive client connections after this long without a request.
+	Idle time.Duration
+	// Connect limits dialing an upstream, for forwarded requests and CONNECT tunnels.
+	Connect time.Duration
+	// ResponseHeader limits the wait for an upstream's response headers (time to first byte).
+	ResponseHeader time.Duration
+	// UpgradeIdle closes upgraded (WebSocket) connections after this long without traffic.
+	UpgradeIdle time.Duration
+	// UpgradeMaxLifetime closes upgraded connections after this long regardless of traffic.
+	UpgradeMaxLifetime time.Duration
+}
+
+// DefaultTimeouts returns the timeouts used when none are configured.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		ReadHeader:         15 * time.Second,
+		Idle:               120 * time.Second,
+		Connect:            10 * time.Second,
+		ResponseHeader:     60 * time.Second,
+		UpgradeIdle:        5 * time.Minute,
+		UpgradeMaxLifetime: 24 * time.Hour,
+	}
 }
 
 // NewServer constructs a Server with an optional custom transport.
 func NewServer(p *policy.Policy, transport http.RoundTripper) *Server {
+	timeouts := DefaultTimeouts()
+	dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}
 	if transport == nil {
-		transport = http.DefaultTransport
+		// Dial through the server's dialer so the connect timeout applies to forwarded requests too.
+		defaultTransport := http.DefaultTransport.(*http.Transport).Clone()
+		defaultTransport.DialContext = dialer.DialContext
+		transport = defaultTransport
 	}
-	return &Server{
+	s := &Server{
 		transport: transport,
+		dialer:    dialer,
 		policy:    p,
+		headers:   privacy.Default(),
+		timeouts:  timeouts,
 	}
+	dialer.Control = s.checkDial
+	return s
+}
+
+// SetTimeouts configures the per-phase timeouts. It must be called before serving traffic.
+func (s *Server) SetTimeouts(timeouts Timeouts) {
+	s.timeouts = timeouts
+	s.dialer.Timeout = timeouts.Connect
+}
+
+// Timeouts returns the configured per-phase timeouts, for building the listening http.Server.
+func (s *Server) Timeouts() Timeouts {
+	return s.timeouts
+}
+
+// SetEgressPolicy refuses upstream connections, forwarded or tunnelled, to addresses the
+// policy denies. The check runs on each resolved address as it is dialed.
+func (s *Server) SetEgressPolicy(egress *policy.Egress) {
+	s.egress = egress
+}
+
+// SetNetworkFilter enables URL-level ABP rules in addition to the host-based policy check.
+func (s *Server) SetNetworkFilter(engine *filter.NetworkEngine) {
+	s.network = engine
+}
+
+// SetPaymentTerms configures the x402 payment requirements advertised in 402 responses.
+func (s *Server) SetPaymentTerms(terms x402.Terms) {
+	s.terms = terms
+}
+
+// SetHeaderPolicy configures which identifying request headers are scrubbed before forwarding.
+func (s *Server) SetHeaderPolicy(headers privacy.HeaderPolicy) {
+	s.headers = headers
+}
+
+// SetCookiePolicy configures when Cookie and Set-Cookie are stripped on third-party requests.
+func (s *Server) SetCookiePolicy(cookies privacy.CookiePolicy) {
+	s.cookies = cookies
+}
+
+// SetSurrogates toggles serving built-in surrogate resources (empty script, transparent
+// pixel, blank frame, ...) for blocked subresources so pages do not break or retry.
+func (s *Server) SetSurrogates(enabled bool) {
+	s.surrogates = enabled
+}
+
+// SetRewriter enables tracking parameter stripping and redirect-wrapper unwrapping.
+func (s *Server) SetRewriter(rewriter *rewrite.Rewriter) {
+	s.rewriter = rewriter
 }
 
 // ServeHTTP enforces PayHole policy before forwarding requests upstream.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodConnect {
-		http.Error(w, "CONNECT not supported", http.StatusNotImplemented)
+		s.serveConnect(w, r)
 		return
 	}
 
@@ -46,37 +162,134 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing host", http.StatusBadRequest)
 		return
 	}
+	if s.loopsBack(host, targetPort(r)) {
+		respondLoopDetected(w)
+		return
+	}
+	if answerMaxForwards(w, r) {
+		return
+	}
+
+	// Redirect wrappers are answered locally so the click never reaches the tracking host;
+	// the destination goes through policy when the client follows the redirect.
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if destination, ok := s.rewriter.Unwrap(absoluteURL(r)); ok {
+			http.Redirect(w, r, destination, http.StatusFound)
+			return
+		}
+	}
+
+	var payment *x402.PaymentRequirements
+	paymentHeader := r.Header.Get(x402.PaymentHeader)
+	filterRequest := filter.RequestFromHTTP(r)
 
 	decision := s.policy.Decide(host, r.RemoteAddr, r.Header.Get("Authorization"))
 	if !decision.Allow {
-		switch decision.Reason {
-		case policy.ReasonPremiumPayment:
-			respondPremiumRequired(w, host, r.URL.String())
-		case policy.ReasonAdBlocked:
-			http.Error(w, "blocked by PayHole filter", http.StatusForbidden)
+		switch {
+		case decision.Reason == policy.ReasonPremiumPayment && paymentHeader != "":
+			requirements := s.paymentRequirements(resourceURL(r), host)
+			if err := s.policy.VerifyPayment(r.Context(), paymentHeader, requirements); err != nil {
+				s.respondPaymentRequirements(w, requirements, err.Error())
+				return
+			}
+			payment = &requirements
+		case decision.Reason == policy.ReasonPremiumPayment:
+			s.respondPremiumRequired(w, r, host)
+		case decision.Reason == policy.ReasonAdBlocked:
+			s.respondBlocked(w, r, filterRequest, nil)
 		default:
 			http.Error(w, "request blocked", http.StatusForbidden)
 		}
-		return
+		if payment == nil {
+			return
+		}
 	}
 
-	req := r.Clone(r.Context())
+	// Allowlisted hosts are exempt from URL rules as well as host rules.
+	if decision.Source != policy.SourceAllowlist {
+		if rule := s.network.Match(filterRequest); rule != nil {
+			s.policy.Record(host, policy.ReasonAdBlocked)
+			s.respondBlocked(w, r, filterRequest, rule)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	req := r.Clone(ctx)
 	req.RequestURI = ""
-	prepareForwardRequest(req)
+	prepareForwardRequest(req, s.headers)
+	s.rewriter.StripParams(req.URL, filterRequest)
+	// The source site comes from the original request, before Referer trimming.
+	stripCookies := s.cookies.Strip(host, filterRequest.SourceHost)
+	if stripCookies {
+		req.Header.Del("Cookie")
+	}
 
-	resp, err := s.transport.RoundTrip(req)
+	resp, err := s.roundTrip(req, cancel)
+	var denied *policy.EgressError
+	if errors.As(err, &denied) {
+		s.policy.Record(host, denied.Reason)
+		http.Error(w, denied.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errLoopDetected) {
+		respondLoopDetected(w)
+		return
+	}
+	if errors.Is(err, errUpstreamTimeout) {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
-	copyHeaders(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	_, copyErr := io.Copy(w, resp.Body)
-	if copyErr != nil && !errors.Is(copyErr, context.Canceled) {
-		// swallow copy errors to keep the proxy resilient
+	// Settle only once the upstream has produced a successful response, so clients are
+	// not charged for errors.
+	if payment != nil && resp.StatusCode < 400 {
+		settlement, err := s.policy.SettlePayment(r.Context(), paymentHeader, *payment)
+		if err != nil {
+			s.respondPaymentRequirements(w, *payment, err.Error())
+			return
+		}
+		if encoded, err := x402.EncodeSettlement(settlement); err == nil {
+			w.Header().Set(x402.PaymentResponseHeader, encoded)
+		}
+	}
+
+	if stripCookies {
+		resp.Header.Del("Set-Cookie")
 	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.serveUpgraded(w, r, resp)
+		return
+	}
+	if decision.Source != policy.SourceAllowlist && r.Method == http.MethodGet {
+		s.injectCosmetics(resp, host)
+	}
+	writeResponse(w, resp)
+}
+
+// respondBlocked serves a surrogate for a blocked subresource, preferring the one named by
+// the matching $redirect rule, and falls back to a plain 403.
+func (s *Server) respondBlocked(w http.ResponseWriter, r *http.Request, req filter.Request, rule *filter.NetworkRule) {
+	if s.surrogates {
+		name := ""
+		if rule != nil {
+			name = rule.Redirect()
+		}
+		if name == "" {
+			name = s.network.Redirect(req)
+		}
+		if res, ok := surrogate.Select(name, req.Type); ok {
+			res.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.Error(w, "blocked by PayHole filter", http.StatusForbidden)
 }
 
 func targetHost(r *http.Request) string {
@@ -93,33 +306,38 @@ func targetHost(r *http.Request) string {
 	return ""
 }
 
-func prepareForwardRequest(r *http.Request) {
+func prepareForwardRequest(r *http.Request, headers privacy.HeaderPolicy) {
+	prepareHopHeaders(r.Header)
 	r.Header.Del("Authorization")
 	r.Header.Del("Proxy-Authorization")
+	r.Header.Del(x402.PaymentHeader)
 
 	if r.ContentLength == 0 {
 		r.Body = nil
 	}
 
-	if r.URL.Scheme == "" {
-		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-			r.URL.Scheme = "ws"
-		} else {
-			r.URL.Scheme = "http"
-		}
+	// Upgrades travel as ordinary HTTP(S) requests; serveUpgraded takes over after the 101.
+	switch strings.ToLower(r.URL.Scheme) {
+	case "", "ws":
+		r.URL.Scheme = "http"
+	case "wss":
+		r.URL.Scheme = "https"
 	}
 
 	if r.URL.Host == "" {
 		r.URL.Host = r.Host
 	}
 
-	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && clientIP != "" {
-		prior := r.Header.Get("X-Forwarded-For")
-		if prior == "" {
-			r.Header.Set("X-Forwarded-For", clientIP)
-		} else {
-			r.Header.Set("X-Forwarded-For", prior+", "+clientIP)
-		}
+	// Behind a trusted load balancer the client is already in X-Forwarded-For; the
+	// balancer that connected to us is the next hop to record.
+	clientIP, _, err := net.SplitHostPort(clientip.Peer(r))
+	if err != nil {
+		clientIP = ""
+	}
+	headers.Apply(r.Header, r.URL, clientIP)
+	// Only a conventional, non-anonymizing proxy announces itself upstream.
+	if headers.Forwarding == privacy.ForwardingAppend {
+		appendVia(r.Header, r.ProtoMajor, r.ProtoMinor)
 	}
 }
 
@@ -131,8 +349,85 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
-func respondPremiumRequired(w http.ResponseWriter, host, requestURL string) {
-	payURL := fmt.Sprintf("https://payhole.app/pay?domain=%s", url.QueryEscape(host))
+// respondPremiumRequired negotiates between the HTML paywall for browsers and an x402
+// payment-requirements document for API clients, CLI tools and agents.
+func (s *Server) respondPremiumRequired(w http.ResponseWriter, r *http.Request, host string) {
+	if !acceptsHTML(r.Header.Get("Accept")) {
+		s.respondPaymentRequirements(w, s.paymentRequirements(resourceURL(r), host), "X-PAYMENT header is required")
+		return
+	}
+	respondPaywallPage(w, host, r.URL.String())
+}
+
+func (s *Server) paymentRequirements(resource, host string) x402.PaymentRequirements {
+	requirements := s.terms.Requirements(resource, fmt.Sprintf("PayHole premium unlock for %s", host))
+	requirements.MimeType = "text/html"
+	requirements.Extra = map[string]string{"checkoutUrl": checkoutURL(host)}
+	return requirements
+}
+
+func (s *Server) respondPaymentRequirements(w http.ResponseWriter, requirements x402.PaymentRequirements, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusPaymentRequired)
+	_ = json.NewEncoder(w).Encode(x402.PaymentRequiredResponse{
+		X402Version: x402.Version,
+		Error:       reason,
+		Accepts:     []x402.PaymentRequirements{requirements},
+	})
+}
+
+// acceptsHTML reports whether the client prefers an HTML page over JSON. Wildcards alone
+// (curl's "*/*") do not count; a missing Accept header keeps the historical HTML default.
+func acceptsHTML(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	var htmlQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			htmlQ = math.Max(htmlQ, q)
+		case "application/json":
+			jsonQ = math.Max(jsonQ, q)
+		}
+	}
+	return htmlQ > 0 && htmlQ >= jsonQ
+}
+
+func resourceURL(r *http.Request) string {
+	return absoluteURL(r).String()
+}
+
+// absoluteURL returns a copy of the request URL in absolute form.
+func absoluteURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return &u
+}
+
+func checkoutURL(host string) string {
+	return fmt.Sprintf("https://payhole.app/pay?domain=%s", url.QueryEscape(host))
+}
+
+func respondPaywallPage(w http.ResponseWriter, host, requestURL string) {
+	payURL := checkoutURL(host)
 	phantomURL := fmt.Sprintf("https://phantom.app/ul/browse/%s", url.QueryEscape(payURL))
 	solflareURL := fmt.Sprintf("https://solflare.com/provider?url=%s", url.QueryEscape(payURL))
 
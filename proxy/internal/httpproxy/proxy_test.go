@@ -1,6 +1,9 @@
 package httpproxy
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -11,8 +14,12 @@ import (
 	"github.com/payhole/proxy/internal/analytics"
 	"github.com/payhole/proxy/internal/auth"
 	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/filter"
 	"github.com/payhole/proxy/internal/policy"
+	"github.com/payhole/proxy/internal/privacy"
+	"github.com/payhole/proxy/internal/rewrite"
 	"github.com/payhole/proxy/internal/testutil"
+	"github.com/payhole/proxy/internal/x402"
 )
 
 type roundTripFunc func(*http.Request) (*http.Response, error)
@@ -21,6 +28,22 @@ func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
 	return f(r)
 }
 
+// testProxyOptions configures the Server built by newTestProxy.
+type testProxyOptions struct {
+	blocked   []string
+	premium   []string
+	transport http.RoundTripper
+}
+
+// newTestProxy builds a Server over a policy with the given lists, a JWT authorizer and an
+// empty unlock cache; feature tests layer their own setup on top.
+func newTestProxy(t *testing.T, opts testProxyOptions) *Server {
+	t.Helper()
+	authorizer, _ := auth.NewJWTAuthorizer("abcdefghijklmnopqrstuvwxyz1234567890abcdef")
+	p := policy.New(blocklist.New(opts.blocked), blocklist.New(opts.premium), authorizer, auth.NewIPCache(), analytics.NewClient(""))
+	return NewServer(p, opts.transport)
+}
+
 func TestProxyBlocksPremiumWithoutToken(t *testing.T) {
 	blocked := blocklist.New([]string{})
 	premium := blocklist.New([]string{"premium.example.com"})
@@ -80,3 +103,322 @@ func TestProxyAllowsPremiumWithValidToken(t *testing.T) {
 		t.Fatalf("expected Authorization header stripped, got %s", forwardedAuth)
 	}
 }
+
+func TestProxyAppliesNetworkFilterRules(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Header:     http.Header{},
+		}, nil
+	})
+	proxy := newTestProxy(t, testProxyOptions{transport: transport})
+	proxy.SetNetworkFilter(filter.NewNetworkEngine([]string{"/ads/banner.js", "||cdn.example.net^$third-party"}))
+
+	tests := []struct {
+		url     string
+		referer string
+		want    int
+	}{
+		{"http://news.example.com/ads/banner.js", "", http.StatusForbidden},
+		{"http://news.example.com/app.js", "", http.StatusOK},
+		{"http://cdn.example.net/lib.js", "http://news.example.com/", http.StatusForbidden},
+		{"http://cdn.example.net/lib.js", "http://www.example.net/", http.StatusOK},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.RemoteAddr = "203.0.113.10:12345"
+		if tc.referer != "" {
+			req.Header.Set("Referer", tc.referer)
+		}
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, req)
+		if resp.Code != tc.want {
+			t.Errorf("GET %s (referer %q): expected %d, got %d", tc.url, tc.referer, tc.want, resp.Code)
+		}
+	}
+}
+
+func TestProxyServesSurrogatesForBlockedSubresources(t *testing.T) {
+	proxy := newTestProxy(t, testProxyOptions{
+		blocked: []string{"ads.example.com"},
+		transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			t.Fatalf("blocked request should not be forwarded: %s", r.URL)
+			return nil, nil
+		}),
+	})
+	proxy.SetNetworkFilter(filter.NewNetworkEngine([]string{"/pixel/track^", "||cdn.example.org/widget.js$redirect=noopframe"}))
+	proxy.SetSurrogates(true)
+
+	tests := []struct {
+		url         string
+		accept      string
+		wantStatus  int
+		wantContent string
+	}{
+		{"http://ads.example.com/tag.js", "*/*", http.StatusOK, "application/javascript; charset=utf-8"},
+		{"http://ads.example.com/banner", "image/avif,image/webp,*/*", http.StatusOK, "image/gif"},
+		{"http://news.example.com/pixel/track?id=1", "image/*", http.StatusOK, "image/gif"},
+		{"http://cdn.example.org/widget.js", "*/*", http.StatusOK, "text/html; charset=utf-8"},
+		{"http://ads.example.com/", "text/html", http.StatusForbidden, "text/plain; charset=utf-8"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Set("Accept", tc.accept)
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, req)
+		if resp.Code != tc.wantStatus || resp.Header().Get("Content-Type") != tc.wantContent {
+			t.Errorf("GET %s: got %d %q, want %d %q", tc.url, resp.Code, resp.Header().Get("Content-Type"), tc.wantStatus, tc.wantContent)
+		}
+	}
+}
+
+func TestProxyRewritesTrackingURLs(t *testing.T) {
+	var forwarded string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwarded = r.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Header:     http.Header{},
+		}, nil
+	})
+	proxy := newTestProxy(t, testProxyOptions{transport: transport})
+	engine := filter.NewNetworkEngine([]string{"||shop.example.com^$removeparam=ref"})
+	proxy.SetNetworkFilter(engine)
+	proxy.SetRewriter(rewrite.New(engine, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "http://shop.example.com/item?id=4&utm_source=mail&ref=feed&fbclid=abc", nil)
+	resp := httptest.NewRecorder()
+	proxy.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	if forwarded != "http://shop.example.com/item?id=4" {
+		t.Fatalf("expected tracking parameters to be stripped, forwarded %s", forwarded)
+	}
+
+	forwarded = ""
+	req = httptest.NewRequest(http.MethodGet, "http://www.google.com/url?q=https%3A%2F%2Fnews.example.com%2Fstory%3Futm_medium%3Dsocial", nil)
+	resp = httptest.NewRecorder()
+	proxy.ServeHTTP(resp, req)
+	if resp.Code != http.StatusFound {
+		t.Fatalf("expected 302 for redirect wrapper, got %d", resp.Code)
+	}
+	if got := resp.Header().Get("Location"); got != "https://news.example.com/story" {
+		t.Fatalf("unexpected unwrapped location %q", got)
+	}
+	if forwarded != "" {
+		t.Fatalf("redirect wrapper should not be contacted, forwarded %s", forwarded)
+	}
+}
+
+func TestProxyStripsThirdPartyTrackerCookies(t *testing.T) {
+	var sentCookie string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sentCookie = r.Header.Get("Cookie")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Header:     http.Header{"Set-Cookie": []string{"id=42"}},
+		}, nil
+	})
+	proxy := newTestProxy(t, testProxyOptions{transport: transport})
+	proxy.SetCookiePolicy(privacy.CookiePolicy{Mode: privacy.CookiesTrackers, Trackers: blocklist.New([]string{"metrics.example.net"})})
+
+	tests := []struct {
+		url     string
+		referer string
+		strip   bool
+	}{
+		{"http://cdn.metrics.example.net/p.gif", "http://news.example.co.uk/", true},
+		{"http://cdn.metrics.example.net/p.gif", "http://www.metrics.example.net/", false},
+		{"http://cdn.metrics.example.net/p.gif", "", false},
+		{"http://static.example.org/a.css", "http://news.example.co.uk/", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Set("Cookie", "id=41")
+		if tc.referer != "" {
+			req.Header.Set("Referer", tc.referer)
+		}
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, req)
+
+		if stripped := sentCookie == ""; stripped != tc.strip {
+			t.Errorf("GET %s (referer %q): Cookie forwarded %q, want stripped=%v", tc.url, tc.referer, sentCookie, tc.strip)
+		}
+		if stripped := resp.Header().Get("Set-Cookie") == ""; stripped != tc.strip {
+			t.Errorf("GET %s (referer %q): Set-Cookie stripped=%v, want %v", tc.url, tc.referer, stripped, tc.strip)
+		}
+	}
+}
+
+func TestProxyStripsCookiesForNonBlockedTrackerHosts(t *testing.T) {
+	blocked := []string{"ads.example.org"}
+	var sentCookie string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sentCookie = r.Header.Get("Cookie")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Header:     http.Header{"Set-Cookie": []string{"id=42"}},
+		}, nil
+	})
+	network := filter.NewNetworkEngine([]string{"||social.example.com/tr^"})
+	proxy := newTestProxy(t, testProxyOptions{blocked: blocked, transport: transport})
+	proxy.SetNetworkFilter(network)
+	proxy.SetCookiePolicy(privacy.CookiePolicy{
+		Mode:     privacy.CookiesTrackers,
+		Trackers: blocklist.Union(network.TrackerHosts(), blocklist.New(blocked)),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://connect.social.example.com/sdk.js", nil)
+	req.Header.Set("Cookie", "session=41")
+	req.Header.Set("Referer", "http://news.example.co.uk/story")
+	resp := httptest.NewRecorder()
+	proxy.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected the tracker host itself to stay reachable, got %d", resp.Code)
+	}
+	if sentCookie != "" {
+		t.Fatalf("expected Cookie to be stripped, upstream got %q", sentCookie)
+	}
+	if got := resp.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("expected Set-Cookie to be stripped, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://cdn.example.net/app.js", nil)
+	req.Header.Set("Cookie", "session=41")
+	req.Header.Set("Referer", "http://news.example.co.uk/story")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if sentCookie != "session=41" {
+		t.Fatalf("expected cookies to other third parties to be forwarded, got %q", sentCookie)
+	}
+}
+
+func TestProxyNegotiatesX402PaymentRequirements(t *testing.T) {
+	proxy := newTestProxy(t, testProxyOptions{premium: []string{"premium.example.com"}})
+	proxy.SetPaymentTerms(x402.Terms{
+		Network:    "solana-devnet",
+		Asset:      "USDCMint111111111111111111111111111111111",
+		PayTo:      "Treasury11111111111111111111111111111111",
+		Amount:     "5000000",
+		MaxTimeout: 2 * time.Minute,
+	})
+
+	tests := []struct {
+		accept   string
+		wantJSON bool
+	}{
+		{"application/json", true},
+		{"*/*", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json, text/html;q=0.5", true},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://premium.example.com/article?id=7", nil)
+		req.RemoteAddr = "203.0.113.10:12345"
+		req.Header.Set("Accept", tc.accept)
+
+		resp := httptest.NewRecorder()
+		proxy.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusPaymentRequired {
+			t.Fatalf("Accept %q: expected 402, got %d", tc.accept, resp.Code)
+		}
+		isJSON := strings.HasPrefix(resp.Header().Get("Content-Type"), "application/json")
+		if isJSON != tc.wantJSON {
+			t.Fatalf("Accept %q: expected JSON=%v, got content type %q", tc.accept, tc.wantJSON, resp.Header().Get("Content-Type"))
+		}
+		if !isJSON {
+			continue
+		}
+
+		var body x402.PaymentRequiredResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode x402 body: %v", err)
+		}
+		if body.X402Version != x402.Version || len(body.Accepts) != 1 {
+			t.Fatalf("unexpected x402 body %+v", body)
+		}
+		got := body.Accepts[0]
+		if got.Scheme != "exact" || got.Network != "solana-devnet" || got.MaxAmountRequired != "5000000" ||
+			got.PayTo != "Treasury11111111111111111111111111111111" || got.Asset != "USDCMint111111111111111111111111111111111" ||
+			got.Resource != "http://premium.example.com/article?id=7" || got.MaxTimeoutSeconds != 120 {
+			t.Fatalf("unexpected payment requirements %+v", got)
+		}
+	}
+}
+
+type stubFacilitator struct {
+	valid   bool
+	settled int
+}
+
+func (f *stubFacilitator) Verify(_ context.Context, _ string, _ x402.PaymentRequirements) (*x402.VerifyResponse, error) {
+	if !f.valid {
+		return &x402.VerifyResponse{IsValid: false, InvalidReason: "insufficient_funds"}, nil
+	}
+	return &x402.VerifyResponse{IsValid: true, Payer: "payer"}, nil
+}
+
+func (f *stubFacilitator) Settle(_ context.Context, _ string, requirements x402.PaymentRequirements) (*x402.SettleResponse, error) {
+	f.settled++
+	return &x402.SettleResponse{Success: true, Transaction: "sig123", Network: requirements.Network}, nil
+}
+
+func TestProxyAcceptsX402PaymentHeader(t *testing.T) {
+	facilitator := &stubFacilitator{valid: true}
+
+	var forwardedPayment string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwardedPayment = r.Header.Get(x402.PaymentHeader)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("premium")),
+			Header:     http.Header{},
+		}, nil
+	})
+	proxy := newTestProxy(t, testProxyOptions{premium: []string{"premium.example.com"}, transport: transport})
+	proxy.policy.SetPaymentFacilitator(facilitator)
+	proxy.SetPaymentTerms(x402.Terms{Network: "solana", Asset: "mint", PayTo: "treasury", Amount: "5000000"})
+
+	payment := base64.StdEncoding.EncodeToString([]byte(`{"x402Version":1,"scheme":"exact","network":"solana","payload":{}}`))
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://premium.example.com/article", nil)
+		req.RemoteAddr = "203.0.113.10:12345"
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set(x402.PaymentHeader, payment)
+		return req
+	}
+
+	resp := httptest.NewRecorder()
+	proxy.ServeHTTP(resp, newRequest())
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200 with valid payment, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if forwardedPayment != "" {
+		t.Fatalf("expected X-PAYMENT stripped before forwarding")
+	}
+	encoded := resp.Header().Get(x402.PaymentResponseHeader)
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || !strings.Contains(string(raw), `"transaction":"sig123"`) {
+		t.Fatalf("unexpected X-PAYMENT-RESPONSE %q", encoded)
+	}
+
+	facilitator.valid = false
+	resp = httptest.NewRecorder()
+	proxy.ServeHTTP(resp, newRequest())
+	if resp.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected 402 for rejected payment, got %d", resp.Code)
+	}
+	if !strings.Contains(resp.Body.String(), "insufficient_funds") {
+		t.Fatalf("expected rejection reason in body, got %s", resp.Body.String())
+	}
+	if facilitator.settled != 1 {
+		t.Fatalf("expected exactly one settlement, got %d", facilitator.settled)
+	}
+}
@@ -0,0 +1,148 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamBufferSize is the chunk size used when relaying response bodies.
+const streamBufferSize = 32 * 1024
+
+var errUpstreamTimeout = errors.New("upstream did not respond in time")
+
+// roundTrip forwards req, cancelling it through cancel when the upstream has not produced
+// response headers within the ResponseHeader timeout. The timer starts once the request
+// body has been sent, so neither slow uploads nor the response body are subject to it.
+func (s *Server) roundTrip(req *http.Request, cancel context.CancelFunc) (*http.Response, error) {
+	if s.timeouts.ResponseHeader <= 0 {
+		return s.transport.RoundTrip(req)
+	}
+	deadline := &headerDeadline{timeout: s.timeouts.ResponseHeader, cancel: cancel}
+	if req.Body == nil || req.Body == http.NoBody {
+		deadline.start()
+	} else {
+		req.Body = &uploadBody{ReadCloser: req.Body, done: deadline.start}
+	}
+	resp, err := s.transport.RoundTrip(req)
+	if deadline.stop() {
+		// The request context is already cancelled, so a late response is unusable.
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return nil, errUpstreamTimeout
+	}
+	return resp, err
+}
+
+// headerDeadline cancels a request when response headers take longer than timeout to
+// arrive after start is called.
+type headerDeadline struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	expired bool
+}
+
+func (d *headerDeadline) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer == nil && !d.stopped {
+		d.timer = time.AfterFunc(d.timeout, d.expire)
+	}
+}
+
+func (d *headerDeadline) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.stopped {
+		d.expired = true
+		d.cancel()
+	}
+}
+
+// stop disarms the deadline and reports whether it had already expired.
+func (d *headerDeadline) stop() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	return d.expired
+}
+
+// uploadBody calls done once the request body has been fully read or closed.
+type uploadBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *uploadBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+// writeResponse relays resp to the client. Event streams and bodies of unknown length are
+// flushed after every write so clients see data as soon as the upstream sends it, and
+// trailers are forwarded once the body is complete.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	removeHopByHop(resp.Header)
+	appendVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	controller := http.NewResponseController(w)
+	flush := flushEachWrite(resp)
+	if flush {
+		// Push the headers out so event-stream clients see the connection open immediately.
+		_ = controller.Flush()
+	}
+
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			if flush && controller.Flush() != nil {
+				flush = false
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for key, values := range resp.Trailer {
+		for _, v := range values {
+			w.Header().Add(http.TrailerPrefix+key, v)
+		}
+	}
+}
+
+// flushEachWrite mirrors httputil.ReverseProxy: server-sent events and responses without a
+// declared length are streamed rather than buffered.
+func flushEachWrite(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
@@ -0,0 +1,157 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStreamingProxy(t *testing.T, timeouts Timeouts) *http.Client {
+	t.Helper()
+	proxy := newTestProxy(t, testProxyOptions{})
+	proxy.SetTimeouts(timeouts)
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+
+	proxyURL, _ := url.Parse(srv.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func TestProxyFlushesServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	client := newStreamingProxy(t, DefaultTimeouts())
+	resp, err := client.Get(upstream.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Fatalf("unexpected first event %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("first event was not flushed while the stream stayed open")
+	}
+}
+
+func TestProxyTimesOutSlowUpstreamHeadersOnly(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = io.WriteString(w, "late body")
+	}))
+	defer upstream.Close()
+
+	timeouts := DefaultTimeouts()
+	timeouts.ResponseHeader = 100 * time.Millisecond
+	client := newStreamingProxy(t, timeouts)
+
+	resp, err := client.Get(upstream.URL + "/slow-headers")
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 for slow upstream headers, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.Get(upstream.URL + "/slow-body")
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "late body" {
+		t.Fatalf("body transfer must not be subject to the header timeout, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestProxyHeaderTimeoutStartsAfterSlowUpload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaded, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(uploaded)
+	}))
+	defer upstream.Close()
+
+	timeouts := DefaultTimeouts()
+	timeouts.ResponseHeader = 300 * time.Millisecond
+	client := newStreamingProxy(t, timeouts)
+
+	body, upload := io.Pipe()
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(200 * time.Millisecond)
+			_, _ = io.WriteString(upload, "chunk ")
+		}
+		upload.Close()
+	}()
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/upload", body)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("POST through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	echoed, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(echoed) != strings.Repeat("chunk ", 5) {
+		t.Fatalf("a slow upload must not count against the header timeout, got %d %q", resp.StatusCode, echoed)
+	}
+}
+
+func TestProxyForwardsTrailersAndChunkedUploads(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaded, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write(uploaded)
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer upstream.Close()
+
+	client := newStreamingProxy(t, DefaultTimeouts())
+	body := io.MultiReader(strings.NewReader("chunk one, "), strings.NewReader("chunk two"))
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/upload", body)
+	req.ContentLength = -1
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("POST through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	echoed, _ := io.ReadAll(resp.Body)
+	if string(echoed) != "chunk one, chunk two" {
+		t.Fatalf("unexpected echoed upload %q", echoed)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Fatalf("expected trailer to be forwarded, got %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveUpgraded completes an HTTP Upgrade (typically WebSocket) once the upstream has agreed
+// with 101 Switching Protocols: the client connection is hijacked, sent the upstream's 101 and
+// relayed to the upstream stream until either side closes or a limit is reached.
+func (s *Server) serveUpgraded(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	requested := r.Header.Get("Upgrade")
+	granted := resp.Header.Get("Upgrade")
+	if !strings.EqualFold(requested, granted) {
+		http.Error(w, "upstream switched to an unexpected protocol", http.StatusBadGateway)
+		return
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "upstream connection cannot be upgraded", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	// Server deadlines would otherwise end long-lived sockets.
+	_ = clientConn.SetDeadline(time.Time{})
+
+	removeHopByHop(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", granted)
+	appendVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	handshake := &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     resp.Header,
+	}
+	if err := handshake.Write(clientBuf); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	s.relayUpgraded(clientConn, clientBuf.Reader, upstream)
+}
+
+// relayUpgraded copies bytes both ways, closing both ends when either direction finishes,
+// when no data has moved for UpgradeIdle, or once UpgradeMaxLifetime has elapsed.
+func (s *Server) relayUpgraded(client io.ReadWriteCloser, clientReader io.Reader, upstream io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = client.Close()
+			_ = upstream.Close()
+		})
+	}
+	defer closeBoth()
+
+	touch := func() {}
+	if idle := s.timeouts.UpgradeIdle; idle > 0 {
+		timer := time.AfterFunc(idle, closeBoth)
+		defer timer.Stop()
+		touch = func() { timer.Reset(idle) }
+	}
+	if lifetime := s.timeouts.UpgradeMaxLifetime; lifetime > 0 {
+		timer := time.AfterFunc(lifetime, closeBoth)
+		defer timer.Stop()
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(activityWriter{upstream, touch}, clientReader)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(activityWriter{client, touch}, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// activityWriter reports every successful write so idle timers only fire on silent sockets.
+type activityWriter struct {
+	w     io.Writer
+	touch func()
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	n, err := a.w.Write(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
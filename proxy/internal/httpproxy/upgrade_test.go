@@ -0,0 +1,103 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newEchoUpgradeServer accepts any Upgrade request and echoes bytes back over the hijacked connection.
+func newEchoUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+		_, _ = io.Copy(conn, buf)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dialUpgrade(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	u, _ := url.Parse(target)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", target, u.Host)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	return conn, reader, resp
+}
+
+func newUpgradeProxy(t *testing.T, blocked []string, timeouts Timeouts) string {
+	t.Helper()
+	proxy := newTestProxy(t, testProxyOptions{blocked: blocked})
+	proxy.SetTimeouts(timeouts)
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestProxyRelaysWebSocketUpgrade(t *testing.T) {
+	upstream := newEchoUpgradeServer(t)
+	proxyAddr := newUpgradeProxy(t, nil, DefaultTimeouts())
+
+	conn, reader, resp := dialUpgrade(t, proxyAddr, upstream.URL+"/socket")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through upgraded connection: %v", err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("expected echoed ping, got %q (%v)", echo, err)
+	}
+}
+
+func TestProxyRejectsUpgradeToBlockedHost(t *testing.T) {
+	proxyAddr := newUpgradeProxy(t, []string{"ws.ads.example.com"}, DefaultTimeouts())
+
+	_, _, resp := dialUpgrade(t, proxyAddr, "http://ws.ads.example.com/socket")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 before upgrading a blocked host, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyClosesIdleUpgradedConnections(t *testing.T) {
+	upstream := newEchoUpgradeServer(t)
+	timeouts := DefaultTimeouts()
+	timeouts.UpgradeIdle = 100 * time.Millisecond
+	proxyAddr := newUpgradeProxy(t, nil, timeouts)
+
+	conn, reader, resp := dialUpgrade(t, proxyAddr, upstream.URL+"/socket")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected idle upgraded connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package intercept
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 30 * 24 * time.Hour
+	// leafRenewBefore re-mints cached leaves before clients start rejecting them.
+	leafRenewBefore = 24 * time.Hour
+	maxCachedLeaves = 2048
+)
+
+// Authority is a local root CA that mints per-host leaf certificates for TLS interception.
+type Authority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *ecdsa.PrivateKey
+	leafKey *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// LoadOrCreateAuthority loads the CA from certPath/keyPath, generating and persisting a new one when absent.
+func LoadOrCreateAuthority(certPath, keyPath string) (*Authority, error) {
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	switch {
+	case certErr == nil && keyErr == nil:
+		return NewAuthority(certPEM, keyPEM)
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+		certPEM, keyPEM, err := GenerateCA("PayHole Local Interception CA")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFile(keyPath, keyPEM, 0o600); err != nil {
+			return nil, err
+		}
+		if err := writeFile(certPath, certPEM, 0o644); err != nil {
+			return nil, err
+		}
+		return NewAuthority(certPEM, keyPEM)
+	case certErr != nil:
+		return nil, fmt.Errorf("read CA certificate: %w", certErr)
+	default:
+		return nil, fmt.Errorf("read CA key: %w", keyErr)
+	}
+}
+
+// NewAuthority parses a PEM encoded CA certificate and EC private key.
+func NewAuthority(certPEM, keyPEM []byte) (*Authority, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("CA certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("CA key is not PEM encoded")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA key: %w", err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(certBlock),
+		key:     key,
+		leafKey: leafKey,
+		leaves:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// GenerateCA creates a self-signed root CA and returns the PEM encoded certificate and key.
+func GenerateCA(commonName string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"PayHole"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// CertificatePEM returns the CA certificate for installation on client devices.
+func (a *Authority) CertificatePEM() []byte {
+	return a.certPEM
+}
+
+// Certificate returns the CA certificate.
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// LeafFor returns a cached leaf certificate for host, minting a new one when missing or near expiry.
+func (a *Authority) LeafFor(host string) (*tls.Certificate, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return nil, errors.New("missing server name")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if leaf, ok := a.leaves[host]; ok && time.Until(leaf.Leaf.NotAfter) > leafRenewBefore {
+		return leaf, nil
+	}
+
+	leaf, err := a.mint(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.leaves) >= maxCachedLeaves {
+		for name := range a.leaves {
+			delete(a.leaves, name)
+			break
+		}
+	}
+	a.leaves[host] = leaf
+	return leaf, nil
+}
+
+// GetCertificate adapts LeafFor to tls.Config.GetCertificate, falling back to fallbackHost without SNI.
+func (a *Authority) GetCertificate(fallbackHost string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != "" {
+			return a.LeafFor(hello.ServerName)
+		}
+		return a.LeafFor(fallbackHost)
+	}
+}
+
+func (a *Authority) mint(host string) (*tls.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host, Organization: []string{"PayHole"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if template.NotAfter.After(a.cert.NotAfter) {
+		template.NotAfter = a.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &a.leafKey.PublicKey, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("mint certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  a.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, perm)
+}
@@ -0,0 +1,54 @@
+package intercept
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateAuthorityPersistsCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	first, err := LoadOrCreateAuthority(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("create authority: %v", err)
+	}
+	second, err := LoadOrCreateAuthority(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("reload authority: %v", err)
+	}
+	if !first.Certificate().Equal(second.Certificate()) {
+		t.Fatalf("expected reloaded CA to match the generated one")
+	}
+}
+
+func TestLeafForIsSignedByCAAndCached(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCA("test CA")
+	if err != nil {
+		t.Fatalf("generate CA: %v", err)
+	}
+	ca, err := NewAuthority(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load CA: %v", err)
+	}
+
+	leaf, err := ca.LeafFor("News.Example.com.")
+	if err != nil {
+		t.Fatalf("mint leaf: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "news.example.com", Roots: roots}); err != nil {
+		t.Fatalf("leaf does not verify against CA: %v", err)
+	}
+
+	again, err := ca.LeafFor("news.example.com")
+	if err != nil {
+		t.Fatalf("lookup leaf: %v", err)
+	}
+	if again != leaf {
+		t.Fatalf("expected cached leaf to be reused")
+	}
+}
@@ -0,0 +1,139 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// Egress denial reasons, one per class of address the proxy refuses to connect to.
+const (
+	ReasonEgressLoopback  DecisionReason = "egress_loopback"
+	ReasonEgressPrivate   DecisionReason = "egress_private"
+	ReasonEgressLinkLocal DecisionReason = "egress_link_local"
+	ReasonEgressShared    DecisionReason = "egress_shared_address"
+	ReasonEgressDenied    DecisionReason = "egress_denied"
+)
+
+// egressRange is a CIDR block together with the reason reported when a dial lands in it.
+type egressRange struct {
+	prefix netip.Prefix
+	reason DecisionReason
+}
+
+// defaultEgressDeny keeps proxy clients away from the proxy host itself, the operator's
+// LAN, cloud metadata endpoints and carrier-grade NAT neighbours.
+var defaultEgressDeny = []egressRange{
+	{netip.MustParsePrefix("0.0.0.0/8"), ReasonEgressLoopback},
+	{netip.MustParsePrefix("127.0.0.0/8"), ReasonEgressLoopback},
+	{netip.MustParsePrefix("::/128"), ReasonEgressLoopback},
+	{netip.MustParsePrefix("::1/128"), ReasonEgressLoopback},
+	{netip.MustParsePrefix("10.0.0.0/8"), ReasonEgressPrivate},
+	{netip.MustParsePrefix("172.16.0.0/12"), ReasonEgressPrivate},
+	{netip.MustParsePrefix("192.168.0.0/16"), ReasonEgressPrivate},
+	{netip.MustParsePrefix("fc00::/7"), ReasonEgressPrivate},
+	{netip.MustParsePrefix("169.254.0.0/16"), ReasonEgressLinkLocal},
+	{netip.MustParsePrefix("fe80::/10"), ReasonEgressLinkLocal},
+	{netip.MustParsePrefix("100.64.0.0/10"), ReasonEgressShared},
+}
+
+// Egress decides which resolved upstream addresses the proxy may connect to. It is checked
+// at dial time, after DNS resolution, so a hostname that resolves (or rebinds) to an
+// internal address is refused just like a literal IP.
+//
+// As with host decisions, the more specific of the allow and deny entries covering an
+// address wins and the allow list wins ties, so "10.1.2.0/24" can be reachable while the
+// rest of 10.0.0.0/8 stays denied.
+type Egress struct {
+	allow []netip.Prefix
+	deny  []egressRange
+}
+
+// EgressError is returned by dials refused by the egress policy.
+type EgressError struct {
+	Addr   netip.Addr
+	Reason DecisionReason
+}
+
+func (e *EgressError) Error() string {
+	return fmt.Sprintf("egress to %s denied (%s)", e.Addr, e.Reason)
+}
+
+// NewEgress builds the default egress policy extended with operator CIDR allow and deny
+// entries. A bare IP is treated as a single-address prefix.
+func NewEgress(allow, deny []string) (*Egress, error) {
+	e := &Egress{deny: append([]egressRange(nil), defaultEgressDeny...)}
+	for _, entry := range allow {
+		prefix, err := parseEgressPrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		e.allow = append(e.allow, prefix)
+	}
+	for _, entry := range deny {
+		prefix, err := parseEgressPrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		e.deny = append(e.deny, egressRange{prefix: prefix, reason: ReasonEgressDenied})
+	}
+	return e, nil
+}
+
+func parseEgressPrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid egress CIDR %q: %w", entry, err)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid egress CIDR %q: %w", entry, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// Check reports whether the proxy may connect to addr and, when it may not, why.
+func (e *Egress) Check(addr netip.Addr) (DecisionReason, bool) {
+	if e == nil {
+		return ReasonAllowed, true
+	}
+	addr = addr.Unmap().WithZone("")
+
+	allowBits := -1
+	for _, prefix := range e.allow {
+		if prefix.Contains(addr) && prefix.Bits() > allowBits {
+			allowBits = prefix.Bits()
+		}
+	}
+	denyBits := -1
+	reason := ReasonAllowed
+	for _, r := range e.deny {
+		if r.prefix.Contains(addr) && r.prefix.Bits() > denyBits {
+			denyBits = r.prefix.Bits()
+			reason = r.reason
+		}
+	}
+	if denyBits == -1 || allowBits >= denyBits {
+		return ReasonAllowed, true
+	}
+	return reason, false
+}
+
+// Control is a net.Dialer Control hook that refuses connections to denied addresses with
+// an *EgressError.
+func (e *Egress) Control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("egress check: unexpected dial address %q", address)
+	}
+	if reason, ok := e.Check(addrPort.Addr()); !ok {
+		return &EgressError{Addr: addrPort.Addr().Unmap(), Reason: reason}
+	}
+	return nil
+}
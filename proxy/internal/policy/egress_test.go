@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestEgressDeniesInternalRanges(t *testing.T) {
+	e, err := NewEgress(nil, nil)
+	if err != nil {
+		t.Fatalf("NewEgress: %v", err)
+	}
+
+	tests := []struct {
+		addr       string
+		wantAllow  bool
+		wantReason DecisionReason
+	}{
+		{"93.184.216.34", true, ReasonAllowed},
+		{"2606:4700::1111", true, ReasonAllowed},
+		{"127.0.0.1", false, ReasonEgressLoopback},
+		{"0.0.0.0", false, ReasonEgressLoopback},
+		{"::1", false, ReasonEgressLoopback},
+		{"::ffff:127.0.0.1", false, ReasonEgressLoopback},
+		{"10.1.2.3", false, ReasonEgressPrivate},
+		{"172.31.255.255", false, ReasonEgressPrivate},
+		{"172.32.0.1", true, ReasonAllowed},
+		{"192.168.1.1", false, ReasonEgressPrivate},
+		{"fd12:3456::1", false, ReasonEgressPrivate},
+		{"169.254.169.254", false, ReasonEgressLinkLocal},
+		{"fe80::1", false, ReasonEgressLinkLocal},
+		{"100.64.0.1", false, ReasonEgressShared},
+	}
+	for _, tc := range tests {
+		reason, ok := e.Check(netip.MustParseAddr(tc.addr))
+		if ok != tc.wantAllow || reason != tc.wantReason {
+			t.Errorf("Check(%s) = %q, %v; want %q, %v", tc.addr, reason, ok, tc.wantReason, tc.wantAllow)
+		}
+	}
+}
+
+func TestEgressAllowAndDenyPrecedence(t *testing.T) {
+	e, err := NewEgress([]string{"10.1.2.0/24", "192.168.0.0/16"}, []string{"198.51.100.0/24", "192.168.5.5"})
+	if err != nil {
+		t.Fatalf("NewEgress: %v", err)
+	}
+
+	tests := []struct {
+		addr       string
+		wantAllow  bool
+		wantReason DecisionReason
+	}{
+		{"10.1.2.3", true, ReasonAllowed},
+		{"10.1.3.3", false, ReasonEgressPrivate},
+		{"192.168.9.9", true, ReasonAllowed},
+		{"192.168.5.5", false, ReasonEgressDenied},
+		{"198.51.100.7", false, ReasonEgressDenied},
+	}
+	for _, tc := range tests {
+		reason, ok := e.Check(netip.MustParseAddr(tc.addr))
+		if ok != tc.wantAllow || reason != tc.wantReason {
+			t.Errorf("Check(%s) = %q, %v; want %q, %v", tc.addr, reason, ok, tc.wantReason, tc.wantAllow)
+		}
+	}
+
+	if _, err := NewEgress([]string{"not-a-cidr"}, nil); err == nil {
+		t.Fatal("expected invalid CIDR to be rejected")
+	}
+}
+
+func TestEgressControlReturnsEgressError(t *testing.T) {
+	e, _ := NewEgress(nil, nil)
+	err := e.Control("tcp4", "169.254.169.254:80", nil)
+	var denied *EgressError
+	if !errors.As(err, &denied) || denied.Reason != ReasonEgressLinkLocal {
+		t.Fatalf("expected link-local egress error, got %v", err)
+	}
+	if err := e.Control("tcp6", "[2606:4700::1111]:443", nil); err != nil {
+		t.Fatalf("expected public address to be allowed, got %v", err)
+	}
+}
@@ -1,13 +1,16 @@
 package policy
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"strings"
-	"time"
 
 	"github.com/payhole/proxy/internal/analytics"
 	"github.com/payhole/proxy/internal/auth"
 	"github.com/payhole/proxy/internal/blocklist"
+	"github.com/payhole/proxy/internal/x402"
 )
 
 // DecisionReason describes why a request was blocked.
@@ -19,20 +22,35 @@ const (
 	ReasonPremiumPayment DecisionReason = "premium_unlock_required"
 )
 
+// DecisionSource names the list whose entry settled a decision.
+type DecisionSource string
+
+const (
+	SourceDefault   DecisionSource = ""
+	SourceAllowlist DecisionSource = "allowlist"
+	SourceBlocklist DecisionSource = "blocklist"
+	SourcePremium   DecisionSource = "premium"
+)
+
 // Decision captures the outcome of a filtering check.
 type Decision struct {
 	Allow      bool
 	StatusCode int
 	Reason     DecisionReason
+	// Source is the list that won and Match the entry within it that matched the host.
+	Source DecisionSource
+	Match  string
 }
 
 // Policy orchestrates blocklist, premium access, and analytics decisions.
 type Policy struct {
 	blocklist blocklist.List
+	allowlist blocklist.List
 	premium   blocklist.List
 	authorizer *auth.JWTAuthorizer
 	ipCache    *auth.IPCache
 	analytics  *analytics.Client
+	payments   x402.Facilitator
 }
 
 // New constructs a Policy.
@@ -52,7 +70,66 @@ func New(
 	}
 }
 
+// SetAllowlist installs exceptions that override blocklist matches.
+func (p *Policy) SetAllowlist(list blocklist.List) {
+	p.allowlist = list
+}
+
+// SetPaymentFacilitator enables inline x402 payments through the X-PAYMENT header.
+func (p *Policy) SetPaymentFacilitator(facilitator x402.Facilitator) {
+	p.payments = facilitator
+}
+
+// VerifyPayment checks an X-PAYMENT header against requirements before a premium request
+// is forwarded. It returns nil only when the facilitator accepts the payment.
+func (p *Policy) VerifyPayment(ctx context.Context, paymentHeader string, requirements x402.PaymentRequirements) error {
+	if p == nil || p.payments == nil {
+		return errors.New("x402 payments are not enabled")
+	}
+	payload, err := x402.DecodePaymentHeader(paymentHeader)
+	if err != nil {
+		return err
+	}
+	if payload.Scheme != requirements.Scheme || payload.Network != requirements.Network {
+		return fmt.Errorf("payment must use scheme %q on network %q", requirements.Scheme, requirements.Network)
+	}
+	verification, err := p.payments.Verify(ctx, paymentHeader, requirements)
+	if err != nil {
+		return err
+	}
+	if !verification.IsValid {
+		if verification.InvalidReason != "" {
+			return fmt.Errorf("payment rejected: %s", verification.InvalidReason)
+		}
+		return errors.New("payment rejected")
+	}
+	return nil
+}
+
+// SettlePayment settles a previously verified X-PAYMENT header.
+func (p *Policy) SettlePayment(ctx context.Context, paymentHeader string, requirements x402.PaymentRequirements) (*x402.SettleResponse, error) {
+	if p == nil || p.payments == nil {
+		return nil, errors.New("x402 payments are not enabled")
+	}
+	settlement, err := p.payments.Settle(ctx, paymentHeader, requirements)
+	if err != nil {
+		return nil, err
+	}
+	if !settlement.Success {
+		if settlement.ErrorReason != "" {
+			return nil, fmt.Errorf("settlement failed: %s", settlement.ErrorReason)
+		}
+		return nil, errors.New("settlement failed")
+	}
+	return settlement, nil
+}
+
 // Decide evaluates whether a host should be allowed for the given client context.
+//
+// Precedence: the more specific of the allowlist and blocklist entries covering the host
+// wins, with the allowlist winning ties, so "tracker.example.com" can be blocked while
+// "api.tracker.example.com" stays reachable and vice versa. The allowlist never waives
+// payment: premium hosts still require an unlock unless the blocklist rejected them first.
 func (p *Policy) Decide(host, remoteAddr, authHeader string) Decision {
 	if p == nil {
 		return Decision{Allow: true, Reason: ReasonAllowed, StatusCode: 200}
@@ -63,21 +140,49 @@ func (p *Policy) Decide(host, remoteAddr, authHeader string) Decision {
 		return Decision{Allow: true, Reason: ReasonAllowed, StatusCode: 200}
 	}
 
-	authorized := p.isAuthorized(remoteAddr, authHeader)
-
-	if p.blocklist != nil && p.blocklist.Contains(canonicalHost) {
+	allowMatch, allowed := match(p.allowlist, canonicalHost)
+	blockMatch, blocked := match(p.blocklist, canonicalHost)
+	if blocked && (!allowed || labelCount(blockMatch) > labelCount(allowMatch)) {
 		p.record(canonicalHost, ReasonAdBlocked)
-		return Decision{Allow: false, StatusCode: 403, Reason: ReasonAdBlocked}
+		return Decision{Allow: false, StatusCode: 403, Reason: ReasonAdBlocked, Source: SourceBlocklist, Match: blockMatch}
 	}
 
-	if p.premium != nil && p.premium.Contains(canonicalHost) && !authorized {
-		p.record(canonicalHost, ReasonPremiumPayment)
-		return Decision{Allow: false, StatusCode: 402, Reason: ReasonPremiumPayment}
+	// Only premium hosts consult the session, so other traffic never slides it forward.
+	if premiumMatch, ok := match(p.premium, canonicalHost); ok {
+		if !p.isAuthorized(remoteAddr, authHeader) {
+			p.record(canonicalHost, ReasonPremiumPayment)
+			return Decision{Allow: false, StatusCode: 402, Reason: ReasonPremiumPayment, Source: SourcePremium, Match: premiumMatch}
+		}
+		return Decision{Allow: true, StatusCode: 200, Reason: ReasonAllowed, Source: SourcePremium, Match: premiumMatch}
 	}
 
+	if allowed {
+		return Decision{Allow: true, StatusCode: 200, Reason: ReasonAllowed, Source: SourceAllowlist, Match: allowMatch}
+	}
 	return Decision{Allow: true, StatusCode: 200, Reason: ReasonAllowed}
 }
 
+func match(list blocklist.List, host string) (string, bool) {
+	if list == nil {
+		return "", false
+	}
+	return list.Match(host)
+}
+
+func labelCount(domain string) int {
+	return strings.Count(domain, ".") + 1
+}
+
+// Record publishes a block decided outside Decide, such as a URL-level network filter match.
+func (p *Policy) Record(host string, reason DecisionReason) {
+	if p == nil {
+		return
+	}
+	if canonicalHost := canonicalizeHost(host); canonicalHost != "" {
+		p.record(canonicalHost, reason)
+	}
+}
+
 func (p *Policy) record(domain string, reason DecisionReason) {
 	if p.analytics != nil {
 		p.analytics.RecordBlocked(domain, string(reason))
@@ -97,12 +202,8 @@ func (p *Policy) isAuthorized(remoteAddr, authHeader string) bool {
 	if token != "" {
 		if claims, err := p.authorizer.Verify(token); err == nil {
 			if p.ipCache != nil {
-				expiry := auth.ExpiryFromClaims(claims)
-				cacheExpiry := time.Now().Add(30 * time.Second)
-				if cacheExpiry.Before(expiry) {
-					expiry = cacheExpiry
-				}
-				p.ipCache.Authorize(remoteAddr, expiry)
+				// The cache slides the session forward on use, but never past the token's exp.
+				p.ipCache.Bind(remoteAddr, claims.Wallet, auth.ExpiryFromClaims(claims))
 			}
 			return true
 		}
@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/payhole/proxy/internal/auth"
+	"github.com/payhole/proxy/internal/blocklist"
+)
+
+func TestDecidePrecedence(t *testing.T) {
+	p := New(
+		blocklist.New([]string{"tracker.example.com", "ads.partner.example"}),
+		blocklist.New([]string{"premium.example.com"}),
+		nil,
+		nil,
+		nil,
+	)
+	p.SetAllowlist(blocklist.New([]string{"api.tracker.example.com", "partner.example", "premium.example.com"}))
+
+	tests := []struct {
+		host       string
+		wantAllow  bool
+		wantSource DecisionSource
+		wantMatch  string
+	}{
+		{"tracker.example.com", false, SourceBlocklist, "tracker.example.com"},
+		{"cdn.tracker.example.com", false, SourceBlocklist, "tracker.example.com"},
+		{"api.tracker.example.com", true, SourceAllowlist, "api.tracker.example.com"},
+		{"v2.api.tracker.example.com", true, SourceAllowlist, "api.tracker.example.com"},
+		{"www.partner.example", true, SourceAllowlist, "partner.example"},
+		{"ads.partner.example", false, SourceBlocklist, "ads.partner.example"},
+		{"premium.example.com", false, SourcePremium, "premium.example.com"},
+		{"news.example.org", true, SourceDefault, ""},
+	}
+
+	for _, tc := range tests {
+		decision := p.Decide(tc.host, "203.0.113.10:1234", "")
+		if decision.Allow != tc.wantAllow || decision.Source != tc.wantSource || decision.Match != tc.wantMatch {
+			t.Errorf("Decide(%s) = %+v, want allow=%v source=%q match=%q", tc.host, decision, tc.wantAllow, tc.wantSource, tc.wantMatch)
+		}
+	}
+}
+
+func TestDecideConsultsSessionOnlyForPremiumHosts(t *testing.T) {
+	authorizer, _ := auth.NewJWTAuthorizer("abcdefghijklmnopqrstuvwxyz1234567890abcdef")
+	cache := auth.NewIPCache()
+	cache.Authorize("203.0.113.10:1234", time.Now().Add(time.Hour))
+	p := New(blocklist.New([]string{"ads.example.com"}), blocklist.New([]string{"premium.example.com"}), authorizer, cache, nil)
+
+	for _, host := range []string{"news.example.org", "ads.example.com"} {
+		p.Decide(host, "203.0.113.10:1234", "Bearer not-a-token")
+	}
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatalf("non-premium hosts must not touch the session, got %+v", stats)
+	}
+
+	if decision := p.Decide("premium.example.com", "203.0.113.10:1234", ""); !decision.Allow {
+		t.Fatalf("expected the unlocked client to reach the premium host, got %+v", decision)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 {
+		t.Fatalf("expected the premium check to consult the session, got %+v", stats)
+	}
+}
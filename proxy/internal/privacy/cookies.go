@@ -0,0 +1,67 @@
+package privacy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/payhole/proxy/internal/blocklist"
+)
+
+// CookieMode selects which third-party requests lose their cookies.
+type CookieMode string
+
+const (
+	// CookiesAllow forwards Cookie and Set-Cookie untouched.
+	CookiesAllow CookieMode = "off"
+	// CookiesTrackers strips cookies on third-party requests to hosts on the tracker lists.
+	CookiesTrackers CookieMode = "trackers"
+	// CookiesThirdParty strips cookies on every third-party request.
+	CookiesThirdParty CookieMode = "third-party"
+)
+
+// ParseCookieMode validates a cookie policy name, defaulting to CookiesTrackers.
+func ParseCookieMode(name string) (CookieMode, error) {
+	switch mode := CookieMode(strings.ToLower(strings.TrimSpace(name))); mode {
+	case "":
+		return CookiesTrackers, nil
+	case CookiesAllow, CookiesTrackers, CookiesThirdParty:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown cookie policy %q", name)
+	}
+}
+
+// CookiePolicy decides whether cookies are stripped from a request and its response. A request
+// is third-party when the eTLD+1 of its target differs from that of its Referer or Origin.
+type CookiePolicy struct {
+	Mode     CookieMode
+	Trackers blocklist.List
+}
+
+// Strip reports whether cookies should be removed for a request to target issued from source,
+// the host of the page named by Origin or Referer. Requests without a source are first-party.
+func (p CookiePolicy) Strip(target, source string) bool {
+	if source == "" || target == "" || blocklist.SameSite(target, source) {
+		return false
+	}
+	switch p.Mode {
+	case CookiesThirdParty:
+		return true
+	case CookiesTrackers:
+		return p.Trackers != nil && p.Trackers.Contains(target)
+	default:
+		return false
+	}
+}
+
+// Summary describes the cookie policy for display on the setup page.
+func (p CookiePolicy) Summary() string {
+	switch p.Mode {
+	case CookiesThirdParty:
+		return "Cookies are stripped on every third-party request"
+	case CookiesTrackers:
+		return "Cookies are stripped on third-party requests to tracker domains"
+	default:
+		return "Cookies are forwarded untouched"
+	}
+}
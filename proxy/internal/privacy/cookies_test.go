@@ -0,0 +1,45 @@
+package privacy
+
+import (
+	"testing"
+
+	"github.com/payhole/proxy/internal/blocklist"
+)
+
+func TestCookiePolicyStrip(t *testing.T) {
+	trackers := blocklist.New([]string{"tracker.example"})
+
+	tests := []struct {
+		mode   CookieMode
+		target string
+		source string
+		want   bool
+	}{
+		{CookiesTrackers, "pixel.tracker.example", "news.example.co.uk", true},
+		{CookiesTrackers, "pixel.tracker.example", "", false},
+		{CookiesTrackers, "pixel.tracker.example", "www.tracker.example", false},
+		{CookiesTrackers, "cdn.other.example", "news.example.co.uk", false},
+		{CookiesThirdParty, "cdn.other.example", "news.example.co.uk", true},
+		{CookiesThirdParty, "static.example.co.uk", "news.example.co.uk", false},
+		{CookiesThirdParty, "shop.example.co.uk", "news.another.co.uk", true},
+		{CookiesAllow, "pixel.tracker.example", "news.example.co.uk", false},
+	}
+	for _, tc := range tests {
+		p := CookiePolicy{Mode: tc.mode, Trackers: trackers}
+		if got := p.Strip(tc.target, tc.source); got != tc.want {
+			t.Errorf("%s: Strip(%s, %s) = %v, want %v", tc.mode, tc.target, tc.source, got, tc.want)
+		}
+	}
+}
+
+func TestParseCookieMode(t *testing.T) {
+	if mode, err := ParseCookieMode(""); err != nil || mode != CookiesTrackers {
+		t.Fatalf("expected trackers default, got %q, %v", mode, err)
+	}
+	if mode, err := ParseCookieMode("Third-Party"); err != nil || mode != CookiesThirdParty {
+		t.Fatalf("expected third-party, got %q, %v", mode, err)
+	}
+	if _, err := ParseCookieMode("everything"); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
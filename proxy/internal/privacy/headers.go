@@ -0,0 +1,174 @@
+package privacy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/payhole/proxy/internal/filter"
+)
+
+// ForwardingMode controls how client identity headers (X-Forwarded-For, Forwarded, Via) are sent upstream.
+type ForwardingMode string
+
+const (
+	// ForwardingAppend appends the client IP to X-Forwarded-For like a conventional proxy.
+	ForwardingAppend ForwardingMode = "append"
+	// ForwardingDrop removes client identity headers entirely.
+	ForwardingDrop ForwardingMode = "drop"
+	// ForwardingOverride replaces client identity headers with a fixed value.
+	ForwardingOverride ForwardingMode = "override"
+)
+
+const (
+	// NormalizedUserAgent is the common browser string sent when User-Agent normalization is on.
+	NormalizedUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	// NormalizedAcceptLanguage is sent when Accept-Language normalization is on.
+	NormalizedAcceptLanguage = "en-US,en;q=0.5"
+)
+
+// legacyClientHints predate the Sec-CH- prefix but leak the same device details.
+var legacyClientHints = []string{"Device-Memory", "DPR", "Viewport-Width", "Width", "Downlink", "ECT", "RTT"}
+
+// HeaderPolicy describes which identifying request headers are scrubbed before forwarding.
+type HeaderPolicy struct {
+	Profile                 string
+	Forwarding              ForwardingMode
+	ForwardingValue         string
+	TrimCrossSiteReferer    bool
+	NormalizeUserAgent      bool
+	NormalizeAcceptLanguage bool
+	StripClientHints        bool
+}
+
+// ProfileNames lists the built-in header privacy profiles.
+var ProfileNames = []string{"off", "balanced", "strict"}
+
+// Profile returns the named built-in policy.
+//
+//   - off: conventional proxy behaviour, appending the client IP to X-Forwarded-For.
+//   - balanced: drop forwarding headers, trim cross-site Referer, strip client hints.
+//   - strict: balanced plus a normalized User-Agent and Accept-Language.
+func Profile(name string) (HeaderPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "off":
+		return HeaderPolicy{Profile: "off", Forwarding: ForwardingAppend}, nil
+	case "", "balanced":
+		return HeaderPolicy{
+			Profile:              "balanced",
+			Forwarding:           ForwardingDrop,
+			TrimCrossSiteReferer: true,
+			StripClientHints:     true,
+		}, nil
+	case "strict":
+		return HeaderPolicy{
+			Profile:                 "strict",
+			Forwarding:              ForwardingDrop,
+			TrimCrossSiteReferer:    true,
+			NormalizeUserAgent:      true,
+			NormalizeAcceptLanguage: true,
+			StripClientHints:        true,
+		}, nil
+	default:
+		return HeaderPolicy{}, fmt.Errorf("unknown privacy profile %q", name)
+	}
+}
+
+// Default returns the balanced profile.
+func Default() HeaderPolicy {
+	policy, _ := Profile("balanced")
+	return policy
+}
+
+// Apply scrubs h for a request to target on behalf of clientIP.
+func (p HeaderPolicy) Apply(h http.Header, target *url.URL, clientIP string) {
+	switch p.Forwarding {
+	case ForwardingAppend:
+		if clientIP != "" {
+			if prior := h.Get("X-Forwarded-For"); prior != "" {
+				h.Set("X-Forwarded-For", prior+", "+clientIP)
+			} else {
+				h.Set("X-Forwarded-For", clientIP)
+			}
+		}
+	case ForwardingOverride:
+		h.Del("Via")
+		h.Set("X-Forwarded-For", p.ForwardingValue)
+		h.Set("Forwarded", "for="+quoteForwarded(p.ForwardingValue))
+	default:
+		h.Del("X-Forwarded-For")
+		h.Del("Forwarded")
+		h.Del("Via")
+	}
+
+	if p.TrimCrossSiteReferer {
+		trimReferer(h, target)
+	}
+	if p.NormalizeUserAgent {
+		h.Set("User-Agent", NormalizedUserAgent)
+	}
+	if p.NormalizeAcceptLanguage && h.Get("Accept-Language") != "" {
+		h.Set("Accept-Language", NormalizedAcceptLanguage)
+	}
+	if p.StripClientHints {
+		for name := range h {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), "Sec-Ch-") {
+				h.Del(name)
+			}
+		}
+		for _, name := range legacyClientHints {
+			h.Del(name)
+		}
+	}
+}
+
+// Summary describes the active controls for display on the setup page.
+func (p HeaderPolicy) Summary() []string {
+	var lines []string
+	switch p.Forwarding {
+	case ForwardingAppend:
+		lines = append(lines, "Client IP is appended to X-Forwarded-For and the proxy is named in Via")
+	case ForwardingOverride:
+		lines = append(lines, fmt.Sprintf("X-Forwarded-For and Forwarded are replaced with %s; Via is removed", p.ForwardingValue))
+	default:
+		lines = append(lines, "X-Forwarded-For, Forwarded and Via are removed")
+	}
+	if p.TrimCrossSiteReferer {
+		lines = append(lines, "Cross-site Referer is trimmed to the origin")
+	}
+	if p.NormalizeUserAgent {
+		lines = append(lines, "User-Agent is normalized")
+	}
+	if p.NormalizeAcceptLanguage {
+		lines = append(lines, "Accept-Language is normalized")
+	}
+	if p.StripClientHints {
+		lines = append(lines, "Client hints (Sec-CH-*) are stripped")
+	}
+	return lines
+}
+
+func trimReferer(h http.Header, target *url.URL) {
+	raw := h.Get("Referer")
+	if raw == "" || target == nil {
+		return
+	}
+	referer, err := url.Parse(raw)
+	if err != nil || referer.Host == "" {
+		h.Del("Referer")
+		return
+	}
+	if filter.SameSite(referer.Hostname(), target.Hostname()) {
+		return
+	}
+	h.Set("Referer", referer.Scheme+"://"+referer.Host+"/")
+}
+
+func quoteForwarded(value string) string {
+	if strings.Contains(value, ":") {
+		// IPv6 addresses must be bracketed and quoted (RFC 7239 section 6).
+		return `"[` + value + `]"`
+	}
+	return value
+}
@@ -0,0 +1,73 @@
+package privacy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestBalancedProfileScrubsIdentifyingHeaders(t *testing.T) {
+	policy := Default()
+	target, _ := url.Parse("https://cdn.example.net/app.js")
+	h := http.Header{
+		"X-Forwarded-For":    []string{"10.0.0.5"},
+		"Forwarded":          []string{"for=10.0.0.5"},
+		"Via":                []string{"1.1 corp-proxy"},
+		"Referer":            []string{"https://news.example.com/articles/secret?id=7"},
+		"Sec-Ch-Ua":          []string{`"Chromium";v="126"`},
+		"Sec-Ch-Ua-Platform": []string{`"macOS"`},
+		"Device-Memory":      []string{"8"},
+		"User-Agent":         []string{"Custom/1.0"},
+	}
+
+	policy.Apply(h, target, "203.0.113.10")
+
+	for _, name := range []string{"X-Forwarded-For", "Forwarded", "Via", "Sec-Ch-Ua", "Sec-Ch-Ua-Platform", "Device-Memory"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("expected %s removed, got %q", name, got)
+		}
+	}
+	if got := h.Get("Referer"); got != "https://news.example.com/" {
+		t.Errorf("expected cross-site referer trimmed to origin, got %q", got)
+	}
+	if got := h.Get("User-Agent"); got != "Custom/1.0" {
+		t.Errorf("balanced profile should keep User-Agent, got %q", got)
+	}
+}
+
+func TestProfilesControlForwardingAndNormalization(t *testing.T) {
+	target, _ := url.Parse("https://www.example.com/page")
+
+	off, _ := Profile("off")
+	h := http.Header{"X-Forwarded-For": []string{"10.0.0.5"}, "Referer": []string{"https://other.example.org/a"}}
+	off.Apply(h, target, "203.0.113.10")
+	if got := h.Get("X-Forwarded-For"); got != "10.0.0.5, 203.0.113.10" {
+		t.Errorf("off profile should append client IP, got %q", got)
+	}
+	if got := h.Get("Referer"); got != "https://other.example.org/a" {
+		t.Errorf("off profile should keep referer, got %q", got)
+	}
+
+	strict, _ := Profile("strict")
+	h = http.Header{"User-Agent": []string{"Custom/1.0"}, "Accept-Language": []string{"de-CH"}, "Referer": []string{"https://example.com/a/b"}}
+	strict.Apply(h, target, "203.0.113.10")
+	if h.Get("User-Agent") != NormalizedUserAgent || h.Get("Accept-Language") != NormalizedAcceptLanguage {
+		t.Errorf("strict profile should normalize UA and language, got %v", h)
+	}
+	if got := h.Get("Referer"); got != "https://example.com/a/b" {
+		t.Errorf("same-site referer should be kept, got %q", got)
+	}
+
+	override := Default()
+	override.Forwarding = ForwardingOverride
+	override.ForwardingValue = "192.0.2.1"
+	h = http.Header{"X-Forwarded-For": []string{"10.0.0.5"}, "Via": []string{"1.1 corp"}}
+	override.Apply(h, target, "203.0.113.10")
+	if h.Get("X-Forwarded-For") != "192.0.2.1" || h.Get("Forwarded") != "for=192.0.2.1" || h.Get("Via") != "" {
+		t.Errorf("unexpected override headers %v", h)
+	}
+
+	if _, err := Profile("paranoid"); err == nil {
+		t.Errorf("expected unknown profile to fail")
+	}
+}
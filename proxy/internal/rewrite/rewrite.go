@@ -0,0 +1,122 @@
+package rewrite
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/payhole/proxy/internal/analytics"
+	"github.com/payhole/proxy/internal/filter"
+)
+
+// Analytics reasons recorded for rewritten requests.
+const (
+	ReasonParamsRemoved     = "tracking_params_removed"
+	ReasonRedirectUnwrapped = "redirect_unwrapped"
+)
+
+// Rewriter strips tracking parameters from outbound URLs and short-circuits known redirect wrappers.
+type Rewriter struct {
+	network   *filter.NetworkEngine
+	analytics *analytics.Client
+}
+
+// New constructs a Rewriter using the built-in tracking parameter set plus any $removeparam
+// rules loaded into network, which may be nil.
+func New(network *filter.NetworkEngine, client *analytics.Client) *Rewriter {
+	return &Rewriter{network: network, analytics: client}
+}
+
+// StripParams removes tracking parameters from u in place and returns the names it removed.
+// Untouched parameters keep their original encoding and order.
+func (rw *Rewriter) StripParams(u *url.URL, req filter.Request) []string {
+	if rw == nil || u.RawQuery == "" {
+		return nil
+	}
+
+	segments := strings.Split(u.RawQuery, "&")
+	params := make([]filter.QueryParam, len(segments))
+	for i, segment := range segments {
+		name, value, _ := strings.Cut(segment, "=")
+		params[i] = filter.QueryParam{Name: unescape(name), Value: unescape(value)}
+	}
+
+	drop := make(map[string]bool)
+	for _, param := range params {
+		if IsTrackingParam(param.Name) {
+			drop[param.Name] = true
+		}
+	}
+	for _, name := range rw.network.RemovedParams(req, params) {
+		drop[name] = true
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+
+	var removed []string
+	kept := segments[:0]
+	for i, segment := range segments {
+		if drop[params[i].Name] {
+			removed = append(removed, params[i].Name)
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	u.ForceQuery = false
+
+	rw.analytics.RecordRewrite(u.Hostname(), ReasonParamsRemoved)
+	return removed
+}
+
+// Unwrap returns the destination of a known redirect wrapper such as google.com/url or
+// l.facebook.com/l.php, with its tracking parameters already stripped.
+func (rw *Rewriter) Unwrap(u *url.URL) (string, bool) {
+	if rw == nil {
+		return "", false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for _, w := range redirectWrappers {
+		if !w.matches(host, u.Path) {
+			continue
+		}
+		query := u.Query()
+		for _, param := range w.params {
+			dest, ok := destination(query.Get(param))
+			if !ok || (strings.EqualFold(dest.Host, u.Host) && dest.Path == u.Path) {
+				continue
+			}
+			rw.StripParams(dest, filter.Request{
+				URL:  dest.String(),
+				Host: strings.ToLower(dest.Hostname()),
+				Type: filter.TypeDocument,
+			})
+			rw.analytics.RecordRewrite(host, ReasonRedirectUnwrapped)
+			return dest.String(), true
+		}
+	}
+	return "", false
+}
+
+// destination only accepts absolute web URLs so a wrapper cannot be used to reach other schemes.
+func destination(raw string) (*url.URL, bool) {
+	if raw == "" {
+		return nil, false
+	}
+	dest, err := url.Parse(raw)
+	if err != nil || dest.Host == "" {
+		return nil, false
+	}
+	switch strings.ToLower(dest.Scheme) {
+	case "http", "https":
+		return dest, true
+	}
+	return nil, false
+}
+
+func unescape(s string) string {
+	if decoded, err := url.QueryUnescape(s); err == nil {
+		return decoded
+	}
+	return s
+}
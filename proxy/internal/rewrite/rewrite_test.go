@@ -0,0 +1,62 @@
+package rewrite
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/payhole/proxy/internal/filter"
+)
+
+func TestStripParamsRemovesTrackingParameters(t *testing.T) {
+	rw := New(filter.NewNetworkEngine([]string{"||shop.example^$removeparam=ref"}), nil)
+
+	tests := []struct {
+		raw     string
+		want    string
+		removed []string
+	}{
+		{"https://site.test/a?id=7&utm_source=news&utm_medium=email&fbclid=x1", "https://site.test/a?id=7", []string{"utm_source", "utm_medium", "fbclid"}},
+		{"https://site.test/a?q=a%20b&gclid=1&mc_eid=2#top", "https://site.test/a?q=a%20b#top", []string{"gclid", "mc_eid"}},
+		{"https://site.test/a?utm_campaign=x", "https://site.test/a", []string{"utm_campaign"}},
+		{"https://site.test/a?ref=home&utm=1", "https://site.test/a?ref=home&utm=1", nil},
+		{"https://shop.example/item?ref=home&id=3", "https://shop.example/item?id=3", []string{"ref"}},
+	}
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.raw)
+		removed := rw.StripParams(u, filter.Request{URL: tc.raw, Host: u.Hostname(), Type: filter.TypeDocument})
+		if u.String() != tc.want {
+			t.Errorf("StripParams(%s) = %s, want %s", tc.raw, u, tc.want)
+		}
+		if !reflect.DeepEqual(removed, tc.removed) {
+			t.Errorf("StripParams(%s) removed %v, want %v", tc.raw, removed, tc.removed)
+		}
+	}
+}
+
+func TestUnwrapKnownRedirectors(t *testing.T) {
+	rw := New(nil, nil)
+
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"https://www.google.com/url?sa=t&q=https%3A%2F%2Fexample.com%2Fpage%3Futm_source%3Dgoogle%26id%3D1", "https://example.com/page?id=1", true},
+		{"https://www.google.co.uk/url?url=https://example.org/", "https://example.org/", true},
+		{"https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2F%3Ffbclid%3Dabc&h=AT0", "https://example.com/", true},
+		{"https://out.reddit.com/t3_abc?url=https%3A%2F%2Fexample.net%2Fx&token=1", "https://example.net/x", true},
+		{"https://duckduckgo.com/l/?uddg=https%3A%2F%2Fexample.com%2F", "https://example.com/", true},
+		{"https://www.google.com/url?q=javascript:alert(1)", "", false},
+		{"https://www.google.com/search?q=https://example.com/", "", false},
+		{"https://l.facebook.com/l.php", "", false},
+		{"https://google.evil.example.com/url?q=https://example.com/", "", false},
+	}
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.raw)
+		got, ok := rw.Unwrap(u)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("Unwrap(%s) = %q, %v; want %q, %v", tc.raw, got, ok, tc.want, tc.ok)
+		}
+	}
+}
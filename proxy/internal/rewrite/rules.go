@@ -0,0 +1,108 @@
+package rewrite
+
+import "strings"
+
+// trackingParams are click identifiers and campaign tags that never change what a page shows.
+var trackingParams = map[string]bool{
+	"fbclid":        true,
+	"gclid":         true,
+	"gclsrc":        true,
+	"dclid":         true,
+	"gbraid":        true,
+	"wbraid":        true,
+	"msclkid":       true,
+	"yclid":         true,
+	"ysclid":        true,
+	"twclid":        true,
+	"ttclid":        true,
+	"igshid":        true,
+	"igsh":          true,
+	"li_fat_id":     true,
+	"mc_eid":        true,
+	"mc_cid":        true,
+	"_hsenc":        true,
+	"_hsmi":         true,
+	"__hstc":        true,
+	"__hssc":        true,
+	"__hsfp":        true,
+	"hsctatracking": true,
+	"mkt_tok":       true,
+	"oly_anon_id":   true,
+	"oly_enc_id":    true,
+	"rb_clickid":    true,
+	"s_cid":         true,
+	"vero_id":       true,
+	"vero_conv":     true,
+	"wickedid":      true,
+	"_openstat":     true,
+	"_gl":           true,
+	"epik":          true,
+	"sc_cid":        true,
+}
+
+// trackingPrefixes cover parameter families such as utm_source, utm_medium and pk_campaign.
+var trackingPrefixes = []string{"utm_", "pk_", "mtm_", "hsa_"}
+
+// IsTrackingParam reports whether name is in the built-in tracking parameter set.
+func IsTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	if trackingParams[name] {
+		return true
+	}
+	for _, prefix := range trackingPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectWrapper describes a link redirector that carries its destination in a query parameter.
+type redirectWrapper struct {
+	host   func(string) bool
+	path   string // exact path, or a prefix when it ends in "/"
+	params []string
+}
+
+func (w redirectWrapper) matches(host, path string) bool {
+	if !w.host(host) {
+		return false
+	}
+	if strings.HasSuffix(w.path, "/") {
+		return strings.HasPrefix(path+"/", w.path)
+	}
+	return path == w.path
+}
+
+var redirectWrappers = []redirectWrapper{
+	{host: isGoogleHost, path: "/url", params: []string{"q", "url"}},
+	{host: hostIs("l.facebook.com", "lm.facebook.com", "l.messenger.com"), path: "/l.php", params: []string{"u"}},
+	{host: hostIs("l.instagram.com"), path: "/", params: []string{"u"}},
+	{host: hostIs("out.reddit.com"), path: "/", params: []string{"url"}},
+	{host: hostIs("youtube.com", "www.youtube.com", "m.youtube.com"), path: "/redirect", params: []string{"q"}},
+	{host: hostIs("duckduckgo.com", "html.duckduckgo.com"), path: "/l/", params: []string{"uddg"}},
+	{host: hostIs("www.linkedin.com", "linkedin.com"), path: "/redir/redirect", params: []string{"url"}},
+	{host: hostIs("steamcommunity.com"), path: "/linkfilter/", params: []string{"url", "u"}},
+	{host: hostIs("slack-redir.net"), path: "/link", params: []string{"url"}},
+	{host: hostIs("t.umblr.com"), path: "/redirect", params: []string{"z"}},
+	{host: hostIs("vk.com", "m.vk.com"), path: "/away.php", params: []string{"to"}},
+	{host: hostIs("exit.sc"), path: "/", params: []string{"url"}},
+}
+
+func hostIs(hosts ...string) func(string) bool {
+	return func(host string) bool {
+		for _, h := range hosts {
+			if host == h {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isGoogleHost matches google.com and its country domains such as www.google.co.uk.
+func isGoogleHost(host string) bool {
+	host = strings.TrimPrefix(host, "www.")
+	rest, ok := strings.CutPrefix(host, "google.")
+	return ok && rest != "" && strings.Count(rest, ".") <= 1
+}
@@ -0,0 +1,106 @@
+package surrogate
+
+import (
+	"embed"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/payhole/proxy/internal/filter"
+)
+
+//go:embed resources
+var resources embed.FS
+
+// Resource is a neutral stand-in served in place of a blocked script, pixel or frame.
+type Resource struct {
+	Name        string
+	ContentType string
+	Body        []byte
+}
+
+// builtins maps each embedded file to its content type.
+var builtins = map[string]string{
+	"noop.js":        "application/javascript; charset=utf-8",
+	"1x1.gif":        "image/gif",
+	"noop.css":       "text/css; charset=utf-8",
+	"noop.json":      "application/json",
+	"noopframe.html": "text/html; charset=utf-8",
+	"noop.txt":       "text/plain; charset=utf-8",
+}
+
+// aliases accepts the resource names used by uBlock Origin $redirect rules.
+var aliases = map[string]string{
+	"noopjs":              "noop.js",
+	"noop.js":             "noop.js",
+	"1x1.gif":             "1x1.gif",
+	"1x1-transparent.gif": "1x1.gif",
+	"1x1-transparent-gif": "1x1.gif",
+	"noopcss":             "noop.css",
+	"noop.css":            "noop.css",
+	"noopjson":            "noop.json",
+	"noop.json":           "noop.json",
+	"noopframe":           "noopframe.html",
+	"noop.html":           "noopframe.html",
+	"noopframe.html":      "noopframe.html",
+	"nooptext":            "noop.txt",
+	"noop.txt":            "noop.txt",
+	"empty":               "noop.txt",
+}
+
+// byType is the surrogate served for each request type when no rule names one. Documents
+// are left out on purpose: a user navigating to a blocked page should see why.
+var byType = map[filter.RequestType]string{
+	filter.TypeScript:         "noop.js",
+	filter.TypeImage:          "1x1.gif",
+	filter.TypeStylesheet:     "noop.css",
+	filter.TypeXMLHTTPRequest: "noop.json",
+	filter.TypeSubdocument:    "noopframe.html",
+	filter.TypePing:           "noop.txt",
+}
+
+// Lookup returns the built-in resource registered under name or one of its uBlock Origin aliases.
+func Lookup(name string) (Resource, bool) {
+	file, ok := aliases[strings.ToLower(name)]
+	if !ok {
+		return Resource{}, false
+	}
+	body, err := resources.ReadFile("resources/" + file)
+	if err != nil {
+		return Resource{}, false
+	}
+	return Resource{Name: file, ContentType: builtins[file], Body: body}, true
+}
+
+// Select picks the surrogate for a blocked request: the resource named by a $redirect rule
+// when it exists, otherwise one matching the request type. It reports false when the request
+// should be refused outright.
+func Select(name string, t filter.RequestType) (Resource, bool) {
+	if name != "" {
+		if res, ok := Lookup(name); ok {
+			return res, true
+		}
+	}
+	if file := byType[t]; file != "" {
+		return Lookup(file)
+	}
+	return Resource{}, false
+}
+
+// ServeHTTP writes the resource as a successful, uncacheable response.
+func (res Resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Content-Type", res.ContentType)
+	header.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	header.Set("Cache-Control", "no-store")
+	// Cross-origin fetches of a surrogate must not fail CORS, or the page sees a network error.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		header.Add("Vary", "Origin")
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(res.Body)
+	}
+}
@@ -0,0 +1,58 @@
+package surrogate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/payhole/proxy/internal/filter"
+)
+
+func TestSelectByNameAndType(t *testing.T) {
+	tests := []struct {
+		name        string
+		reqType     filter.RequestType
+		wantName    string
+		wantContent string
+		ok          bool
+	}{
+		{"noopjs", filter.TypeImage, "noop.js", "application/javascript; charset=utf-8", true},
+		{"1x1-transparent.gif", filter.TypeScript, "1x1.gif", "image/gif", true},
+		{"", filter.TypeScript, "noop.js", "application/javascript; charset=utf-8", true},
+		{"", filter.TypeImage, "1x1.gif", "image/gif", true},
+		{"", filter.TypeStylesheet, "noop.css", "text/css; charset=utf-8", true},
+		{"", filter.TypeXMLHTTPRequest, "noop.json", "application/json", true},
+		{"", filter.TypeSubdocument, "noopframe.html", "text/html; charset=utf-8", true},
+		{"unknown-resource", filter.TypeScript, "noop.js", "application/javascript; charset=utf-8", true},
+		{"", filter.TypeDocument, "", "", false},
+		{"", filter.TypeMedia, "", "", false},
+	}
+	for _, tc := range tests {
+		res, ok := Select(tc.name, tc.reqType)
+		if ok != tc.ok || res.Name != tc.wantName || res.ContentType != tc.wantContent {
+			t.Errorf("Select(%q, %v) = %s/%s %v, want %s/%s %v", tc.name, tc.reqType, res.Name, res.ContentType, ok, tc.wantName, tc.wantContent, tc.ok)
+		}
+	}
+}
+
+func TestEmbeddedGIFIsValid(t *testing.T) {
+	res, ok := Lookup("1x1.gif")
+	if !ok || len(res.Body) < 6 || string(res.Body[:6]) != "GIF89a" {
+		t.Fatalf("expected embedded GIF89a pixel, got %v %q", ok, res.Body)
+	}
+}
+
+func TestServeHTTPAllowsCrossOriginFetch(t *testing.T) {
+	res, _ := Lookup("noop.json")
+	req := httptest.NewRequest(http.MethodGet, "https://api.tracker.example/v1/config", nil)
+	req.Header.Set("Origin", "https://news.example.com")
+	rec := httptest.NewRecorder()
+	res.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "{}\n" {
+		t.Fatalf("unexpected surrogate response %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://news.example.com" {
+		t.Fatalf("expected origin to be echoed, got %q", got)
+	}
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrInvalidExpiry rejects unlocks whose expiry is missing, already past or further ahead
+// than the maximum unlock lifetime allows.
+var ErrInvalidExpiry = errors.New("invalid unlock expiry")
+
+// Unlock is the payload the payments service posts after a successful payment.
+type Unlock struct {
+	Wallet    string `json:"wallet"`
+	ExpiresAt string `json:"expiresAt"`
+	ClientIP  string `json:"clientIp"`
+}
+
+// Expiry returns when the unlock ends, capped at now+maxLifetime. An expiry that is not
+// RFC 3339, already past, or beyond maxLifetime plus the clock tolerance is rejected, so
+// a single webhook cannot bind a client for longer than one paid unlock lasts.
+func (u Unlock) Expiry(now time.Time, maxLifetime, tolerance time.Duration) (time.Time, error) {
+	ts, err := time.Parse(time.RFC3339, u.ExpiresAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q is not RFC 3339", ErrInvalidExpiry, u.ExpiresAt)
+	}
+	if !ts.After(now) {
+		return time.Time{}, fmt.Errorf("%w: %s is in the past", ErrInvalidExpiry, u.ExpiresAt)
+	}
+	limit := now.Add(maxLifetime)
+	if ts.After(limit.Add(tolerance)) {
+		return time.Time{}, fmt.Errorf("%w: %s is more than %s ahead", ErrInvalidExpiry, u.ExpiresAt, maxLifetime)
+	}
+	if ts.After(limit) {
+		ts = limit
+	}
+	return ts, nil
+}
+
+// UnlockHandler serves /webhooks/unlock, passing authenticated payloads and their expiry,
+// capped at maxLifetime, to onUnlock. With a nil verifier (no shared secret configured)
+// every request is refused.
+func UnlockHandler(v *Verifier, maxLifetime time.Duration, onUnlock func(Unlock, time.Time)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if v == nil {
+			http.Error(w, "unlock webhook is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := v.Verify(r)
+		if err != nil {
+			log.Printf("unlock webhook rejected from %s: %v (%d failures)", r.RemoteAddr, err, v.Failures())
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrSourceNotAllowed) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		var payload Unlock
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		expiry, err := payload.Expiry(v.now(), maxLifetime, v.tolerance)
+		if err != nil {
+			log.Printf("unlock webhook from %s ignored: %v", r.RemoteAddr, err)
+			http.Error(w, "invalid expiresAt", http.StatusBadRequest)
+			return
+		}
+		onUnlock(payload, expiry)
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,213 @@
+// Package webhook authenticates calls from the payments service. Each request carries an
+// HMAC-SHA256 signature over its timestamp, a unique webhook id and the raw body, made with
+// a secret shared by both services:
+//
+//	X-PayHole-Timestamp: 1700000000
+//	X-PayHole-Webhook-Id: 0b7c5f0e-...
+//	X-PayHole-Signature: v1=hex(HMAC-SHA256(secret, timestamp + "." + id + "." + body))
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-PayHole-Timestamp"
+	IDHeader        = "X-PayHole-Webhook-Id"
+	SignatureHeader = "X-PayHole-Signature"
+
+	signaturePrefix = "v1="
+	// MinSecretLength matches the payments service's requirement for its JWT secret.
+	MinSecretLength = 32
+	maxBodyBytes    = 64 << 10
+	maxIDLength     = 128
+)
+
+var (
+	ErrSourceNotAllowed = errors.New("source address not allowed")
+	ErrMissingSignature = errors.New("missing signature headers")
+	ErrStaleTimestamp   = errors.New("timestamp outside tolerance")
+	ErrBadSignature     = errors.New("signature mismatch")
+	ErrReplayed         = errors.New("webhook id already used")
+)
+
+// Verifier checks signed webhook requests and remembers recently used ids so a captured
+// request cannot be replayed within the timestamp tolerance.
+type Verifier struct {
+	secret    []byte
+	tolerance time.Duration
+	sources   []netip.Prefix
+	now       func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+
+	failures atomic.Uint64
+}
+
+// NewVerifier constructs a Verifier. Requests whose timestamp differs from the local clock
+// by more than tolerance are rejected; when sources is non-empty, only callers whose address
+// falls in one of those CIDRs (or equals one of those IPs) are accepted.
+func NewVerifier(secret string, tolerance time.Duration, sources []string) (*Verifier, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("webhook secret must be at least %d characters", MinSecretLength)
+	}
+	if tolerance <= 0 {
+		return nil, errors.New("webhook tolerance must be positive")
+	}
+	v := &Verifier{
+		secret:    []byte(secret),
+		tolerance: tolerance,
+		now:       time.Now,
+		seen:      make(map[string]time.Time),
+	}
+	for _, source := range sources {
+		prefix, err := parsePrefix(source)
+		if err != nil {
+			return nil, err
+		}
+		v.sources = append(v.sources, prefix)
+	}
+	return v, nil
+}
+
+func parsePrefix(source string) (netip.Prefix, error) {
+	source = strings.TrimSpace(source)
+	if !strings.Contains(source, "/") {
+		addr, err := netip.ParseAddr(source)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid webhook source %q: %w", source, err)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(source)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid webhook source %q: %w", source, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// Sign returns the signature header value for a webhook body sent at timestamp with id.
+func Sign(secret []byte, timestamp time.Time, id string, body []byte) string {
+	return signaturePrefix + hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), id, body))
+}
+
+func mac(secret []byte, timestamp, id string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write([]byte(id))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify authenticates r and returns its body. Every rejection is counted in Failures.
+func (v *Verifier) Verify(r *http.Request) ([]byte, error) {
+	body, err := v.verify(r)
+	if err != nil {
+		v.failures.Add(1)
+		return nil, err
+	}
+	return body, nil
+}
+
+func (v *Verifier) verify(r *http.Request) ([]byte, error) {
+	if !v.sourceAllowed(r.RemoteAddr) {
+		return nil, ErrSourceNotAllowed
+	}
+
+	rawTimestamp := r.Header.Get(TimestampHeader)
+	id := r.Header.Get(IDHeader)
+	signature := r.Header.Get(SignatureHeader)
+	if rawTimestamp == "" || id == "" || len(id) > maxIDLength || !strings.HasPrefix(signature, signaturePrefix) {
+		return nil, ErrMissingSignature
+	}
+	unix, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return nil, ErrMissingSignature
+	}
+	now := v.now()
+	sent := time.Unix(unix, 0)
+	if sent.Before(now.Add(-v.tolerance)) || sent.After(now.Add(v.tolerance)) {
+		return nil, ErrStaleTimestamp
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodyBytes {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxBodyBytes)
+	}
+
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil || !hmac.Equal(given, mac(v.secret, rawTimestamp, id, body)) {
+		return nil, ErrBadSignature
+	}
+
+	// Only authenticated ids are remembered, so forged requests cannot fill the cache.
+	if !v.claim(id, sent.Add(v.tolerance), now) {
+		return nil, ErrReplayed
+	}
+	return body, nil
+}
+
+// claim records id until expires, reporting false when it was already recorded.
+func (v *Verifier) claim(id string, expires, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for seenID, until := range v.seen {
+		if now.After(until) {
+			delete(v.seen, seenID)
+		}
+	}
+	if _, ok := v.seen[id]; ok {
+		return false
+	}
+	v.seen[id] = expires
+	return true
+}
+
+func (v *Verifier) sourceAllowed(remoteAddr string) bool {
+	if len(v.sources) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range v.sources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Failures returns the number of rejected webhook requests since startup.
+func (v *Verifier) Failures() uint64 {
+	if v == nil {
+		return 0
+	}
+	return v.failures.Load()
+}
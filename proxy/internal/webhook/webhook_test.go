@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "abcdefghijklmnopqrstuvwxyz1234567890abcdef"
+
+func signedRequest(body, id string, sent time.Time, secret string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/unlock", strings.NewReader(body))
+	r.RemoteAddr = "10.0.0.5:41000"
+	r.Header.Set(TimestampHeader, strconv.FormatInt(sent.Unix(), 10))
+	r.Header.Set(IDHeader, id)
+	r.Header.Set(SignatureHeader, Sign([]byte(secret), sent, id, []byte(body)))
+	return r
+}
+
+func unlockBody(expires time.Time) string {
+	return `{"wallet":"wallet123","expiresAt":"` + expires.UTC().Format(time.RFC3339) + `","clientIp":"203.0.113.10"}`
+}
+
+func TestUnlockHandlerAcceptsSignedWebhookOnce(t *testing.T) {
+	v, err := NewVerifier(testSecret, 5*time.Minute, nil)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	var unlocked []Unlock
+	handler := UnlockHandler(v, 30*24*time.Hour, func(u Unlock, _ time.Time) { unlocked = append(unlocked, u) })
+
+	body := unlockBody(time.Now().Add(24 * time.Hour))
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, signedRequest(body, "id-1", time.Now(), testSecret))
+	if resp.Code != http.StatusAccepted || len(unlocked) != 1 || unlocked[0].ClientIP != "203.0.113.10" {
+		t.Fatalf("expected accepted unlock, got %d %+v", resp.Code, unlocked)
+	}
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, signedRequest(body, "id-1", time.Now(), testSecret))
+	if resp.Code != http.StatusUnauthorized || len(unlocked) != 1 {
+		t.Fatalf("expected replay to be rejected, got %d", resp.Code)
+	}
+	if v.Failures() != 1 {
+		t.Fatalf("expected 1 counted failure, got %d", v.Failures())
+	}
+}
+
+func TestVerifierRejectsForgedAndStaleRequests(t *testing.T) {
+	v, _ := NewVerifier(testSecret, 5*time.Minute, nil)
+	body := `{"clientIp":"203.0.113.10"}`
+
+	unsigned := httptest.NewRequest(http.MethodPost, "/webhooks/unlock", strings.NewReader(body))
+	tampered := signedRequest(body, "id-2", time.Now(), testSecret)
+	tampered.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"clientIp":"198.51.100.1"}`)).Body
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want error
+	}{
+		{"unsigned", unsigned, ErrMissingSignature},
+		{"wrong secret", signedRequest(body, "id-3", time.Now(), strings.Repeat("x", 40)), ErrBadSignature},
+		{"tampered body", tampered, ErrBadSignature},
+		{"stale", signedRequest(body, "id-4", time.Now().Add(-10*time.Minute), testSecret), ErrStaleTimestamp},
+		{"future", signedRequest(body, "id-5", time.Now().Add(10*time.Minute), testSecret), ErrStaleTimestamp},
+	}
+	for _, tc := range tests {
+		if _, err := v.Verify(tc.req); err != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	if v.Failures() != uint64(len(tests)) {
+		t.Fatalf("expected %d failures, got %d", len(tests), v.Failures())
+	}
+}
+
+func TestVerifierRestrictsSourceAddresses(t *testing.T) {
+	v, err := NewVerifier(testSecret, time.Minute, []string{"172.18.0.0/16", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	handler := UnlockHandler(v, time.Hour, func(Unlock, time.Time) {})
+
+	req := signedRequest(`{}`, "id-6", time.Now(), testSecret)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for disallowed source, got %d", resp.Code)
+	}
+
+	req = signedRequest(unlockBody(time.Now().Add(time.Minute)), "id-7", time.Now(), testSecret)
+	req.RemoteAddr = "172.18.0.4:5000"
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected allowed source to be accepted, got %d", resp.Code)
+	}
+}
+
+func TestUnlockHandlerRefusesWithoutSecret(t *testing.T) {
+	if _, err := NewVerifier("short", time.Minute, nil); err == nil {
+		t.Fatal("expected short secret to be rejected")
+	}
+	resp := httptest.NewRecorder()
+	UnlockHandler(nil, time.Hour, func(Unlock, time.Time) { t.Fatal("unexpected unlock") }).ServeHTTP(resp, signedRequest(`{}`, "id", time.Now(), testSecret))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a configured secret, got %d", resp.Code)
+	}
+}
+
+func TestUnlockHandlerBoundsExpiry(t *testing.T) {
+	v, _ := NewVerifier(testSecret, 5*time.Minute, nil)
+	maxLifetime := 30 * 24 * time.Hour
+	var expiries []time.Time
+	handler := UnlockHandler(v, maxLifetime, func(_ Unlock, expiry time.Time) { expiries = append(expiries, expiry) })
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		wantMax time.Time
+	}{
+		{"within lifetime", unlockBody(now.Add(time.Hour)), http.StatusAccepted, now.Add(time.Hour)},
+		{"clock skew is clamped", unlockBody(now.Add(maxLifetime + time.Minute)), http.StatusAccepted, now.Add(maxLifetime)},
+		{"years ahead", unlockBody(now.Add(5 * 365 * 24 * time.Hour)), http.StatusBadRequest, time.Time{}},
+		{"already expired", unlockBody(now.Add(-time.Minute)), http.StatusBadRequest, time.Time{}},
+		{"missing expiry", `{"wallet":"wallet123","clientIp":"203.0.113.10"}`, http.StatusBadRequest, time.Time{}},
+	}
+	for i, tc := range tests {
+		expiries = nil
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, signedRequest(tc.body, "bound-"+strconv.Itoa(i), time.Now(), testSecret))
+		if resp.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, resp.Code)
+		}
+		if tc.status != http.StatusAccepted {
+			if len(expiries) != 0 {
+				t.Fatalf("%s: rejected unlock must not be applied", tc.name)
+			}
+			continue
+		}
+		if len(expiries) != 1 || expiries[0].After(tc.wantMax.Add(time.Second)) {
+			t.Fatalf("%s: expiry %v exceeds %v", tc.name, expiries, tc.wantMax)
+		}
+	}
+}
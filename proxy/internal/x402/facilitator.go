@@ -0,0 +1,144 @@
+package x402
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// PaymentHeader carries the client's signed payment on the retried request.
+	PaymentHeader = "X-PAYMENT"
+	// PaymentResponseHeader carries the settlement result back to the client.
+	PaymentResponseHeader = "X-PAYMENT-RESPONSE"
+)
+
+// PaymentPayload is the decoded content of an X-PAYMENT header.
+type PaymentPayload struct {
+	X402Version int             `json:"x402Version"`
+	Scheme      string          `json:"scheme"`
+	Network     string          `json:"network"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// VerifyResponse is a facilitator's answer to /verify.
+type VerifyResponse struct {
+	IsValid       bool   `json:"isValid"`
+	InvalidReason string `json:"invalidReason,omitempty"`
+	Payer         string `json:"payer,omitempty"`
+}
+
+// SettleResponse is a facilitator's answer to /settle and the body of X-PAYMENT-RESPONSE.
+type SettleResponse struct {
+	Success     bool   `json:"success"`
+	ErrorReason string `json:"errorReason,omitempty"`
+	Transaction string `json:"transaction"`
+	Network     string `json:"network"`
+	Payer       string `json:"payer,omitempty"`
+}
+
+// Facilitator verifies and settles x402 payments on behalf of the proxy.
+type Facilitator interface {
+	Verify(ctx context.Context, paymentHeader string, requirements PaymentRequirements) (*VerifyResponse, error)
+	Settle(ctx context.Context, paymentHeader string, requirements PaymentRequirements) (*SettleResponse, error)
+}
+
+// DecodePaymentHeader parses a base64 encoded X-PAYMENT header.
+func DecodePaymentHeader(header string) (*PaymentPayload, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header))
+	if err != nil {
+		return nil, fmt.Errorf("X-PAYMENT is not base64: %w", err)
+	}
+	var payload PaymentPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, fmt.Errorf("X-PAYMENT is not valid JSON: %w", err)
+	}
+	if payload.X402Version != Version {
+		return nil, fmt.Errorf("unsupported x402 version %d", payload.X402Version)
+	}
+	return &payload, nil
+}
+
+// EncodeSettlement renders a settlement for the X-PAYMENT-RESPONSE header.
+func EncodeSettlement(settlement *SettleResponse) (string, error) {
+	raw, err := json.Marshal(settlement)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// HTTPFacilitator talks to an x402 facilitator over its /verify and /settle endpoints.
+type HTTPFacilitator struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPFacilitator constructs a facilitator client rooted at baseURL.
+func NewHTTPFacilitator(baseURL string, timeout time.Duration) *HTTPFacilitator {
+	return &HTTPFacilitator{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+type facilitatorRequest struct {
+	X402Version         int                 `json:"x402Version"`
+	PaymentHeader       string              `json:"paymentHeader"`
+	PaymentRequirements PaymentRequirements `json:"paymentRequirements"`
+}
+
+// Verify asks the facilitator whether the payment satisfies requirements.
+func (f *HTTPFacilitator) Verify(ctx context.Context, paymentHeader string, requirements PaymentRequirements) (*VerifyResponse, error) {
+	var resp VerifyResponse
+	if err := f.post(ctx, "/verify", paymentHeader, requirements, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Settle asks the facilitator to submit the payment on-chain.
+func (f *HTTPFacilitator) Settle(ctx context.Context, paymentHeader string, requirements PaymentRequirements) (*SettleResponse, error) {
+	var resp SettleResponse
+	if err := f.post(ctx, "/settle", paymentHeader, requirements, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (f *HTTPFacilitator) post(ctx context.Context, path, paymentHeader string, requirements PaymentRequirements, out interface{}) error {
+	body, err := json.Marshal(facilitatorRequest{
+		X402Version:         Version,
+		PaymentHeader:       paymentHeader,
+		PaymentRequirements: requirements,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("facilitator %s returned status %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.New("facilitator returned an invalid response")
+	}
+	return nil
+}
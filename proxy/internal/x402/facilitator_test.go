@@ -0,0 +1,70 @@
+package x402
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPFacilitatorVerifyAndSettle(t *testing.T) {
+	var paths []string
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body facilitatorRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode facilitator request: %v", err)
+		}
+		if body.PaymentHeader != "payment" || body.PaymentRequirements.PayTo != "treasury" {
+			t.Errorf("unexpected facilitator request %+v", body)
+		}
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/verify":
+			_ = json.NewEncoder(w).Encode(VerifyResponse{IsValid: true, Payer: "payer"})
+		case "/settle":
+			_ = json.NewEncoder(w).Encode(SettleResponse{Success: true, Transaction: "sig", Network: "solana"})
+		}
+	}))
+	defer standIn.Close()
+
+	facilitator := NewHTTPFacilitator(standIn.URL+"/", time.Second)
+	requirements := Terms{PayTo: "treasury", Network: "solana", Amount: "1"}.Requirements("https://premium.test/", "unlock")
+
+	verification, err := facilitator.Verify(context.Background(), "payment", requirements)
+	if err != nil || !verification.IsValid || verification.Payer != "payer" {
+		t.Fatalf("unexpected verify result %+v (%v)", verification, err)
+	}
+	settlement, err := facilitator.Settle(context.Background(), "payment", requirements)
+	if err != nil || !settlement.Success || settlement.Transaction != "sig" {
+		t.Fatalf("unexpected settle result %+v (%v)", settlement, err)
+	}
+	if len(paths) != 2 || paths[0] != "/verify" || paths[1] != "/settle" {
+		t.Fatalf("unexpected facilitator calls %v", paths)
+	}
+}
+
+func TestDecodePaymentHeader(t *testing.T) {
+	raw := base64.StdEncoding.EncodeToString([]byte(`{"x402Version":1,"scheme":"exact","network":"solana","payload":{"transaction":"abc"}}`))
+	payload, err := DecodePaymentHeader(raw)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if payload.Scheme != SchemeExact || payload.Network != "solana" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+	if _, err := DecodePaymentHeader("not base64!"); err == nil {
+		t.Fatalf("expected invalid header to fail")
+	}
+}
+
+func TestAtomicAmount(t *testing.T) {
+	if got, err := AtomicAmount(5, USDCDecimals); err != nil || got != "5000000" {
+		t.Fatalf("expected 5000000, got %q (%v)", got, err)
+	}
+	if got, err := AtomicAmount(0.1, USDCDecimals); err != nil || got != "100000" {
+		t.Fatalf("expected 100000, got %q (%v)", got, err)
+	}
+}
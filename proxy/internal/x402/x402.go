@@ -0,0 +1,74 @@
+package x402
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Version is the x402 protocol version PayHole speaks.
+const Version = 1
+
+// SchemeExact is the x402 scheme for paying a fixed amount of an asset.
+const SchemeExact = "exact"
+
+// USDCDecimals is the number of decimal places of the USDC SPL token.
+const USDCDecimals = 6
+
+// PaymentRequirements describes one accepted way to pay, using x402 field names.
+type PaymentRequirements struct {
+	Scheme            string            `json:"scheme"`
+	Network           string            `json:"network"`
+	MaxAmountRequired string            `json:"maxAmountRequired"`
+	Resource          string            `json:"resource"`
+	Description       string            `json:"description"`
+	MimeType          string            `json:"mimeType"`
+	PayTo             string            `json:"payTo"`
+	MaxTimeoutSeconds int               `json:"maxTimeoutSeconds"`
+	Asset             string            `json:"asset"`
+	Extra             map[string]string `json:"extra,omitempty"`
+}
+
+// PaymentRequiredResponse is the JSON body of an x402 402 Payment Required response.
+type PaymentRequiredResponse struct {
+	X402Version int                   `json:"x402Version"`
+	Error       string                `json:"error"`
+	Accepts     []PaymentRequirements `json:"accepts"`
+}
+
+// Terms are the operator's payment settings from which per-resource requirements are built.
+type Terms struct {
+	Network    string
+	Asset      string
+	PayTo      string
+	Amount     string
+	MaxTimeout time.Duration
+}
+
+// Requirements builds the payment requirements for resource.
+func (t Terms) Requirements(resource, description string) PaymentRequirements {
+	timeout := int(t.MaxTimeout / time.Second)
+	if timeout <= 0 {
+		timeout = 60
+	}
+	return PaymentRequirements{
+		Scheme:            SchemeExact,
+		Network:           t.Network,
+		MaxAmountRequired: t.Amount,
+		Resource:          resource,
+		Description:       description,
+		PayTo:             t.PayTo,
+		MaxTimeoutSeconds: timeout,
+		Asset:             t.Asset,
+	}
+}
+
+// AtomicAmount converts a decimal token amount into its smallest units, e.g. 5 USDC to "5000000".
+func AtomicAmount(amount float64, decimals int) (string, error) {
+	if amount <= 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return "", fmt.Errorf("invalid payment amount %v", amount)
+	}
+	units := math.Round(amount * math.Pow10(decimals))
+	return strconv.FormatUint(uint64(units), 10), nil
+}